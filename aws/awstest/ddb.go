@@ -0,0 +1,503 @@
+package awstest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	targetPrefix = "DynamoDB_20120810."
+	errorPrefix  = "com.amazonaws.dynamodb.v20120810#"
+)
+
+func (s *Server) table(name string) (*table, error) {
+	t, ok := s.tables[name]
+	if !ok {
+		return nil, &ddbError{Status: 400, Type: errorPrefix + "ResourceNotFoundException", Message: "Requested resource not found: Table: " + name + " not found"}
+	}
+	return t, nil
+}
+
+// a table keyed by a hash key attribute and perhaps a range key attribute
+type table struct {
+	name, hashKey, rangeKey string
+	items                   map[string]item // by encoded key
+
+	status      string // e.g. "ACTIVE"
+	created     time.Time
+	definitions []attributeDefinition // empty for tables made with Server.CreateTable
+	billingMode string
+	throughput  *throughput
+	gsis, lsis  []*index
+	ttl         string // the time to live attribute, if enabled
+}
+
+// an attribute value as sent, e.g. {"S": "x"}
+type attribute map[string]interface{}
+
+type item map[string]attribute
+
+// an error reported to dynamodb clients, as e.g. {"__type": "...#ResourceNotFoundException", "message": "..."}
+type ddbError struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *ddbError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+func validation(format string, args ...interface{}) error {
+	return &ddbError{Status: 400, Type: errorPrefix + "ValidationException", Message: fmt.Sprintf(format, args...)}
+}
+
+// makes an empty, active, on-demand table, replacing any of the same name. rangeKey may be empty.
+func (s *Server) CreateTable(name, hashKey, rangeKey string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tables[name] = &table{
+		name:        name,
+		hashKey:     hashKey,
+		rangeKey:    rangeKey,
+		items:       make(map[string]item),
+		status:      "ACTIVE",
+		created:     time.Now(),
+		billingMode: "PAY_PER_REQUEST",
+	}
+}
+
+func (s *Server) serveDynamoDB(w http.ResponseWriter, r *http.Request) {
+	out, err := s.dynamoDB(r)
+	if err != nil {
+		e, ok := err.(*ddbError)
+		if !ok {
+			e = &ddbError{Status: 500, Type: errorPrefix + "InternalFailure", Message: err.Error()}
+		}
+		out = map[string]string{"__type": e.Type, "message": e.Message}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(out)
+}
+
+type attributeUpdate struct {
+	Action string
+	Value  attribute
+}
+
+// the fields of the requests the server understands
+type ddbRequest struct {
+	TableName        string
+	Key              item
+	Item             item
+	AttributeUpdates map[string]attributeUpdate
+	AttributesToGet  []string
+	ReturnValues     string
+
+	UpdateExpression          string
+	ConditionExpression       string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]attribute
+}
+
+func (s *Server) dynamoDB(r *http.Request) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verify(r, body); err != nil {
+		var ae *authError
+		if errors.As(err, &ae) {
+			typ := "InvalidSignatureException"
+			switch ae.Code {
+			case "AccessDenied":
+				typ = "MissingAuthenticationTokenException"
+			case "InvalidAccessKeyId":
+				typ = "UnrecognizedClientException"
+			}
+			return nil, &ddbError{Status: 400, Type: "com.amazon.coral.service#" + typ, Message: ae.Message}
+		}
+		return nil, err
+	}
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, targetPrefix) {
+		return nil, &ddbError{Status: 400, Type: "com.amazon.coral.service#UnknownOperationException", Message: target}
+	}
+	var req ddbRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, &ddbError{Status: 400, Type: "com.amazon.coral.service#SerializationException", Message: err.Error()}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch target[len(targetPrefix):] {
+	case "BatchGetItem":
+		return s.batchGet(body)
+	case "BatchWriteItem":
+		return s.batchWrite(body)
+	case "CreateTable":
+		return s.createTable(body)
+	case "ListTables":
+		return s.listTables(body)
+	}
+	t, err := s.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := target[len(targetPrefix):]; op {
+	case "DescribeTable":
+		defer t.settle()
+		return map[string]interface{}{"Table": t.describe()}, nil
+	case "UpdateTable":
+		return t.update(body)
+	case "DeleteTable":
+		return s.deleteTable(t)
+	case "UpdateTimeToLive":
+		return t.updateTimeToLive(body)
+	case "DescribeTimeToLive":
+		return t.describeTimeToLive(), nil
+	case "GetItem":
+		return t.getItem(&req)
+	case "PutItem":
+		return t.putItem(&req)
+	case "DeleteItem":
+		return t.deleteItem(&req)
+	case "UpdateItem":
+		return t.updateItem(&req)
+	case "Query":
+		return t.query(&req, body)
+	case "Scan":
+		return t.scan(&req, body)
+	default:
+		return nil, &ddbError{Status: 400, Type: "com.amazon.coral.service#UnknownOperationException", Message: op}
+	}
+}
+
+// encodes the key of an item, or a key by itself, which must have the table's key attributes
+func (t *table) key(it item, exact bool) (string, error) {
+	names := []string{t.hashKey}
+	if t.rangeKey != "" {
+		names = append(names, t.rangeKey)
+	}
+	if exact && len(it) != len(names) {
+		return "", validation("The provided key element does not match the schema")
+	}
+	var parts []string
+	for _, n := range names {
+		a, ok := it[n]
+		if !ok || !a.scalar() {
+			return "", validation("The provided key element does not match the schema")
+		}
+		buf, err := json.Marshal(a)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, string(buf))
+	}
+	return strings.Join(parts, "\x00"), nil
+}
+
+func (a attribute) scalar() bool {
+	if len(a) != 1 {
+		return false
+	}
+	for k := range a {
+		return k == "S" || k == "N" || k == "B"
+	}
+	return false
+}
+
+func (t *table) getItem(req *ddbRequest) (interface{}, error) {
+	k, err := t.key(req.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	it, ok := t.items[k]
+	if !ok {
+		return struct{}{}, nil
+	}
+	if len(req.AttributesToGet) > 0 {
+		it = project(it, req.AttributesToGet)
+	}
+	return map[string]interface{}{"Item": it}, nil
+}
+
+func (t *table) putItem(req *ddbRequest) (interface{}, error) {
+	k, err := t.key(req.Item, false)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[k]
+	if err := req.check(old); err != nil {
+		return nil, err
+	}
+	t.items[k] = req.Item
+	return returnValues(req.ReturnValues, old, nil, nil)
+}
+
+func (t *table) deleteItem(req *ddbRequest) (interface{}, error) {
+	k, err := t.key(req.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[k]
+	if err := req.check(old); err != nil {
+		return nil, err
+	}
+	delete(t.items, k)
+	return returnValues(req.ReturnValues, old, nil, nil)
+}
+
+func (t *table) updateItem(req *ddbRequest) (interface{}, error) {
+	k, err := t.key(req.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	actions, err := req.actions()
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[k]
+	if err := req.check(old); err != nil {
+		return nil, err
+	}
+	// operands refer to the item as it was
+	before := make(item)
+	for n, a := range req.Key {
+		before[n] = a
+	}
+	for n, a := range old {
+		before[n] = a
+	}
+	it := make(item)
+	for n, a := range before {
+		it[n] = a
+	}
+	var updated []string
+	for _, u := range actions {
+		if _, ok := req.Key[u.name]; ok {
+			return nil, validation("Cannot update attribute %s. This attribute is part of the key", u.name)
+		}
+		var v attribute
+		if u.value != nil {
+			if v = u.value(before); v == nil {
+				return nil, validation("The provided expression refers to an attribute that does not exist in the item")
+			}
+		}
+		switch u.clause {
+		case "SET":
+			it[u.name] = v
+		case "REMOVE":
+			delete(it, u.name)
+		case "ADD":
+			if it[u.name], err = add(it[u.name], v); err != nil {
+				return nil, err
+			}
+		case "DELETE":
+			v, err := remove(it[u.name], v)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				delete(it, u.name)
+			} else {
+				it[u.name] = v
+			}
+		}
+		updated = append(updated, u.name)
+	}
+	t.items[k] = it
+	return returnValues(req.ReturnValues, old, it, updated)
+}
+
+// an update's actions, from its update expression or attribute updates
+func (req *ddbRequest) actions() ([]updateAction, error) {
+	if req.UpdateExpression != "" {
+		if len(req.AttributeUpdates) > 0 {
+			return nil, validation("Can not use both expression and non-expression parameters in the same request")
+		}
+		p, err := newExprParser(req.UpdateExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+		if err != nil {
+			return nil, err
+		}
+		return p.update()
+	}
+	var out []updateAction
+	for name, u := range req.AttributeUpdates {
+		v := u.Value
+		a := updateAction{name: name, value: func(item) attribute { return v }}
+		switch u.Action {
+		case "", "PUT":
+			a.clause = "SET"
+		case "ADD":
+			a.clause = "ADD"
+		case "DELETE":
+			a.clause = "DELETE"
+			if v == nil {
+				a.clause, a.value = "REMOVE", nil
+			}
+		default:
+			return nil, validation("unknown action %q", u.Action)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// checks a write's condition expression, if any, against the item as it is, or nil
+func (req *ddbRequest) check(old item) error {
+	if req.ConditionExpression == "" {
+		return nil
+	}
+	p, err := newExprParser(req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return err
+	}
+	cond, err := p.condition()
+	if err != nil {
+		return err
+	}
+	if err := p.done(); err != nil {
+		return err
+	}
+	if !cond(old) {
+		return &ddbError{Status: 400, Type: errorPrefix + "ConditionalCheckFailedException", Message: "The conditional request failed"}
+	}
+	return nil
+}
+
+// the response to a write, with the attributes asked for
+func returnValues(rv string, before, after item, updated []string) (interface{}, error) {
+	var attrs item
+	switch rv {
+	case "", "NONE":
+	case "ALL_OLD":
+		attrs = before
+	case "ALL_NEW":
+		attrs = after
+	case "UPDATED_OLD":
+		attrs = project(before, updated)
+	case "UPDATED_NEW":
+		attrs = project(after, updated)
+	default:
+		return nil, validation("bad ReturnValues %q", rv)
+	}
+	if len(attrs) == 0 {
+		return struct{}{}, nil
+	}
+	return map[string]interface{}{"Attributes": attrs}, nil
+}
+
+// just the named attributes of an item
+func project(it item, names []string) item {
+	out := make(item)
+	for _, n := range names {
+		if a, ok := it[n]; ok {
+			out[n] = a
+		}
+	}
+	return out
+}
+
+// adds a number to a number, or a set's elements to a set, treating a missing attribute as
+// zero or empty
+func add(a, b attribute) (attribute, error) {
+	if bn, ok := b["N"].(string); ok {
+		an := "0"
+		if a != nil {
+			if an, ok = a["N"].(string); !ok {
+				return a, validation("An operand in the update expression has an incorrect data type")
+			}
+		}
+		x, ok1 := new(big.Rat).SetString(an)
+		y, ok2 := new(big.Rat).SetString(bn)
+		if !ok1 || !ok2 {
+			return a, validation("bad number")
+		}
+		return attribute{"N": decimal(x.Add(x, y))}, nil
+	}
+	typ, elems, ok := set(b)
+	if !ok {
+		return a, validation("ADD is only supported for numbers and sets")
+	}
+	if a == nil {
+		return b, nil
+	}
+	atyp, aelems, ok := set(a)
+	if !ok || atyp != typ {
+		return a, validation("An operand in the update expression has an incorrect data type")
+	}
+	seen := make(map[interface{}]bool)
+	for _, e := range aelems {
+		seen[e] = true
+	}
+	for _, e := range elems {
+		if !seen[e] {
+			aelems = append(aelems, e)
+			seen[e] = true
+		}
+	}
+	return attribute{typ: aelems}, nil
+}
+
+// a decimal string for r, which has a finite decimal expansion when it's a sum of decimals
+func decimal(r *big.Rat) string {
+	p := big.NewInt(1)
+	for n := 0; n < 128; n++ {
+		if new(big.Int).Mod(p, r.Denom()).Sign() == 0 {
+			return r.FloatString(n)
+		}
+		p.Mul(p, big.NewInt(10))
+	}
+	return r.FloatString(38)
+}
+
+// removes a set's elements from another, dropping the attribute if none are left
+func remove(a, b attribute) (attribute, error) {
+	typ, elems, ok := set(b)
+	if !ok {
+		return a, validation("DELETE values must be sets")
+	}
+	if a == nil {
+		return nil, nil
+	}
+	atyp, aelems, ok := set(a)
+	if !ok || atyp != typ {
+		return a, validation("An operand in the update expression has an incorrect data type")
+	}
+	drop := make(map[interface{}]bool)
+	for _, e := range elems {
+		drop[e] = true
+	}
+	var out []interface{}
+	for _, e := range aelems {
+		if !drop[e] {
+			out = append(out, e)
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return attribute{typ: out}, nil
+}
+
+// the type and elements of a set attribute
+func set(a attribute) (string, []interface{}, bool) {
+	for _, typ := range []string{"SS", "NS", "BS"} {
+		if elems, ok := a[typ].([]interface{}); ok {
+			return typ, elems, true
+		}
+	}
+	return "", nil, false
+}
@@ -0,0 +1,127 @@
+package awstest
+
+import (
+	"encoding/json"
+)
+
+type keysAndAttributes struct {
+	Keys            []item
+	ConsistentRead  bool     `json:",omitempty"`
+	AttributesToGet []string `json:",omitempty"`
+}
+
+type writeRequest struct {
+	PutRequest *struct {
+		Item item
+	} `json:",omitempty"`
+	DeleteRequest *struct {
+		Key item
+	} `json:",omitempty"`
+}
+
+// whether another item may be processed in a batch, counting it if so
+func (s *Server) allow(n *int) bool {
+	if s.BatchLimit > 0 && *n >= s.BatchLimit {
+		return false
+	}
+	*n++
+	return true
+}
+
+func (s *Server) batchGet(body []byte) (interface{}, error) {
+	var req struct {
+		RequestItems map[string]keysAndAttributes
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validation("%v", err)
+	}
+	total := 0
+	for _, ka := range req.RequestItems {
+		total += len(ka.Keys)
+	}
+	if total > 100 {
+		return nil, validation("Too many items requested for the BatchGetItem call")
+	}
+	responses := make(map[string][]item)
+	unprocessed := make(map[string]keysAndAttributes)
+	n := 0
+	for name, ka := range req.RequestItems {
+		t, err := s.table(name)
+		if err != nil {
+			return nil, err
+		}
+		responses[name] = []item{}
+		seen := make(map[string]bool)
+		for _, k := range ka.Keys {
+			key, err := t.key(k, true)
+			if err != nil {
+				return nil, err
+			}
+			if seen[key] {
+				return nil, validation("Provided list of item keys contains duplicates")
+			}
+			seen[key] = true
+			if !s.allow(&n) {
+				left := unprocessed[name]
+				left.Keys = append(left.Keys, k)
+				left.ConsistentRead, left.AttributesToGet = ka.ConsistentRead, ka.AttributesToGet
+				unprocessed[name] = left
+				continue
+			}
+			if it, ok := t.items[key]; ok {
+				if len(ka.AttributesToGet) > 0 {
+					it = project(it, ka.AttributesToGet)
+				}
+				responses[name] = append(responses[name], it)
+			}
+		}
+	}
+	return map[string]interface{}{"Responses": responses, "UnprocessedKeys": unprocessed}, nil
+}
+
+func (s *Server) batchWrite(body []byte) (interface{}, error) {
+	var req struct {
+		RequestItems map[string][]writeRequest
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validation("%v", err)
+	}
+	total := 0
+	for _, ws := range req.RequestItems {
+		total += len(ws)
+	}
+	if total > 25 {
+		return nil, validation("Too many items requested for the BatchWriteItem call")
+	}
+	unprocessed := make(map[string][]writeRequest)
+	n := 0
+	for name, ws := range req.RequestItems {
+		t, err := s.table(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range ws {
+			if !s.allow(&n) {
+				unprocessed[name] = append(unprocessed[name], w)
+				continue
+			}
+			switch {
+			case w.PutRequest != nil:
+				key, err := t.key(w.PutRequest.Item, false)
+				if err != nil {
+					return nil, err
+				}
+				t.items[key] = w.PutRequest.Item
+			case w.DeleteRequest != nil:
+				key, err := t.key(w.DeleteRequest.Key, true)
+				if err != nil {
+					return nil, err
+				}
+				delete(t.items, key)
+			default:
+				return nil, validation("empty write request")
+			}
+		}
+	}
+	return map[string]interface{}{"UnprocessedItems": unprocessed}, nil
+}
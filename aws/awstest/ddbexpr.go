@@ -0,0 +1,467 @@
+package awstest
+
+import (
+	"strings"
+	"unicode"
+)
+
+// parses condition, key condition, projection and update expressions, whose attribute
+// names and values may be placeholders like "#n" and ":v". only top-level attribute
+// names are supported, not paths into lists and maps.
+type exprParser struct {
+	toks   []string
+	pos    int
+	names  map[string]string
+	values map[string]attribute
+}
+
+// an operand's value for an item: an attribute, or nil if it's missing, or a constant
+type operand func(it item) attribute
+
+func newExprParser(expr string, names map[string]string, values map[string]attribute) (*exprParser, error) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &exprParser{toks: toks, names: names, values: values}, nil
+}
+
+func tokenize(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),=+-", c):
+			toks = append(toks, s[i:i+1])
+			i++
+		case c == '<' || c == '>':
+			j := i + 1
+			if j < len(s) && (s[j] == '=' || (c == '<' && s[j] == '>')) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case c == '#' || c == ':' || c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			return nil, validation("Invalid expression: unexpected %q", c)
+		}
+	}
+	return toks, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+// whether the next token is tok, ignoring case, consuming it if so
+func (p *exprParser) accept(tok string) bool {
+	if strings.EqualFold(p.peek(), tok) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(tok string) error {
+	if !p.accept(tok) {
+		return validation("Invalid expression: expected %q at %q", tok, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) done() error {
+	if p.pos < len(p.toks) {
+		return validation("Invalid expression: unexpected %q", p.peek())
+	}
+	return nil
+}
+
+// an attribute name, perhaps given by a placeholder
+func (p *exprParser) name() (string, error) {
+	tok := p.peek()
+	p.pos++
+	switch {
+	case strings.HasPrefix(tok, "#"):
+		n, ok := p.names[tok]
+		if !ok {
+			return "", validation("An expression attribute name used in the document path is not defined; attribute name: %s", tok)
+		}
+		return n, nil
+	case tok == "" || strings.HasPrefix(tok, ":") || strings.ContainsAny(tok, "(),=<>+-"):
+		return "", validation("Invalid expression: expected an attribute name at %q", tok)
+	}
+	return tok, nil
+}
+
+func (p *exprParser) operand() (operand, error) {
+	if tok := p.peek(); strings.HasPrefix(tok, ":") {
+		p.pos++
+		v, ok := p.values[tok]
+		if !ok {
+			return nil, validation("An expression attribute value used in expression is not defined; attribute value: %s", tok)
+		}
+		return func(item) attribute { return v }, nil
+	}
+	n, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	return func(it item) attribute { return it[n] }, nil
+}
+
+// a condition expression's value for an item
+type predicate func(it item) bool
+
+func (p *exprParser) condition() (predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) bool { return l(it) || right(it) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) and() (predicate, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) bool { return l(it) && right(it) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) not() (predicate, error) {
+	if p.accept("NOT") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool { return !e(it) }, nil
+	}
+	return p.primary()
+}
+
+var comparators = map[string]string{"=": "EQ", "<>": "NE", "<": "LT", "<=": "LE", ">": "GT", ">=": "GE"}
+
+func (p *exprParser) primary() (predicate, error) {
+	if p.accept("(") {
+		e, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	switch f := strings.ToLower(p.peek()); f {
+	case "attribute_exists", "attribute_not_exists", "begins_with", "contains":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		a, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		var b operand
+		if f == "begins_with" || f == "contains" {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if b, err = p.operand(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			switch f {
+			case "attribute_exists":
+				return a(it) != nil
+			case "attribute_not_exists":
+				return a(it) == nil
+			case "begins_with":
+				return condition{"BEGINS_WITH", []attribute{b(it)}}.match(a(it))
+			default:
+				return condition{"CONTAINS", []attribute{b(it)}}.match(a(it))
+			}
+		}, nil
+	}
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := p.peek(); {
+	case comparators[tok] != "":
+		p.pos++
+		b, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		op := comparators[tok]
+		return func(it item) bool {
+			x, y := a(it), b(it)
+			if x == nil || y == nil {
+				return false
+			}
+			return condition{op, []attribute{y}}.match(x)
+		}, nil
+	case strings.EqualFold(tok, "BETWEEN"):
+		p.pos++
+		lo, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			return condition{"BETWEEN", []attribute{lo(it), hi(it)}}.match(a(it))
+		}, nil
+	case strings.EqualFold(tok, "IN"):
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var list []operand
+		for {
+			b, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, b)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			var vs []attribute
+			for _, b := range list {
+				vs = append(vs, b(it))
+			}
+			return condition{"IN", vs}.match(a(it))
+		}, nil
+	}
+	return nil, validation("Invalid expression: unexpected %q", p.peek())
+}
+
+// a key condition expression's conditions, by attribute: comparisons, BETWEEN and
+// begins_with, joined by AND, with one for each key attribute
+func (p *exprParser) keyConditions() (map[string]condition, error) {
+	out := make(map[string]condition)
+	for {
+		parens := p.accept("(")
+		name, c, err := p.keyCondition()
+		if err != nil {
+			return nil, err
+		}
+		if parens {
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := out[name]; ok {
+			return nil, validation("Invalid KeyConditionExpression: An attribute name is specified more than once: %s", name)
+		}
+		out[name] = c
+		if !p.accept("AND") {
+			break
+		}
+	}
+	return out, p.done()
+}
+
+func (p *exprParser) keyCondition() (string, condition, error) {
+	value := func() (attribute, error) {
+		tok := p.peek()
+		p.pos++
+		v, ok := p.values[tok]
+		if !ok {
+			return nil, validation("Invalid KeyConditionExpression: expected a defined attribute value at %q", tok)
+		}
+		return v, nil
+	}
+	if p.accept("begins_with") {
+		if err := p.expect("("); err != nil {
+			return "", condition{}, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return "", condition{}, err
+		}
+		if err := p.expect(","); err != nil {
+			return "", condition{}, err
+		}
+		v, err := value()
+		if err != nil {
+			return "", condition{}, err
+		}
+		return name, condition{"BEGINS_WITH", []attribute{v}}, p.expect(")")
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", condition{}, err
+	}
+	if p.accept("BETWEEN") {
+		lo, err := value()
+		if err != nil {
+			return "", condition{}, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return "", condition{}, err
+		}
+		hi, err := value()
+		if err != nil {
+			return "", condition{}, err
+		}
+		return name, condition{"BETWEEN", []attribute{lo, hi}}, nil
+	}
+	op := comparators[p.peek()]
+	if op == "" || op == "NE" {
+		return "", condition{}, validation("Invalid KeyConditionExpression: unsupported operator %q", p.peek())
+	}
+	p.pos++
+	v, err := value()
+	if err != nil {
+		return "", condition{}, err
+	}
+	return name, condition{op, []attribute{v}}, nil
+}
+
+// a projection expression's attribute names, separated by commas
+func (p *exprParser) projection() ([]string, error) {
+	var out []string
+	for {
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+		if !p.accept(",") {
+			break
+		}
+	}
+	return out, p.done()
+}
+
+// an update expression's action on one attribute
+type updateAction struct {
+	clause string // SET, REMOVE, ADD or DELETE
+	name   string
+	value  operand // nil for REMOVE
+}
+
+func (p *exprParser) update() ([]updateAction, error) {
+	var out []updateAction
+	seen := make(map[string]bool)
+	for p.pos < len(p.toks) {
+		clause := strings.ToUpper(p.peek())
+		switch clause {
+		case "SET", "REMOVE", "ADD", "DELETE":
+		default:
+			return nil, validation("Invalid UpdateExpression: unexpected %q", p.peek())
+		}
+		if seen[clause] {
+			return nil, validation("Invalid UpdateExpression: The \"%s\" section can only be used once in an update expression", clause)
+		}
+		seen[clause] = true
+		p.pos++
+		for {
+			n, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			u := updateAction{clause: clause, name: n}
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				if u.value, err = p.sum(); err != nil {
+					return nil, err
+				}
+			case "ADD", "DELETE":
+				if u.value, err = p.operand(); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, u)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, validation("Invalid UpdateExpression: empty")
+	}
+	return out, nil
+}
+
+// an operand, or the sum or difference of two numeric ones, as in "SET n = n + :one"
+func (p *exprParser) sum() (operand, error) {
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	sign := p.peek()
+	if sign != "+" && sign != "-" {
+		return a, nil
+	}
+	p.pos++
+	b, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(it item) attribute {
+		x, y := a(it), b(it)
+		if sign == "-" {
+			if n, ok := y["N"].(string); ok {
+				if strings.HasPrefix(n, "-") {
+					n = n[1:]
+				} else {
+					n = "-" + n
+				}
+				y = attribute{"N": n}
+			}
+		}
+		if x == nil || y == nil {
+			return nil
+		}
+		v, err := add(x, y)
+		if err != nil {
+			return nil
+		}
+		return v
+	}, nil
+}
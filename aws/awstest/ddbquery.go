@@ -0,0 +1,341 @@
+package awstest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+type condition struct {
+	ComparisonOperator string
+	AttributeValueList []attribute
+}
+
+// fields of Query and Scan requests
+type pageRequest struct {
+	IndexName              string
+	KeyConditions          map[string]condition
+	QueryFilter            map[string]condition
+	ScanFilter             map[string]condition
+	KeyConditionExpression string
+	FilterExpression       string
+	ProjectionExpression   string
+	ScanIndexForward       *bool
+	Limit                  int
+	ExclusiveStartKey      item
+	Segment                int
+	TotalSegments          int
+}
+
+// the request's key conditions, filter and attributes to get, from its expressions
+// or from the legacy parameters, which can't be mixed
+func (q *pageRequest) parse(req *ddbRequest, filter map[string]condition) (map[string]condition, predicate, []string, error) {
+	legacy := len(q.KeyConditions) > 0 || len(filter) > 0 || len(req.AttributesToGet) > 0
+	expr := q.KeyConditionExpression != "" || q.FilterExpression != "" || q.ProjectionExpression != ""
+	switch {
+	case legacy && expr:
+		return nil, nil, nil, validation("Can not use both expression and non-expression parameters in the same request")
+	case legacy:
+		return q.KeyConditions, func(it item) bool { return matches(it, filter) }, req.AttributesToGet, nil
+	}
+	parser := func(expr string) (*exprParser, error) {
+		return newExprParser(expr, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	}
+	var keys map[string]condition
+	if q.KeyConditionExpression != "" {
+		p, err := parser(q.KeyConditionExpression)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if keys, err = p.keyConditions(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	match := func(item) bool { return true }
+	if q.FilterExpression != "" {
+		p, err := parser(q.FilterExpression)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if match, err = p.condition(); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := p.done(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	var names []string
+	if q.ProjectionExpression != "" {
+		p, err := parser(q.ProjectionExpression)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if names, err = p.projection(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return keys, match, names, nil
+}
+
+func (t *table) query(req *ddbRequest, body []byte) (interface{}, error) {
+	var q pageRequest
+	json.Unmarshal(body, &q)
+	if q.IndexName != "" {
+		return nil, validation("The table does not have the specified index: %s", q.IndexName)
+	}
+	keys, filter, names, err := q.parse(req, q.QueryFilter)
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := keys[t.hashKey]
+	if !ok || hash.ComparisonOperator != "EQ" {
+		return nil, validation("Query condition missed key schema element: %s", t.hashKey)
+	}
+	for name, c := range keys {
+		if name != t.hashKey && name != t.rangeKey {
+			return nil, validation("Query condition missed key schema element")
+		}
+		switch c.ComparisonOperator {
+		case "EQ", "LT", "LE", "GT", "GE", "BEGINS_WITH", "BETWEEN":
+		default:
+			return nil, validation("Unsupported operator on KeyCondition: %s", c.ComparisonOperator)
+		}
+	}
+	var items []item
+	for _, it := range t.items {
+		if matches(it, keys) {
+			items = append(items, it)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return compare(items[i][t.rangeKey], items[j][t.rangeKey]) < 0
+	})
+	if q.ScanIndexForward != nil && !*q.ScanIndexForward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	return t.page(items, &q, filter, names)
+}
+
+func (t *table) scan(req *ddbRequest, body []byte) (interface{}, error) {
+	var q pageRequest
+	json.Unmarshal(body, &q)
+	if q.IndexName != "" {
+		return nil, validation("The table does not have the specified index: %s", q.IndexName)
+	}
+	if q.TotalSegments > 0 && (q.Segment < 0 || q.Segment >= q.TotalSegments) {
+		return nil, validation("Segment must be less than TotalSegments")
+	}
+	if q.KeyConditionExpression != "" {
+		return nil, validation("KeyConditionExpression can only be used with Query")
+	}
+	_, filter, names, err := q.parse(req, q.ScanFilter)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k := range t.items {
+		if q.TotalSegments > 0 {
+			h := fnv.New32a()
+			h.Write([]byte(k))
+			if int(h.Sum32()%uint32(q.TotalSegments)) != q.Segment {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var items []item
+	for _, k := range keys {
+		items = append(items, t.items[k])
+	}
+	return t.page(items, &q, filter, names)
+}
+
+// the page of items, in order, after the start key and up to the limit, then filtered
+func (t *table) page(items []item, q *pageRequest, filter predicate, names []string) (interface{}, error) {
+	if q.ExclusiveStartKey != nil {
+		start, err := t.key(q.ExclusiveStartKey, true)
+		if err != nil {
+			return nil, err
+		}
+		for i, it := range items {
+			if k, _ := t.key(it, false); k == start {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+	var last item
+	if q.Limit > 0 && len(items) > q.Limit {
+		items = items[:q.Limit]
+		last = t.keyOf(items[len(items)-1])
+	}
+	scanned := len(items)
+	out := []item{}
+	for _, it := range items {
+		if !filter(it) {
+			continue
+		}
+		if len(names) > 0 {
+			it = project(it, names)
+		}
+		out = append(out, it)
+	}
+	resp := map[string]interface{}{
+		"Items":            out,
+		"Count":            len(out),
+		"ScannedCount":     scanned,
+		"ConsumedCapacity": map[string]interface{}{"TableName": t.name, "CapacityUnits": 0.5 * float64(scanned)},
+	}
+	if last != nil {
+		resp["LastEvaluatedKey"] = last
+	}
+	return resp, nil
+}
+
+// just the key attributes of an item
+func (t *table) keyOf(it item) item {
+	names := []string{t.hashKey}
+	if t.rangeKey != "" {
+		names = append(names, t.rangeKey)
+	}
+	return project(it, names)
+}
+
+func matches(it item, conditions map[string]condition) bool {
+	for name, c := range conditions {
+		if !c.match(it[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) match(a attribute) bool {
+	vs := c.AttributeValueList
+	arg := func(i int) attribute {
+		if i < len(vs) {
+			return vs[i]
+		}
+		return nil
+	}
+	switch c.ComparisonOperator {
+	case "NULL":
+		return a == nil
+	case "NOT_NULL":
+		return a != nil
+	}
+	if a == nil {
+		return c.ComparisonOperator == "NE" || c.ComparisonOperator == "NOT_CONTAINS"
+	}
+	switch c.ComparisonOperator {
+	case "EQ":
+		return equal(a, arg(0))
+	case "NE":
+		return !equal(a, arg(0))
+	case "LT":
+		return sameScalar(a, arg(0)) && compare(a, arg(0)) < 0
+	case "LE":
+		return sameScalar(a, arg(0)) && compare(a, arg(0)) <= 0
+	case "GT":
+		return sameScalar(a, arg(0)) && compare(a, arg(0)) > 0
+	case "GE":
+		return sameScalar(a, arg(0)) && compare(a, arg(0)) >= 0
+	case "BETWEEN":
+		return sameScalar(a, arg(0)) && sameScalar(a, arg(1)) && compare(a, arg(0)) >= 0 && compare(a, arg(1)) <= 0
+	case "BEGINS_WITH":
+		x, y := scalar(a), scalar(arg(0))
+		return sameScalar(a, arg(0)) && a["N"] == nil && strings.HasPrefix(string(x), string(y))
+	case "IN":
+		for _, v := range vs {
+			if equal(a, v) {
+				return true
+			}
+		}
+		return false
+	case "CONTAINS":
+		return contains(a, arg(0))
+	case "NOT_CONTAINS":
+		return !contains(a, arg(0))
+	}
+	return false
+}
+
+func equal(a, b attribute) bool {
+	if _, ok := a["N"]; ok && sameScalar(a, b) {
+		return compare(a, b) == 0
+	}
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+// whether a and b are scalars of the same type
+func sameScalar(a, b attribute) bool {
+	if !a.scalar() || !b.scalar() {
+		return false
+	}
+	for k := range a {
+		_, ok := b[k]
+		return ok
+	}
+	return false
+}
+
+// orders scalars: numbers numerically, strings and binaries bytewise
+func compare(a, b attribute) int {
+	if x, ok := a["N"].(string); ok {
+		y, _ := b["N"].(string)
+		p, _ := new(big.Rat).SetString(x)
+		q, _ := new(big.Rat).SetString(y)
+		if p == nil || q == nil {
+			return strings.Compare(x, y)
+		}
+		return p.Cmp(q)
+	}
+	return bytes.Compare(scalar(a), scalar(b))
+}
+
+// a string or binary's bytes
+func scalar(a attribute) []byte {
+	if s, ok := a["S"].(string); ok {
+		return []byte(s)
+	}
+	if s, ok := a["B"].(string); ok {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return b
+	}
+	return nil
+}
+
+// whether a string contains a substring, or a set or list an element
+func contains(a, v attribute) bool {
+	if s, ok := a["S"].(string); ok {
+		sub, ok := v["S"].(string)
+		return ok && strings.Contains(s, sub)
+	}
+	if _, elems, ok := set(a); ok {
+		for _, e := range elems {
+			for _, x := range v {
+				if e == x {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if l, ok := a["L"].([]interface{}); ok {
+		for _, e := range l {
+			if m, ok := e.(map[string]interface{}); ok && equal(m, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,360 @@
+package awstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type keySchemaElement struct {
+	AttributeName, KeyType string
+}
+
+type attributeDefinition struct {
+	AttributeName, AttributeType string
+}
+
+type throughput struct {
+	ReadCapacityUnits, WriteCapacityUnits int64
+}
+
+type index struct {
+	IndexName             string
+	IndexStatus           string `json:",omitempty"`
+	KeySchema             []keySchemaElement
+	Projection            json.RawMessage
+	ProvisionedThroughput *throughput `json:",omitempty"`
+}
+
+// fields of CreateTable and UpdateTable requests
+type tableRequest struct {
+	TableName                   string
+	KeySchema                   []keySchemaElement
+	AttributeDefinitions        []attributeDefinition
+	BillingMode                 string
+	ProvisionedThroughput       *throughput
+	GlobalSecondaryIndexes      []*index
+	LocalSecondaryIndexes       []*index
+	GlobalSecondaryIndexUpdates []struct {
+		Create *index
+		Delete *struct {
+			IndexName string
+		}
+	}
+}
+
+func resourceInUse(format string, args ...interface{}) error {
+	return &ddbError{Status: 400, Type: errorPrefix + "ResourceInUseException", Message: fmt.Sprintf(format, args...)}
+}
+
+// a table made through the api starts out CREATING, and becomes ACTIVE once
+// described, as do its indexes; see settle
+func (s *Server) createTable(body []byte) (interface{}, error) {
+	var req tableRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validation("%v", err)
+	}
+	if req.TableName == "" {
+		return nil, validation("TableName must be specified")
+	}
+	if _, ok := s.tables[req.TableName]; ok {
+		return nil, resourceInUse("Table already exists: %s", req.TableName)
+	}
+	t := &table{
+		name:        req.TableName,
+		items:       make(map[string]item),
+		status:      "CREATING",
+		created:     time.Now(),
+		definitions: req.AttributeDefinitions,
+		gsis:        req.GlobalSecondaryIndexes,
+		lsis:        req.LocalSecondaryIndexes,
+	}
+	if err := t.billing(req.BillingMode, req.ProvisionedThroughput); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, x := range append(append([]*index{}, t.gsis...), t.lsis...) {
+		if names[x.IndexName] {
+			return nil, validation("Duplicate index name: %s", x.IndexName)
+		}
+		names[x.IndexName] = true
+	}
+	used := make(map[string]bool)
+	var err error
+	if t.hashKey, t.rangeKey, err = t.keySchema(req.KeySchema, used); err != nil {
+		return nil, err
+	}
+	for _, x := range t.gsis {
+		if err := t.index(x, true, used); err != nil {
+			return nil, err
+		}
+	}
+	for _, x := range t.lsis {
+		if err := t.index(x, false, used); err != nil {
+			return nil, err
+		}
+		if x.KeySchema[0].AttributeName != t.hashKey || len(x.KeySchema) != 2 {
+			return nil, validation("Local secondary index %s must have the table's hash key and a range key", x.IndexName)
+		}
+	}
+	if len(used) != len(t.definitions) {
+		return nil, validation("One or more parameter values were invalid: Some AttributeDefinitions are not used")
+	}
+	s.tables[t.name] = t
+	return map[string]interface{}{"TableDescription": t.describe()}, nil
+}
+
+func (t *table) billing(mode string, tp *throughput) error {
+	switch mode {
+	case "", "PROVISIONED":
+		if tp == nil {
+			return validation("One or more parameter values were invalid: ReadCapacityUnits and WriteCapacityUnits must both be specified when BillingMode is PROVISIONED")
+		}
+		t.billingMode = "PROVISIONED"
+	case "PAY_PER_REQUEST":
+		if tp != nil {
+			return validation("One or more parameter values were invalid: Neither ReadCapacityUnits nor WriteCapacityUnits can be specified when BillingMode is PAY_PER_REQUEST")
+		}
+		t.billingMode = mode
+	default:
+		return validation("Unknown BillingMode: %s", mode)
+	}
+	t.throughput = tp
+	return nil
+}
+
+// checks a key schema against the table's attribute definitions, noting the
+// attributes it uses
+func (t *table) keySchema(schema []keySchemaElement, used map[string]bool) (hash, rng string, err error) {
+	for i, e := range schema {
+		switch {
+		case i == 0 && e.KeyType == "HASH":
+			hash = e.AttributeName
+		case i == 1 && e.KeyType == "RANGE":
+			rng = e.AttributeName
+		default:
+			return "", "", validation("Invalid KeySchema: the first element must be HASH, and the optional second RANGE")
+		}
+		if t.attributeType(e.AttributeName) == "" {
+			return "", "", validation("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions: %s", e.AttributeName)
+		}
+		used[e.AttributeName] = true
+	}
+	if hash == "" {
+		return "", "", validation("Invalid KeySchema: no HASH key")
+	}
+	return hash, rng, nil
+}
+
+func (t *table) attributeType(name string) string {
+	for _, d := range t.definitions {
+		if d.AttributeName == name {
+			return d.AttributeType
+		}
+	}
+	return ""
+}
+
+func (t *table) index(x *index, global bool, used map[string]bool) error {
+	if x.IndexName == "" {
+		return validation("IndexName must be specified")
+	}
+	if _, _, err := t.keySchema(x.KeySchema, used); err != nil {
+		return err
+	}
+	if !global {
+		return nil
+	}
+	if (t.billingMode == "PROVISIONED") != (x.ProvisionedThroughput != nil) {
+		return validation("One or more parameter values were invalid: ProvisionedThroughput must be specified for index %s exactly when the table is PROVISIONED", x.IndexName)
+	}
+	x.IndexStatus = "CREATING"
+	return nil
+}
+
+func (t *table) hasIndex(name string) bool {
+	for _, x := range append(append([]*index{}, t.gsis...), t.lsis...) {
+		if x.IndexName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *table) describe() interface{} {
+	schema := []keySchemaElement{{t.hashKey, "HASH"}}
+	if t.rangeKey != "" {
+		schema = append(schema, keySchemaElement{t.rangeKey, "RANGE"})
+	}
+	out := map[string]interface{}{
+		"TableName":          t.name,
+		"TableArn":           "arn:aws:dynamodb:us-east-1:000000000000:table/" + t.name,
+		"TableStatus":        t.status,
+		"KeySchema":          schema,
+		"ItemCount":          len(t.items),
+		"CreationDateTime":   float64(t.created.UnixNano()) / 1e9,
+		"BillingModeSummary": map[string]string{"BillingMode": t.billingMode},
+	}
+	if len(t.definitions) > 0 {
+		out["AttributeDefinitions"] = t.definitions
+	}
+	if t.throughput != nil {
+		out["ProvisionedThroughput"] = t.throughput
+	}
+	if len(t.gsis) > 0 {
+		out["GlobalSecondaryIndexes"] = t.gsis
+	}
+	if len(t.lsis) > 0 {
+		out["LocalSecondaryIndexes"] = t.lsis
+	}
+	return out
+}
+
+// finishes creating or updating the table and its indexes
+func (t *table) settle() {
+	t.status = "ACTIVE"
+	var gsis []*index
+	for _, x := range t.gsis {
+		switch x.IndexStatus {
+		case "DELETING":
+			continue
+		case "CREATING":
+			x.IndexStatus = "ACTIVE"
+		}
+		gsis = append(gsis, x)
+	}
+	t.gsis = gsis
+}
+
+func (t *table) update(body []byte) (interface{}, error) {
+	var req tableRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validation("%v", err)
+	}
+	if t.status != "ACTIVE" {
+		return nil, resourceInUse("Attempt to change a resource which is still in use: Table is being %s: %s", t.status, t.name)
+	}
+	if len(req.GlobalSecondaryIndexUpdates) > 1 {
+		return nil, validation("Subscriber limit exceeded: Only 1 online index can be created or deleted simultaneously per table")
+	}
+	if req.BillingMode != "" || req.ProvisionedThroughput != nil {
+		mode := req.BillingMode
+		if mode == "" {
+			mode = t.billingMode
+		}
+		if err := t.billing(mode, req.ProvisionedThroughput); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range req.GlobalSecondaryIndexUpdates {
+		switch {
+		case u.Create != nil:
+			if t.hasIndex(u.Create.IndexName) {
+				return nil, validation("Duplicate index name: %s", u.Create.IndexName)
+			}
+			for _, d := range req.AttributeDefinitions {
+				switch ty := t.attributeType(d.AttributeName); ty {
+				case "":
+					t.definitions = append(t.definitions, d)
+				case d.AttributeType:
+				default:
+					return nil, validation("Cannot change the type of attribute %s", d.AttributeName)
+				}
+			}
+			if err := t.index(u.Create, true, make(map[string]bool)); err != nil {
+				return nil, err
+			}
+			t.gsis = append(t.gsis, u.Create)
+		case u.Delete != nil:
+			found := false
+			for _, x := range t.gsis {
+				if x.IndexName == u.Delete.IndexName {
+					x.IndexStatus, found = "DELETING", true
+				}
+			}
+			if !found {
+				return nil, &ddbError{Status: 400, Type: errorPrefix + "ResourceNotFoundException", Message: "Requested resource not found: Index: " + u.Delete.IndexName + " not found"}
+			}
+		}
+	}
+	t.status = "UPDATING"
+	return map[string]interface{}{"TableDescription": t.describe()}, nil
+}
+
+// deletes the table at once, though it's reported as DELETING
+func (s *Server) deleteTable(t *table) (interface{}, error) {
+	if t.status == "CREATING" || t.status == "UPDATING" {
+		return nil, resourceInUse("Attempt to change a resource which is still in use: Table is being %s: %s", t.status, t.name)
+	}
+	delete(s.tables, t.name)
+	t.status = "DELETING"
+	return map[string]interface{}{"TableDescription": t.describe()}, nil
+}
+
+// pages through the table names in order, ListPageSize at a time unless Limit is smaller
+func (s *Server) listTables(body []byte) (interface{}, error) {
+	var req struct {
+		ExclusiveStartTableName string
+		Limit                   int
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validation("%v", err)
+	}
+	limit := s.ListPageSize
+	if limit <= 0 {
+		limit = 100
+	}
+	if req.Limit > 0 && req.Limit < limit {
+		limit = req.Limit
+	}
+	var names []string
+	for name := range s.tables {
+		if name > req.ExclusiveStartTableName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := map[string]interface{}{"TableNames": names}
+	if len(names) > limit {
+		out["TableNames"] = names[:limit]
+		out["LastEvaluatedTableName"] = names[limit-1]
+	}
+	return out, nil
+}
+
+func (t *table) updateTimeToLive(body []byte) (interface{}, error) {
+	var req struct {
+		TimeToLiveSpecification struct {
+			AttributeName string
+			Enabled       bool
+		}
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validation("%v", err)
+	}
+	spec := req.TimeToLiveSpecification
+	switch {
+	case spec.AttributeName == "":
+		return nil, validation("TimeToLiveSpecification.AttributeName must be specified")
+	case spec.Enabled && t.ttl != "":
+		return nil, validation("TimeToLive is already enabled")
+	case !spec.Enabled && t.ttl == "":
+		return nil, validation("TimeToLive is already disabled")
+	case !spec.Enabled && t.ttl != spec.AttributeName:
+		return nil, validation("TimeToLive is enabled on a different attribute: %s", t.ttl)
+	}
+	t.ttl = ""
+	if spec.Enabled {
+		t.ttl = spec.AttributeName
+	}
+	return map[string]interface{}{"TimeToLiveSpecification": spec}, nil
+}
+
+func (t *table) describeTimeToLive() interface{} {
+	d := map[string]string{"TimeToLiveStatus": "DISABLED"}
+	if t.ttl != "" {
+		d["TimeToLiveStatus"], d["AttributeName"] = "ENABLED", t.ttl
+	}
+	return map[string]interface{}{"TimeToLiveDescription": d}
+}
@@ -0,0 +1,766 @@
+package awstest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws"
+	"github.com/xoba/goutil/aws/s3"
+)
+
+// an s3 request, parsed
+type s3Request struct {
+	*http.Request
+	w      http.ResponseWriter
+	i      s3.Interface
+	object s3.Object
+	query  url.Values
+	body   []byte
+}
+
+func (r *s3Request) has(param string) bool {
+	_, ok := r.query[param]
+	return ok
+}
+
+func (s *Server) serveS3(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s3Error(w, r, id, err)
+		return
+	}
+	req := &s3Request{
+		Request: r,
+		w:       w,
+		i:       s.S3.WithContext(r.Context()),
+		object:  parsePath(r.URL.Path),
+		query:   r.URL.Query(),
+		body:    body,
+	}
+	if req.isPost() {
+		if err := s.postObject(req); err != nil {
+			s3Error(w, r, id, err)
+		}
+		return
+	}
+	if err := s.verify(r, body); err != nil {
+		// like s3, anyone may read from a public bucket
+		if !(r.Header.Get("Authorization") == "" && !req.has("X-Amz-Signature") && s.public(req)) {
+			s3Error(w, r, id, err)
+			return
+		}
+	}
+	if req.body, err = decodeChunked(r.Header, body); err != nil {
+		s3Error(w, r, id, err)
+		return
+	}
+	if err := checkContentMD5(r.Header, req.body); err != nil {
+		s3Error(w, r, id, err)
+		return
+	}
+	switch {
+	case req.object.Bucket == "":
+		err = req.service()
+	case req.object.Key == "":
+		err = req.bucket()
+	default:
+		err = req.obj()
+	}
+	if err != nil {
+		s3Error(w, r, id, err)
+	}
+}
+
+func (s *Server) public(req *s3Request) bool {
+	return (req.Method == "GET" || req.Method == "HEAD") && req.object.Key != "" && s.S3.IsPublic(req.object.Bucket)
+}
+
+// the bucket and key of a path-style url path
+func parsePath(p string) s3.Object {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return s3.Object{Bucket: p[:i], Key: p[i+1:]}
+	}
+	return s3.Object{Bucket: p}
+}
+
+func checkContentMD5(h http.Header, body []byte) error {
+	v := h.Get("Content-MD5")
+	if v == "" {
+		return nil
+	}
+	d, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(d) != md5.Size {
+		return &s3.Error{StatusCode: 400, Code: "InvalidDigest", Message: "bad Content-MD5: " + v}
+	}
+	if sum := md5.Sum(body); string(d) != string(sum[:]) {
+		return &s3.Error{StatusCode: 400, Code: "BadDigest", Message: "Content-MD5 doesn't match the body"}
+	}
+	return nil
+}
+
+// reports err as s3 error xml, or just a status for HEAD requests and 304's
+func s3Error(w http.ResponseWriter, r *http.Request, id string, err error) {
+	e := &s3.Error{StatusCode: 400, Code: "InvalidRequest", Message: err.Error()}
+	var se *s3.Error
+	var ae *authError
+	switch {
+	case errors.As(err, &se):
+		c := *se
+		e = &c
+	case errors.As(err, &ae):
+		e = &s3.Error{StatusCode: ae.Status, Code: ae.Code, Message: ae.Message}
+	case errors.Is(err, r.Context().Err()):
+		e = &s3.Error{StatusCode: 500, Code: "InternalError", Message: err.Error()}
+	}
+	e.Resource = r.URL.Path
+	e.RequestId = id
+	if r.Method == "HEAD" || e.StatusCode == 304 {
+		w.WriteHeader(e.StatusCode)
+		return
+	}
+	writeXML(w, e.StatusCode, e)
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) error {
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(buf)
+	return nil
+}
+
+func (r *s3Request) service() error {
+	if r.Method != "GET" {
+		return notImplemented(r.Request)
+	}
+	b, err := r.i.Buckets()
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, b)
+}
+
+func notImplemented(r *http.Request) error {
+	return &s3.Error{StatusCode: 501, Code: "NotImplemented", Message: fmt.Sprintf("%s %s isn't supported", r.Method, r.URL)}
+}
+
+func malformedXML(err error) error {
+	return &s3.Error{StatusCode: 400, Code: "MalformedXML", Message: err.Error()}
+}
+
+func (r *s3Request) bucket() error {
+	bucket := r.object.Bucket
+	switch r.Method {
+	case "GET":
+		switch {
+		case r.has("policy"):
+			p, err := r.i.GetBucketPolicy(bucket)
+			if err != nil {
+				return err
+			}
+			buf, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			r.w.Header().Set("Content-Type", "application/json")
+			r.w.Write(buf)
+			return nil
+		case r.has("lifecycle"):
+			c, err := r.i.GetBucketLifecycle(bucket)
+			if err != nil {
+				return err
+			}
+			return writeXML(r.w, 200, c)
+		case r.has("cors"):
+			c, err := r.i.GetBucketCors(bucket)
+			if err != nil {
+				return err
+			}
+			return writeXML(r.w, 200, c)
+		case r.has("versioning"):
+			c, err := r.i.GetBucketVersioning(bucket)
+			if err != nil {
+				return err
+			}
+			return writeXML(r.w, 200, c)
+		case r.has("versions"):
+			return r.listVersions()
+		case r.query.Get("list-type") == "2":
+			return r.listV2()
+		default:
+			return r.list()
+		}
+	case "PUT":
+		switch {
+		case r.has("policy"):
+			var p s3.Policy
+			if err := json.Unmarshal(r.body, &p); err != nil {
+				return &s3.Error{StatusCode: 400, Code: "MalformedPolicy", Message: err.Error()}
+			}
+			if err := r.i.PutBucketPolicy(bucket, p); err != nil {
+				return err
+			}
+			r.w.WriteHeader(204)
+			return nil
+		case r.has("lifecycle"):
+			var c s3.LifecycleConfiguration
+			if err := xml.Unmarshal(r.body, &c); err != nil {
+				return malformedXML(err)
+			}
+			return r.i.PutBucketLifecycle(bucket, c)
+		case r.has("cors"):
+			var c s3.CORSConfiguration
+			if err := xml.Unmarshal(r.body, &c); err != nil {
+				return malformedXML(err)
+			}
+			return r.i.PutBucketCors(bucket, c)
+		case r.has("versioning"):
+			var c s3.VersioningConfiguration
+			if err := xml.Unmarshal(r.body, &c); err != nil {
+				return malformedXML(err)
+			}
+			return r.i.PutBucketVersioning(bucket, c)
+		case len(r.query) > 0:
+			return notImplemented(r.Request)
+		default:
+			var c struct {
+				LocationConstraint string
+			}
+			if len(r.body) > 0 {
+				if err := xml.Unmarshal(r.body, &c); err != nil {
+					return malformedXML(err)
+				}
+			}
+			return r.i.CreateBucket(s3.CreateBucketRequest{Bucket: bucket, Region: c.LocationConstraint})
+		}
+	case "DELETE":
+		var err error
+		switch {
+		case r.has("policy"):
+			err = r.i.DeleteBucketPolicy(bucket)
+		case r.has("lifecycle"):
+			err = r.i.DeleteBucketLifecycle(bucket)
+		case r.has("cors"):
+			err = r.i.DeleteBucketCors(bucket)
+		case len(r.query) > 0:
+			return notImplemented(r.Request)
+		default:
+			err = r.i.DeleteBucket(bucket)
+		}
+		if err != nil {
+			return err
+		}
+		r.w.WriteHeader(204)
+		return nil
+	case "POST":
+		if r.has("delete") {
+			return r.deleteObjects()
+		}
+	}
+	return notImplemented(r.Request)
+}
+
+func (r *s3Request) maxKeys() (int64, error) {
+	v := r.query.Get("max-keys")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "bad max-keys: " + v}
+	}
+	return n, nil
+}
+
+func (r *s3Request) list() error {
+	n, err := r.maxKeys()
+	if err != nil {
+		return err
+	}
+	out, err := r.i.List(s3.ListRequest{
+		Bucket:    r.object.Bucket,
+		MaxKeys:   n,
+		Marker:    r.query.Get("marker"),
+		Prefix:    r.query.Get("prefix"),
+		Delimiter: r.query.Get("delimiter"),
+	})
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, out)
+}
+
+func (r *s3Request) listV2() error {
+	n, err := r.maxKeys()
+	if err != nil {
+		return err
+	}
+	out, err := r.i.ListV2(s3.ListV2Request{
+		Bucket:            r.object.Bucket,
+		Prefix:            r.query.Get("prefix"),
+		Delimiter:         r.query.Get("delimiter"),
+		MaxKeys:           n,
+		StartAfter:        r.query.Get("start-after"),
+		ContinuationToken: r.query.Get("continuation-token"),
+	})
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3.ListV2Result
+	}{ListV2Result: out})
+}
+
+func (r *s3Request) listVersions() error {
+	n, err := r.maxKeys()
+	if err != nil {
+		return err
+	}
+	out, err := r.i.ListVersions(s3.ListVersionsRequest{
+		Bucket:          r.object.Bucket,
+		Prefix:          r.query.Get("prefix"),
+		Delimiter:       r.query.Get("delimiter"),
+		MaxKeys:         n,
+		KeyMarker:       r.query.Get("key-marker"),
+		VersionIdMarker: r.query.Get("version-id-marker"),
+	})
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, out)
+}
+
+func (r *s3Request) deleteObjects() error {
+	var d struct {
+		Quiet  bool
+		Object []s3.ObjectIdentifier
+	}
+	if err := xml.Unmarshal(r.body, &d); err != nil {
+		return malformedXML(err)
+	}
+	out, err := r.i.DeleteObjects(s3.DeleteObjectsRequest{Bucket: r.object.Bucket, Objects: d.Object, Quiet: d.Quiet})
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		*s3.DeleteObjectsResult
+	}{DeleteObjectsResult: out})
+}
+
+func (r *s3Request) obj() error {
+	switch r.Method {
+	case "GET":
+		return r.get(false)
+	case "HEAD":
+		return r.get(true)
+	case "PUT":
+		switch {
+		case r.has("uploadId"):
+			return r.uploadPart()
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return r.copy()
+		case len(r.query) > 0:
+			return notImplemented(r.Request)
+		default:
+			return r.put()
+		}
+	case "DELETE":
+		if id := r.query.Get("uploadId"); id != "" {
+			if err := r.i.AbortMultipart(s3.Multipart{Object: r.object, UploadId: id}); err != nil {
+				return err
+			}
+		} else if err := r.i.Delete(s3.DeleteRequest{Object: r.object, VersionId: r.query.Get("versionId")}); err != nil {
+			return err
+		}
+		r.w.WriteHeader(204)
+		return nil
+	case "POST":
+		switch {
+		case r.has("uploads"):
+			return r.initiateMultipart()
+		case r.has("uploadId"):
+			return r.completeMultipart()
+		}
+	}
+	return notImplemented(r.Request)
+}
+
+func (r *s3Request) get(head bool) error {
+	e, err := customerKey(r.Header, "")
+	if err != nil {
+		return err
+	}
+	c, err := conditions(r.Header)
+	if err != nil {
+		return err
+	}
+	req := s3.GetRequest{Object: r.object, VersionId: r.query.Get("versionId"), Conditions: c, Encryption: e}
+	h, err := r.i.HeadObject(s3.HeadRequest{Object: req.Object, VersionId: req.VersionId, Conditions: c, Encryption: e})
+	if err != nil {
+		return err
+	}
+	status := 200
+	if v := r.Header.Get("Range"); v != "" && !head {
+		if req.Range, err = parseRange(v); err != nil {
+			return err
+		}
+		status = 206
+	}
+	var data []byte
+	if !head {
+		if data, err = r.i.GetObject(req); err != nil {
+			return err
+		}
+	}
+	writeHead(r.w.Header(), h, e != nil)
+	if status == 206 {
+		end := req.Range.Start + int64(len(data)) - 1
+		r.w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", req.Range.Start, end, h.ContentLength))
+		r.w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	r.w.WriteHeader(status)
+	r.w.Write(data)
+	return nil
+}
+
+// a "bytes=start-end" or "bytes=start-" range
+func parseRange(v string) (*s3.ByteRange, error) {
+	bad := &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "unsupported range: " + v}
+	se := strings.SplitN(strings.TrimPrefix(v, "bytes="), "-", 2)
+	if !strings.HasPrefix(v, "bytes=") || len(se) != 2 {
+		return nil, bad
+	}
+	start, err := strconv.ParseInt(se[0], 10, 64)
+	if err != nil {
+		return nil, bad
+	}
+	end := int64(-1)
+	if se[1] != "" {
+		if end, err = strconv.ParseInt(se[1], 10, 64); err != nil || end < start {
+			return nil, bad
+		}
+	}
+	return &s3.ByteRange{Start: start, End: end}, nil
+}
+
+func conditions(h http.Header) (c s3.Conditions, err error) {
+	c.IfMatch = h.Get("If-Match")
+	c.IfNoneMatch = h.Get("If-None-Match")
+	parse := func(name string) time.Time {
+		v := h.Get(name)
+		if v == "" || err != nil {
+			return time.Time{}
+		}
+		var t time.Time
+		if t, err = http.ParseTime(v); err != nil {
+			err = &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "bad " + name + ": " + v}
+		}
+		return t
+	}
+	c.IfModifiedSince = parse("If-Modified-Since")
+	c.IfUnmodifiedSince = parse("If-Unmodified-Since")
+	return
+}
+
+// the response headers for an object; customerKey is whether it was read with SSE-C
+func writeHead(h http.Header, r *s3.HeadResponse, customerKey bool) {
+	h.Set("ETag", `"`+r.ETag+`"`)
+	h.Set("Content-Type", r.ContentType)
+	h.Set("Content-Length", strconv.Itoa(r.ContentLength))
+	h.Set("Last-Modified", r.LastModified.UTC().Format(http.TimeFormat))
+	set := func(k, v string) {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	set("Content-Encoding", r.ContentEncoding)
+	set("Cache-Control", r.CacheControl)
+	set("Content-Disposition", r.ContentDisposition)
+	set("X-Amz-Storage-Class", r.StorageClass)
+	set("X-Amz-Version-Id", r.VersionId)
+	for k, v := range r.Metadata {
+		h.Set("X-Amz-Meta-"+k, v)
+	}
+	if e := r.Encryption; e != nil {
+		set("X-Amz-Server-Side-Encryption", e.ServerSideEncryption)
+		set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", e.KMSKeyId)
+	}
+	if customerKey {
+		h.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	}
+}
+
+// the SSE-C key in the headers, with the given prefix (e.g. "Copy-Source-"), or nil if none
+func customerKey(h http.Header, prefix string) (*s3.Encryption, error) {
+	v := h.Get("X-Amz-" + prefix + "Server-Side-Encryption-Customer-Key")
+	if v == "" {
+		return nil, nil
+	}
+	bad := &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "bad customer key"}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 || h.Get("X-Amz-"+prefix+"Server-Side-Encryption-Customer-Algorithm") != "AES256" {
+		return nil, bad
+	}
+	sum := md5.Sum(key)
+	if h.Get("X-Amz-"+prefix+"Server-Side-Encryption-Customer-Key-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, bad
+	}
+	return &s3.Encryption{CustomerKey: key}, nil
+}
+
+// the headers common to puts, copies and multipart initiations
+func basePut(o s3.Object, h http.Header) (s3.BasePut, error) {
+	b := s3.BasePut{
+		Object:             o,
+		ContentType:        h.Get("Content-Type"),
+		ContentEncoding:    h.Get("Content-Encoding"),
+		ContentMD5:         h.Get("Content-MD5"),
+		CacheControl:       h.Get("Cache-Control"),
+		ContentDisposition: h.Get("Content-Disposition"),
+		StorageClass:       h.Get("X-Amz-Storage-Class"),
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") && len(v) > 0 {
+			if b.Metadata == nil {
+				b.Metadata = make(map[string]string)
+			}
+			b.Metadata[strings.ToLower(k[len("X-Amz-Meta-"):])] = v[0]
+		}
+	}
+	e, err := customerKey(h, "")
+	if err != nil {
+		return b, err
+	}
+	if sse := h.Get("X-Amz-Server-Side-Encryption"); sse != "" {
+		if e == nil {
+			e = &s3.Encryption{}
+		}
+		e.ServerSideEncryption = sse
+		e.KMSKeyId = h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	}
+	b.Encryption = e
+	return b, nil
+}
+
+// decodes an aws-chunked body with unsigned chunks, moving its trailing headers, like
+// checksums, into h; other bodies are returned as they are
+func decodeChunked(h http.Header, body []byte) ([]byte, error) {
+	encodings := strings.Split(h.Get("Content-Encoding"), ",")
+	if encodings[0] != "aws-chunked" {
+		return body, nil
+	}
+	bad := func(msg string) error {
+		return &s3.Error{StatusCode: 400, Code: "IncompleteBody", Message: msg}
+	}
+	if h.Get("X-Amz-Content-Sha256") != aws.StreamingUnsignedTrailer {
+		return nil, &s3.Error{StatusCode: 501, Code: "NotImplemented", Message: "only unsigned aws-chunked bodies are supported"}
+	}
+	line := func() (string, bool) {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return "", false
+		}
+		l := string(body[:i])
+		body = body[i+2:]
+		return l, true
+	}
+	var out []byte
+	for {
+		l, ok := line()
+		if !ok {
+			return nil, bad("unterminated chunk size")
+		}
+		n, err := strconv.ParseInt(l, 16, 64)
+		if err != nil || n < 0 {
+			return nil, bad("bad chunk size: " + l)
+		}
+		if n == 0 {
+			break
+		}
+		if int64(len(body)) < n+2 || string(body[n:n+2]) != "\r\n" {
+			return nil, bad("short chunk")
+		}
+		out, body = append(out, body[:n]...), body[n+2:]
+	}
+	allowed := make(map[string]bool)
+	for _, t := range strings.Split(h.Get("X-Amz-Trailer"), ",") {
+		allowed[http.CanonicalHeaderKey(strings.TrimSpace(t))] = true
+	}
+	for {
+		l, ok := line()
+		if !ok {
+			return nil, bad("unterminated trailer")
+		}
+		if l == "" {
+			break
+		}
+		i := strings.Index(l, ":")
+		if i < 0 || !allowed[http.CanonicalHeaderKey(l[:i])] {
+			return nil, bad("unexpected trailer: " + l)
+		}
+		h.Set(l[:i], l[i+1:])
+	}
+	if strconv.Itoa(len(out)) != h.Get("X-Amz-Decoded-Content-Length") {
+		return nil, bad("body doesn't match x-amz-decoded-content-length")
+	}
+	h.Set("Content-Encoding", strings.Join(encodings[1:], ","))
+	if len(encodings) == 1 {
+		h.Del("Content-Encoding")
+	}
+	return out, nil
+}
+
+// checks the body against an x-amz-checksum-* header, if any
+func checkChecksum(h http.Header, body []byte) error {
+	var sum []byte
+	v := h.Get("X-Amz-Checksum-Sha256")
+	if v != "" {
+		s := sha256.Sum256(body)
+		sum = s[:]
+	} else if v = h.Get("X-Amz-Checksum-Crc32c"); v != "" {
+		c := crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli))
+		sum = []byte{byte(c >> 24), byte(c >> 16), byte(c >> 8), byte(c)}
+	} else {
+		return nil
+	}
+	if base64.StdEncoding.EncodeToString(sum) != v {
+		return &s3.Error{StatusCode: 400, Code: "BadDigest", Message: "checksum doesn't match the body"}
+	}
+	return nil
+}
+
+func (r *s3Request) put() error {
+	b, err := basePut(r.object, r.Header)
+	if err != nil {
+		return err
+	}
+	if err := checkChecksum(r.Header, r.body); err != nil {
+		return err
+	}
+	if err := r.i.Put(s3.PutRequest{BasePut: b, ReaderFact: goutil.BufferReaderFact{Buffer: r.body}}); err != nil {
+		return err
+	}
+	sum := md5.Sum(r.body)
+	r.w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	if e := b.Encryption; e != nil && e.ServerSideEncryption != "" {
+		r.w.Header().Set("X-Amz-Server-Side-Encryption", e.ServerSideEncryption)
+	}
+	return nil
+}
+
+func (r *s3Request) copy() error {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "bad copy source"}
+	}
+	from := parsePath(src)
+	if from.Key == "" {
+		return &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "bad copy source: " + src}
+	}
+	req := s3.CopyRequest{From: from, To: r.object, ReplaceMetadata: r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE"}
+	if req.Headers, err = basePut(r.object, r.Header); err != nil {
+		return err
+	}
+	if req.SourceEncryption, err = customerKey(r.Header, "Copy-Source-"); err != nil {
+		return err
+	}
+	if err := r.i.Copy(req); err != nil {
+		return err
+	}
+	h, err := r.i.HeadObject(s3.HeadRequest{Object: r.object, Encryption: req.Headers.Encryption})
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified time.Time
+	}{ETag: `"` + h.ETag + `"`, LastModified: h.LastModified})
+}
+
+func (r *s3Request) initiateMultipart() error {
+	b, err := basePut(r.object, r.Header)
+	if err != nil {
+		return err
+	}
+	m, err := r.i.InitiateMultipart(b)
+	if err != nil {
+		return err
+	}
+	return writeXML(r.w, 200, struct {
+		XMLName               xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket, Key, UploadId string
+	}{Bucket: m.Object.Bucket, Key: m.Object.Key, UploadId: m.UploadId})
+}
+
+func (r *s3Request) uploadPart() error {
+	n, err := strconv.Atoi(r.query.Get("partNumber"))
+	if err != nil {
+		return &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "bad part number"}
+	}
+	e, err := customerKey(r.Header, "")
+	if err != nil {
+		return err
+	}
+	p, err := r.i.UploadPart(s3.UploadPartRequest{
+		Multipart:  s3.Multipart{Object: r.object, UploadId: r.query.Get("uploadId")},
+		PartNumber: n,
+		ReaderFact: goutil.BufferReaderFact{Buffer: r.body},
+		Encryption: e,
+	})
+	if err != nil {
+		return err
+	}
+	r.w.Header().Set("ETag", `"`+p.ETag+`"`)
+	return nil
+}
+
+func (r *s3Request) completeMultipart() error {
+	var c struct {
+		Parts []s3.Part `xml:"Part"`
+	}
+	if err := xml.Unmarshal(r.body, &c); err != nil {
+		return malformedXML(err)
+	}
+	if len(c.Parts) == 0 {
+		return malformedXML(errors.New("no parts"))
+	}
+	for i := range c.Parts {
+		c.Parts[i].ETag = strings.Replace(c.Parts[i].ETag, `"`, "", -1)
+	}
+	m := s3.Multipart{Object: r.object, UploadId: r.query.Get("uploadId")}
+	if err := r.i.CompleteMultipart(s3.CompleteMultipartRequest{Multipart: m, Parts: c.Parts}); err != nil {
+		return err
+	}
+	out := struct {
+		XMLName                     xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location, Bucket, Key, ETag string
+	}{Location: r.URL.Path, Bucket: r.object.Bucket, Key: r.object.Key}
+	// objects encrypted with a customer key can't be read without it
+	if h, err := r.i.Head(r.object); err == nil {
+		out.ETag = `"` + h.ETag + `"`
+	}
+	return writeXML(r.w, 200, out)
+}
@@ -0,0 +1,199 @@
+package awstest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"time"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws/s3"
+)
+
+// whether r is a browser upload: a multipart form posted to a bucket
+func (r *s3Request) isPost() bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == "POST" && r.object.Bucket != "" && r.object.Key == "" && mt == "multipart/form-data"
+}
+
+// stores a browser upload, authorized by its signed policy rather than a signed request
+func (s *Server) postObject(r *s3Request) error {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return &s3.Error{StatusCode: 400, Code: "MalformedPOSTRequest", Message: err.Error()}
+	}
+	fields := make(map[string]string) // by lower-cased name
+	var file []byte
+	var filename string
+	found := false
+	mr := multipart.NewReader(bytes.NewReader(r.body), params["boundary"])
+	for !found {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &s3.Error{StatusCode: 400, Code: "MalformedPOSTRequest", Message: err.Error()}
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return err
+		}
+		// like s3, ignores fields after the file
+		if p.FormName() == "file" {
+			file, filename, found = data, p.FileName(), true
+		} else {
+			fields[strings.ToLower(p.FormName())] = string(data)
+		}
+	}
+	if !found {
+		return &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "POST requires exactly one file upload per request."}
+	}
+	if err := s.verifyPost(r.object.Bucket, fields, int64(len(file))); err != nil {
+		return err
+	}
+	key := strings.Replace(fields["key"], "${filename}", filename, -1)
+	if key == "" {
+		return &s3.Error{StatusCode: 400, Code: "InvalidArgument", Message: "Bucket POST must contain a field named 'key'."}
+	}
+	b := s3.BasePut{Object: s3.Object{Bucket: r.object.Bucket, Key: key}, ContentType: fields["content-type"]}
+	for k, v := range fields {
+		if strings.HasPrefix(k, "x-amz-meta-") {
+			if b.Metadata == nil {
+				b.Metadata = make(map[string]string)
+			}
+			b.Metadata[k[len("x-amz-meta-"):]] = v
+		}
+	}
+	if err := r.i.Put(s3.PutRequest{BasePut: b, ReaderFact: goutil.BufferReaderFact{Buffer: file}}); err != nil {
+		return err
+	}
+	sum := md5.Sum(file)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	r.w.Header().Set("ETag", etag)
+	switch fields["success_action_status"] {
+	case "200":
+		r.w.WriteHeader(200)
+	case "201":
+		return writeXML(r.w, 201, struct {
+			XMLName  xml.Name `xml:"PostResponse"`
+			Location string
+			Bucket   string
+			Key      string
+			ETag     string
+		}{Location: r.URL.Path + key, Bucket: b.Object.Bucket, Key: key, ETag: etag})
+	default:
+		r.w.WriteHeader(204)
+	}
+	return nil
+}
+
+// checks a browser upload's form fields and size against its policy, which must be
+// signed with the server's keys, and must cover every field
+func (s *Server) verifyPost(bucket string, fields map[string]string, size int64) error {
+	if fields["x-amz-security-token"] != s.SessionToken {
+		return denied(403, "InvalidToken", "the provided token is malformed or otherwise invalid")
+	}
+	if fields["x-amz-algorithm"] != "AWS4-HMAC-SHA256" {
+		return denied(400, "InvalidArgument", "only AWS4-HMAC-SHA256 is supported")
+	}
+	svc, err := s.scope(fields["x-amz-credential"])
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(isoFormat, fields["x-amz-date"])
+	if err != nil {
+		return denied(400, "InvalidArgument", "bad x-amz-date")
+	}
+	keys := s.keys()
+	if sig := svc.SignPolicy(&keys, t, fields["policy"]); !hmac.Equal([]byte(sig), []byte(fields["x-amz-signature"])) {
+		return denied(403, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided")
+	}
+	doc, err := base64.StdEncoding.DecodeString(fields["policy"])
+	if err != nil {
+		return denied(400, "InvalidPolicyDocument", err.Error())
+	}
+	var policy struct {
+		Expiration string        `json:"expiration"`
+		Conditions []interface{} `json:"conditions"`
+	}
+	if err := json.Unmarshal(doc, &policy); err != nil {
+		return denied(400, "InvalidPolicyDocument", err.Error())
+	}
+	exp, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return denied(400, "InvalidPolicyDocument", "bad expiration: "+policy.Expiration)
+	}
+	if time.Now().After(exp) {
+		return denied(403, "AccessDenied", "Invalid according to Policy: Policy expired.")
+	}
+	value := func(name string) string {
+		if name == "bucket" {
+			return bucket
+		}
+		return fields[name]
+	}
+	failed := func(c interface{}) error {
+		buf, _ := json.Marshal(c)
+		return denied(403, "AccessDenied", "Invalid according to Policy: Policy Condition failed: "+string(buf))
+	}
+	covered := make(map[string]bool)
+	for _, c := range policy.Conditions {
+		switch c := c.(type) {
+		case map[string]interface{}:
+			for k, v := range c {
+				name := strings.ToLower(k)
+				if value(name) != fmt.Sprint(v) {
+					return failed(c)
+				}
+				covered[name] = true
+			}
+		case []interface{}:
+			if len(c) != 3 {
+				return denied(400, "InvalidPolicyDocument", fmt.Sprintf("bad condition: %v", c))
+			}
+			switch op := strings.ToLower(fmt.Sprint(c[0])); op {
+			case "content-length-range":
+				min, ok1 := c[1].(float64)
+				max, ok2 := c[2].(float64)
+				switch {
+				case !ok1 || !ok2:
+					return denied(400, "InvalidPolicyDocument", fmt.Sprintf("bad condition: %v", c))
+				case float64(size) < min:
+					return denied(400, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed size")
+				case float64(size) > max:
+					return denied(400, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size")
+				}
+			case "eq", "starts-with":
+				name := strings.ToLower(strings.TrimPrefix(fmt.Sprint(c[1]), "$"))
+				got, want := value(name), fmt.Sprint(c[2])
+				if (op == "eq" && got != want) || (op == "starts-with" && !strings.HasPrefix(got, want)) {
+					return failed(c)
+				}
+				covered[name] = true
+			default:
+				return denied(400, "InvalidPolicyDocument", "unknown condition: "+op)
+			}
+		default:
+			return denied(400, "InvalidPolicyDocument", fmt.Sprintf("bad condition: %v", c))
+		}
+	}
+	for name := range fields {
+		switch {
+		case name == "policy", name == "x-amz-signature", strings.HasPrefix(name, "x-ignore-"):
+		case !covered[name]:
+			return denied(403, "AccessDenied", "Invalid according to Policy: Extra input fields: "+name)
+		}
+	}
+	return nil
+}
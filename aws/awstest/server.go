@@ -0,0 +1,97 @@
+/*
+in-process stand-ins for s3 and dynamodb, for exercising the real wire code of
+aws/s3 and aws/ddb (signing, error responses, pagination and so on) without network access.
+
+	srv := awstest.NewServer(auth)
+	defer srv.Close()
+	srv.S3.MakeBucket("b")
+	ss3 := srv.S3Client() // an s3.Interface talking to srv
+
+s3 requests must be path-style; browser POST uploads are checked against their signed
+policies. objects are kept in an s3.FakeS3, with its limitations. dynamodb speaks the
+item operations of the 2012-08-10 api that aws/ddb uses, plus Query, Scan, batches,
+table administration and time to live settings, with condition, update, key condition,
+filter and projection expressions on top-level attributes. tables made with the
+CreateTable operation are CREATING until first described, and secondary indexes are
+recorded but can't be queried; time to live is recorded but items don't expire.
+*/
+package awstest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws"
+	"github.com/xoba/goutil/aws/ddb"
+	"github.com/xoba/goutil/aws/s3"
+)
+
+type Server struct {
+	URL  string   // base url, e.g. "http://127.0.0.1:51234"
+	Auth aws.Auth // the only credentials accepted
+
+	// if set, required of requests as with temporary credentials
+	SessionToken string
+
+	// if positive, the most items a dynamodb batch request processes, leaving the
+	// rest unprocessed as when throttled
+	BatchLimit int
+
+	// if positive, the most table names ListTables returns at once, instead of 100
+	ListPageSize int
+
+	S3 *s3.FakeS3
+
+	srv      *httptest.Server
+	requests uint64
+
+	lock   sync.Mutex
+	tables map[string]*table
+}
+
+// starts a server accepting requests signed with auth's keys
+func NewServer(auth aws.Auth) *Server {
+	s := &Server{
+		Auth:   auth,
+		S3:     s3.NewMemoryS3(),
+		tables: make(map[string]*table),
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// an s3 client for the server, with quick retries
+func (s *Server) S3Client() s3.Interface {
+	return s3.SmartS3{Auth: s.Auth, Strat: quickStrat(), Endpoint: s.URL, Addressing: s3.PathStyle}
+}
+
+// a dynamodb client for one of the server's tables, with quick retries
+func (s *Server) DynamoDB(table string) ddb.DynamoDB {
+	return ddb.DynamoDB{Table: table, Auth: s.Auth, Strat: quickStrat(), Endpoint: s.URL}
+}
+
+func quickStrat() goutil.RetryStrategy {
+	return &goutil.RetryBackoffStrat{BackoffFactor: 2, Delay: 10 * time.Millisecond, Retries: 3}
+}
+
+// dynamodb requests are told apart from s3's by their X-Amz-Target header
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := fmt.Sprintf("%016X", atomic.AddUint64(&s.requests, 1))
+	if r.Header.Get("X-Amz-Target") != "" {
+		w.Header().Set("X-Amzn-Requestid", id)
+		s.serveDynamoDB(w, r)
+		return
+	}
+	w.Header().Set("X-Amz-Request-Id", id)
+	s.serveS3(w, r, id)
+}
@@ -0,0 +1,683 @@
+package awstest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws"
+	"github.com/xoba/goutil/aws/ddb"
+	"github.com/xoba/goutil/aws/s3"
+)
+
+var testAuth = aws.Auth{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+func TestS3(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	ss3 := srv.S3Client()
+
+	if err := ss3.CreateBucket(s3.CreateBucketRequest{Bucket: "b", Region: "us-west-2"}); err != nil {
+		t.Fatal(err)
+	}
+	o := s3.Object{Bucket: "b", Key: "dir/a file+x.txt"}
+	data := []byte("hello, world")
+	err := ss3.PutObject(s3.PutObjectRequest{
+		BasePut: s3.BasePut{Object: o, Metadata: map[string]string{"user": "joe"}, Checksum: s3.ChecksumSHA256},
+		Data:    data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ss3.Head(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ContentLength != len(data) || h.ContentType != "text/plain; charset=utf-8" || h.Metadata["user"] != "joe" {
+		t.Errorf("bad head: %#v", h)
+	}
+	buf, err := ss3.GetObject(s3.GetRequest{Object: o})
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("bad get: %q, %v", buf, err)
+	}
+	buf, err = ss3.GetObject(s3.GetRequest{Object: o, Range: &s3.ByteRange{Start: 7, End: -1}})
+	if err != nil || string(buf) != "world" {
+		t.Errorf("bad ranged get: %q, %v", buf, err)
+	}
+	if _, err := ss3.GetObject(s3.GetRequest{Object: o, Conditions: s3.Conditions{IfNoneMatch: h.ETag}}); !s3.IsNotModified(err) {
+		t.Errorf("expected not modified: %v", err)
+	}
+	if _, err := ss3.GetObject(s3.GetRequest{Object: s3.Object{Bucket: "b", Key: "missing"}}); !s3.IsNoSuchKey(err) {
+		t.Errorf("expected no such key: %v", err)
+	}
+	if err := ss3.Copy(s3.CopyRequest{From: o, To: s3.Object{Bucket: "b", Key: "copy"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// checksums are sent after the body, so a reader that can only be read once will do
+	long := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, a := range []s3.ChecksumAlgorithm{s3.ChecksumSHA256, s3.ChecksumCRC32C} {
+		x := s3.Object{Bucket: "b", Key: "once"}
+		err := ss3.Put(s3.PutRequest{
+			BasePut:    s3.BasePut{Object: x, ContentEncoding: "compress", Checksum: a},
+			ReaderFact: goutil.NewSingleReaderFact(bytes.NewReader(long), len(long)),
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", a, err)
+		}
+		h, err := ss3.Head(x)
+		if err != nil || h.ContentLength != len(long) || h.ContentEncoding != "compress" {
+			t.Errorf("%s: bad head: %#v, %v", a, h, err)
+		}
+		if buf, err := ss3.GetObject(s3.GetRequest{Object: x}); err != nil || !bytes.Equal(buf, long) {
+			t.Errorf("%s: bad get: %d bytes, %v", a, len(buf), err)
+		}
+		if err := ss3.Delete(s3.DeleteRequest{Object: x}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// listing a page at a time
+	for i := 0; i < 5; i++ {
+		if err := ss3.PutObject(s3.PutObjectRequest{BasePut: s3.BasePut{Object: s3.Object{Bucket: "b", Key: string('k' + rune(i))}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	l := s3.NewLister(ss3, s3.ListV2Request{Bucket: "b", Delimiter: "/", MaxKeys: 2})
+	for l.Next() {
+		keys = append(keys, l.Key())
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 7 || keys[0] != "copy" || keys[1] != "dir/" || keys[6] != "o" {
+		t.Errorf("bad listing: %q", keys)
+	}
+	if n, err := s3.DeletePrefix(ss3, s3.DeletePrefixRequest{Bucket: "b"}); err != nil || n != 7 {
+		t.Errorf("bad delete: %d, %v", n, err)
+	}
+
+	// multipart
+	big := make([]byte, s3.MinPartSize+100)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	err = s3.Upload(ss3, s3.UploadRequest{
+		PutRequest: s3.PutRequest{BasePut: s3.BasePut{Object: o, Checksum: s3.ChecksumMD5}, ReaderFact: goutil.BufferReaderFact{Buffer: big}},
+		Threshold:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ss3.GetObject(s3.GetRequest{Object: o}); err != nil || !bytes.Equal(buf, big) {
+		t.Errorf("bad multipart get: %d bytes, %v", len(buf), err)
+	}
+
+	if err := ss3.MakePublic("b"); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.S3.IsPublic("b") {
+		t.Error("not public")
+	}
+	if err := ss3.PutBucketVersioning("b", s3.VersioningConfiguration{Status: s3.VersioningEnabled}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ss3.GetBucketVersioning("b"); err != nil || v.Status != s3.VersioningEnabled {
+		t.Errorf("bad versioning: %v, %v", v, err)
+	}
+	if _, err := ss3.GetBucketCors("b"); !s3.IsCode(err, "NoSuchCORSConfiguration") {
+		t.Errorf("expected no cors: %v", err)
+	}
+	if err := ss3.DeleteBucket("b"); !s3.IsCode(err, "BucketNotEmpty") {
+		t.Errorf("expected bucket not empty: %v", err)
+	}
+}
+
+func TestS3Signatures(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.S3.MakeBucket("b")
+	o := s3.Object{Bucket: "b", Key: "x"}
+	if err := srv.S3.PutObject(s3.PutObjectRequest{BasePut: s3.BasePut{Object: o}, Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := s3.GetForEndpoint(aws.Auth{AccessKey: testAuth.AccessKey, SecretKey: "wrong"}, srv.URL, "", s3.PathStyle)
+	if _, err := bad.Head(o); err == nil {
+		t.Error("head with the wrong secret succeeded")
+	}
+	if _, err := bad.GetObject(s3.GetRequest{Object: o}); !s3.IsCode(err, "SignatureDoesNotMatch") {
+		t.Errorf("expected signature mismatch: %v", err)
+	}
+	unknown := s3.GetForEndpoint(aws.Auth{AccessKey: "nobody", SecretKey: "x"}, srv.URL, "", s3.PathStyle)
+	if _, err := unknown.Buckets(); !s3.IsCode(err, "InvalidAccessKeyId") {
+		t.Errorf("expected invalid access key: %v", err)
+	}
+	get := func(u string) int {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+	if code := get(srv.URL + "/b/x"); code != 403 {
+		t.Errorf("anonymous get: %d", code)
+	}
+	r, err := srv.S3Client().(s3.SmartS3).Presign(s3.PresignRequest{Object: o, Expiration: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(r.URL); code != 200 {
+		t.Errorf("presigned get: %d", code)
+	}
+	if code := get(r.URL + "0"); code != 403 {
+		t.Errorf("tampered presigned get: %d", code)
+	}
+
+	srv.SessionToken = "token"
+	if _, err := srv.S3Client().GetObject(s3.GetRequest{Object: o}); !s3.IsCode(err, "InvalidToken") {
+		t.Errorf("expected invalid token: %v", err)
+	}
+	temp := aws.ProviderFunc(func() (*aws.Credentials, error) {
+		return &aws.Credentials{AccessKey: testAuth.AccessKey, SecretKey: testAuth.SecretKey, SessionToken: "token"}, nil
+	})
+	if _, err := s3.GetForEndpoint(temp, srv.URL, "", s3.PathStyle).Head(o); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDynamoDB(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.CreateTable("t", "id", "")
+	d := srv.DynamoDB("t")
+
+	if err := d.PutItem(map[string]ddb.Value{"id": ddb.SV("a"), "name": ddb.SV("joe"), "n": ddb.NV(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.IncrementItem("a", "n", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateItem("b", "name", ddb.SV("sue")); err != nil {
+		t.Fatal(err)
+	}
+	item, ok, err := d.GetItem("a")
+	if err != nil || !ok || item["name"].S != "joe" || item["n"].N != "5" {
+		t.Errorf("bad item: %v, %v, %v", item, ok, err)
+	}
+	if item, ok, err := d.GetItem("b"); err != nil || !ok || item["name"].S != "sue" {
+		t.Errorf("bad updated item: %v, %v, %v", item, ok, err)
+	}
+
+	// every type, and exact numbers
+	all := map[string]ddb.Value{
+		"id":   ddb.SV("all"),
+		"n":    ddb.DV("12345678901234567890.0000001"),
+		"ss":   ddb.SSV("a", "b"),
+		"ns":   ddb.NSV("1", "2"),
+		"bs":   ddb.BSV([]byte{1}),
+		"bool": ddb.BoolV(true),
+		"null": ddb.NullV(),
+		"l":    ddb.LV(ddb.SV("x"), ddb.NV(1)),
+		"m":    ddb.MV(map[string]ddb.Value{"k": ddb.BoolV(false)}),
+	}
+	if err := d.PutItem(all); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.IncrementItem("all", "n", 0.1); err != nil {
+		t.Fatal(err)
+	}
+	adds := map[string]ddb.Update{"ss": {Action: ddb.Add, Value: ddb.SSV("b", "c")}, "ns": {Action: ddb.Delete, Value: ddb.NSV("1")}}
+	if _, err := d.Update(ddb.UpdateItemRequest{Key: ddb.Key{"id": ddb.SV("all")}, Updates: adds}); err != nil {
+		t.Fatal(err)
+	}
+	all["n"] = ddb.DV("12345678901234567890.1000001")
+	all["ss"] = ddb.SSV("a", "b", "c")
+	all["ns"] = ddb.NSV("2")
+	if item, ok, err := d.GetItem("all"); err != nil || !ok || !reflect.DeepEqual(item, all) {
+		t.Errorf("bad item: %v, %v, %v", item, ok, err)
+	}
+	if err := d.DeleteItem("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := d.GetItem("a"); err != nil || ok {
+		t.Errorf("deleted item found: %v, %v", ok, err)
+	}
+	if _, _, err := srv.DynamoDB("missing").GetItem("a"); !ddb.IsResourceNotFound(err) {
+		t.Errorf("expected resource not found: %v", err)
+	}
+
+	// composite keys
+	srv.CreateTable("events", "user", "time")
+	e := srv.DynamoDB("events")
+	k := ddb.Key{"user": ddb.SV("joe"), "time": ddb.NV(1)}
+	if _, err := e.Put(ddb.PutItemRequest{Item: map[string]ddb.Value{"user": ddb.SV("joe"), "time": ddb.NV(1), "what": ddb.BV([]byte{0, 1})}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PutItem(map[string]ddb.Value{"user": ddb.SV("joe")}); !ddb.IsCode(err, "ValidationException") {
+		t.Errorf("expected validation error: %v", err)
+	}
+	if _, _, err := e.GetItem("joe"); err == nil {
+		t.Error("string key for a table with a range key")
+	}
+	old, err := e.Update(ddb.UpdateItemRequest{Key: k, Updates: map[string]ddb.Update{"what": {Action: ddb.Delete}, "n": {Action: ddb.Add, Value: ddb.NV(1)}}, ReturnValues: ddb.ReturnUpdatedOld})
+	if err != nil || len(old) != 1 || !bytes.Equal(old["what"].B, []byte{0, 1}) {
+		t.Errorf("bad old values: %v, %v", old, err)
+	}
+	if item, ok, err := e.Get(ddb.GetItemRequest{Key: k}); err != nil || !ok || len(item) != 3 || item["n"].N != "1" {
+		t.Errorf("bad updated item: %v, %v, %v", item, ok, err)
+	}
+	if old, err := e.Delete(ddb.DeleteItemRequest{Key: k, ReturnValues: ddb.ReturnAllOld}); err != nil || old["user"].S != "joe" {
+		t.Errorf("bad deleted item: %v, %v", old, err)
+	}
+
+	d.Auth.SecretKey = "wrong"
+	if _, _, err := d.GetItem("b"); err == nil {
+		t.Error("get with the wrong secret succeeded")
+	}
+}
+
+func TestQueryScan(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.CreateTable("events", "user", "time")
+	d := srv.DynamoDB("events")
+	for _, user := range []string{"joe", "sue"} {
+		for i := 0; i < 10; i++ {
+			item := map[string]ddb.Value{"user": ddb.SV(user), "time": ddb.IV(int64(i)), "even": ddb.BoolV(i%2 == 0)}
+			if err := d.PutItem(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	times := func(it *ddb.Iterator) (out []string) {
+		for it.Next() {
+			out = append(out, it.Item()["time"].N)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	q := ddb.QueryRequest{
+		KeyConditions: map[string]ddb.Condition{"user": ddb.Cond(ddb.EQ, ddb.SV("joe")), "time": ddb.Cond(ddb.Between, ddb.IV(2), ddb.IV(8))},
+		Filter:        ddb.If("even", ddb.Cond(ddb.EQ, ddb.BoolV(true))),
+		Reverse:       true,
+	}
+	if got := times(d.Query(q)); !reflect.DeepEqual(got, []string{"8", "6", "4", "2"}) {
+		t.Errorf("bad query: %v", got)
+	}
+	q.Limit = 3
+	it := d.Query(q)
+	if got := times(it); !reflect.DeepEqual(got, []string{"8", "6", "4"}) {
+		t.Errorf("bad limited query: %v", got)
+	}
+	if it.ConsumedCapacity() == 0 || it.ScannedCount() < 5 {
+		t.Errorf("bad stats: %v, %d", it.ConsumedCapacity(), it.ScannedCount())
+	}
+	it = d.Query(ddb.QueryRequest{
+		KeyConditions:   map[string]ddb.Condition{"user": ddb.Cond(ddb.EQ, ddb.SV("sue")), "time": ddb.Cond(ddb.LT, ddb.IV(5))},
+		Filter:          ddb.Or(ddb.If("time", ddb.Cond(ddb.EQ, ddb.IV(1))), ddb.If("time", ddb.Cond(ddb.GE, ddb.IV(3)))),
+		AttributesToGet: []string{"time"},
+	})
+	if got := times(it); !reflect.DeepEqual(got, []string{"1", "3", "4"}) {
+		t.Errorf("bad filtered query: %v", got)
+	}
+	if it := d.Query(ddb.QueryRequest{KeyConditions: map[string]ddb.Condition{"user": ddb.Cond(ddb.NE, ddb.SV("sue"))}}); it.Next() || it.Err() == nil {
+		t.Error("queried with NE")
+	}
+
+	// resuming in pages of 3
+	var all []string
+	var start ddb.Key
+	for {
+		it := d.Scan(ddb.ScanRequest{Limit: 3, StartKey: start})
+		all = append(all, times(it)...)
+		if start = it.LastEvaluatedKey(); start == nil {
+			break
+		}
+	}
+	if len(all) != 20 {
+		t.Errorf("bad paged scan: %v", all)
+	}
+
+	n := 0
+	var lock sync.Mutex
+	err := d.ParallelScan(ddb.ScanRequest{Filter: ddb.If("even", ddb.Cond(ddb.EQ, ddb.BoolV(false)))}, 4, func(item map[string]ddb.Value) error {
+		lock.Lock()
+		defer lock.Unlock()
+		n++
+		return nil
+	})
+	if err != nil || n != 10 {
+		t.Errorf("bad parallel scan: %d, %v", n, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.CreateTable("t", "id", "")
+	srv.BatchLimit = 7
+	d := srv.DynamoDB("t")
+	d.Strat = &goutil.RetryBackoffStrat{Delay: time.Millisecond, Retries: 20}
+
+	var puts []map[string]ddb.Value
+	var keys []ddb.Key
+	for i := 0; i < 260; i++ {
+		puts = append(puts, map[string]ddb.Value{"id": ddb.IV(int64(i)), "n": ddb.IV(int64(i * i))})
+		keys = append(keys, ddb.Key{"id": ddb.IV(int64(i))})
+	}
+	if err := d.BatchWriteItem(ddb.BatchWriteRequest{Puts: puts}); err != nil {
+		t.Fatal(err)
+	}
+	items, err := d.BatchGetItem(ddb.BatchGetRequest{Keys: append(keys, ddb.Key{"id": ddb.IV(1000)}, keys[0])})
+	if err != nil || len(items) != 260 {
+		t.Fatalf("bad batch get: %d, %v", len(items), err)
+	}
+	for _, item := range items {
+		id, _ := item["id"].Int()
+		if n, _ := item["n"].Int(); n != id*id {
+			t.Errorf("bad item: %v", item)
+		}
+	}
+	if err := d.BatchWriteItem(ddb.BatchWriteRequest{Deletes: keys[:100], Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := d.BatchGetItem(ddb.BatchGetRequest{Keys: keys}); err != nil || len(items) != 160 {
+		t.Errorf("bad batch get after deletes: %d, %v", len(items), err)
+	}
+
+	d.Strat = &goutil.RetryBackoffStrat{Delay: time.Millisecond, Retries: 1}
+	if _, err := d.BatchGetItem(ddb.BatchGetRequest{Keys: keys}); err == nil {
+		t.Error("unprocessed keys weren't reported")
+	}
+	if _, err := srv.DynamoDB("missing").BatchGetItem(ddb.BatchGetRequest{Keys: keys}); !ddb.IsResourceNotFound(err) {
+		t.Errorf("expected a missing table: %v", err)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.CreateTable("t", "id", "")
+	d := srv.DynamoDB("t")
+	d.Strat = &goutil.RetryBackoffStrat{Delay: time.Millisecond, Retries: 100}
+
+	item := map[string]ddb.Value{"id": ddb.SV("a"), "n": ddb.IV(1)}
+	if _, err := d.Put(ddb.PutItemRequest{Item: item, If: ddb.NotExists("id")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := d.Put(ddb.PutItemRequest{Item: item, If: ddb.NotExists("id")})
+	var cf *ddb.ConditionalCheckFailedError
+	if !errors.As(err, &cf) || ddb.Retryable(err) {
+		t.Errorf("expected conditional check failure: %v", err)
+	}
+	k := ddb.Key{"id": ddb.SV("a")}
+	set := map[string]ddb.Update{"s": {Value: ddb.SV("x")}}
+	cond := ddb.And(ddb.Exists("n"), ddb.Or(ddb.If("n", ddb.Cond(ddb.GT, ddb.IV(5))), ddb.If("n", ddb.Cond(ddb.In, ddb.IV(1), ddb.IV(2)))))
+	if _, err := d.Update(ddb.UpdateItemRequest{Key: k, Updates: set, If: cond}); err != nil {
+		t.Error(err)
+	}
+	if _, err := d.Update(ddb.UpdateItemRequest{Key: k, Updates: set, If: ddb.Not(cond)}); !ddb.IsConditionalCheckFailed(err) {
+		t.Errorf("expected conditional check failure: %v", err)
+	}
+	if _, err := d.Delete(ddb.DeleteItemRequest{Key: k, If: ddb.If("s", ddb.Cond(ddb.BeginsWith, ddb.SV("y")))}); !ddb.IsConditionalCheckFailed(err) {
+		t.Errorf("expected conditional check failure: %v", err)
+	}
+
+	// concurrent increments, each retried until it wins
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.ReadModifyWrite(ddb.Key{"id": ddb.SV("counter")}, "version", func(item map[string]ddb.Value) error {
+				c, _ := item["count"].Int()
+				item["count"] = ddb.IV(c + 1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	item, _, err = d.Get(ddb.GetItemRequest{Key: ddb.Key{"id": ddb.SV("counter")}})
+	if err != nil || item["count"].N != "10" || item["version"].N != "10" {
+		t.Errorf("bad counter: %v, %v", item, err)
+	}
+	_, err = d.ReadModifyWrite(ddb.Key{"id": ddb.SV("counter")}, "version", func(item map[string]ddb.Value) error {
+		item["id"] = ddb.SV("other")
+		return nil
+	})
+	if err == nil {
+		t.Error("changed the key")
+	}
+}
+
+func TestStructs(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.CreateTable("events", "user", "time")
+	d := srv.DynamoDB("events")
+	type event struct {
+		User  string    `ddb:"user,hash"`
+		Time  time.Time `ddb:"time,range"`
+		Tags  []string  `ddb:"tags,set"`
+		Count int       `ddb:"count"`
+	}
+	e := event{User: "joe", Time: time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC), Tags: []string{"a", "b"}, Count: 3}
+	if err := d.PutStruct(e); err != nil {
+		t.Fatal(err)
+	}
+	out := event{User: e.User, Time: e.Time}
+	if ok, err := d.GetStruct(&out); err != nil || !ok || !reflect.DeepEqual(out, e) {
+		t.Errorf("bad struct: %+v, %v, %v", out, ok, err)
+	}
+	out.Time = out.Time.Add(time.Second)
+	if ok, err := d.GetStruct(&out); err != nil || ok {
+		t.Errorf("found a missing struct: %v, %v", ok, err)
+	}
+}
+
+func TestTables(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.ListPageSize = 1
+	srv.CreateTable("a", "id", "")
+	d := srv.DynamoDB("events")
+	user := ddb.KeyAttribute{Name: "user", Type: ddb.S}
+	at := ddb.KeyAttribute{Name: "time", Type: ddb.N}
+	kind := ddb.KeyAttribute{Name: "kind", Type: ddb.S}
+	size := ddb.KeyAttribute{Name: "size", Type: ddb.N}
+	desc, err := d.CreateTable(ddb.CreateTableRequest{
+		Key:        ddb.KeySchema{Hash: user, Range: at},
+		Throughput: &ddb.Throughput{Read: 5, Write: 5},
+		GlobalIndexes: []ddb.GlobalIndex{{
+			Name:       "by-kind",
+			Key:        ddb.KeySchema{Hash: kind, Range: at},
+			Projection: ddb.Projection{Type: ddb.ProjectKeysOnly},
+			Throughput: &ddb.Throughput{Read: 1, Write: 1},
+		}},
+		LocalIndexes: []ddb.LocalIndex{{Name: "by-size", Range: size}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.TableStatus != ddb.Creating || desc.Billing() != ddb.Provisioned {
+		t.Errorf("bad new table: %+v", desc)
+	}
+	if _, err := d.CreateTable(ddb.CreateTableRequest{Key: ddb.KeySchema{Hash: user}}); !ddb.IsCode(err, "ResourceInUseException") {
+		t.Errorf("recreated a table: %v", err)
+	}
+	desc, err = d.WaitUntilActive(time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ddb.KeySchema{Hash: user, Range: at}
+	if k := desc.Key(); k != want || len(desc.GlobalSecondaryIndexes) != 1 || len(desc.LocalSecondaryIndexes) != 1 {
+		t.Errorf("bad table: %+v", desc)
+	}
+	if names, err := d.ListTables(); err != nil || !reflect.DeepEqual(names, []string{"a", "events"}) {
+		t.Errorf("bad tables: %v, %v", names, err)
+	}
+
+	if _, err := d.UpdateTable(ddb.UpdateTableRequest{Billing: ddb.PayPerRequest, DeleteIndexes: []string{"by-kind"}}); err != nil {
+		t.Fatal(err)
+	}
+	desc, err = d.WaitUntilActive(time.Millisecond, time.Second)
+	if err != nil || desc.Billing() != ddb.PayPerRequest || len(desc.GlobalSecondaryIndexes) != 0 {
+		t.Errorf("bad updated table: %+v, %v", desc, err)
+	}
+
+	if err := d.UpdateTimeToLive("expires", true); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := d.DescribeTimeToLive(); err != nil || ttl.TimeToLiveStatus != "ENABLED" || ttl.AttributeName != "expires" {
+		t.Errorf("bad ttl: %+v, %v", ttl, err)
+	}
+	if err := d.UpdateTimeToLive("expires", true); !ddb.IsCode(err, "ValidationException") {
+		t.Errorf("enabled ttl twice: %v", err)
+	}
+
+	if err := d.DeleteTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WaitUntilDeleted(time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.DynamoDB("missing").WaitUntilActive(time.Millisecond, 10*time.Millisecond); err == nil {
+		t.Error("waited for a missing table")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := srv.DynamoDB("missing").WithContext(ctx).WaitUntilActive(time.Millisecond, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled wait: %v", err)
+	}
+	bad := srv.DynamoDB("events")
+	bad.Auth.SecretKey = "wrong"
+	if _, err := bad.WaitUntilActive(time.Millisecond, time.Second); !ddb.IsCode(err, "InvalidSignatureException") {
+		t.Errorf("expected the describe error: %v", err)
+	}
+}
+
+func TestPostUpload(t *testing.T) {
+	srv := NewServer(testAuth)
+	defer srv.Close()
+	srv.S3.MakeBucket("b")
+	srv.SessionToken = "token"
+	temp := aws.ProviderFunc(func() (*aws.Credentials, error) {
+		return &aws.Credentials{AccessKey: testAuth.AccessKey, SecretKey: testAuth.SecretKey, SessionToken: "token"}, nil
+	})
+	ss3 := s3.GetForEndpoint(temp, srv.URL, "", s3.PathStyle).(s3.SmartS3)
+	f, err := ss3.PresignPost(s3.PostPolicy{
+		Bucket:     "b",
+		KeyPrefix:  "uploads/",
+		MaxSize:    100,
+		Expiration: time.Minute,
+		Fields:     map[string]string{"success_action_status": "201"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Fields["x-amz-security-token"] != "token" {
+		t.Fatalf("no session token: %v", f.Fields)
+	}
+	post := func(fields map[string]string, data string) int {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		for k, v := range fields {
+			w.WriteField(k, v)
+		}
+		fw, err := w.CreateFormFile("file", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+		w.Close()
+		resp, err := http.Post(f.URL, w.FormDataContentType(), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(f.Fields, "hello"); code != 201 {
+		t.Fatalf("post: %d", code)
+	}
+	if buf, err := ss3.GetObject(s3.GetRequest{Object: s3.Object{Bucket: "b", Key: "uploads/a.txt"}}); err != nil || string(buf) != "hello" {
+		t.Errorf("bad upload: %q, %v", buf, err)
+	}
+	if code := post(f.Fields, strings.Repeat("x", 101)); code != 400 {
+		t.Errorf("too large a post: %d", code)
+	}
+	tampered := func(k, v string) map[string]string {
+		out := map[string]string{k: v}
+		for k, v := range f.Fields {
+			if _, ok := out[k]; !ok {
+				out[k] = v
+			}
+		}
+		return out
+	}
+	if code := post(tampered("x-amz-security-token", ""), "hello"); code != 403 {
+		t.Errorf("post without a token: %d", code)
+	}
+	if code := post(tampered("x-amz-meta-user", "joe"), "hello"); code != 403 {
+		t.Errorf("post with an extra field: %d", code)
+	}
+	if code := post(tampered("key", "other/${filename}"), "hello"); code != 403 {
+		t.Errorf("post outside the prefix: %d", code)
+	}
+}
+
+func TestDecodeChunked(t *testing.T) {
+	body := "5\r\nhello\r\n0\r\nx-amz-checksum-crc32c:mnG7TA==\r\n\r\n"
+	header := func() http.Header {
+		h := make(http.Header)
+		h.Set("Content-Encoding", "aws-chunked")
+		h.Set("X-Amz-Content-Sha256", aws.StreamingUnsignedTrailer)
+		h.Set("X-Amz-Trailer", "x-amz-checksum-crc32c")
+		h.Set("X-Amz-Decoded-Content-Length", "5")
+		return h
+	}
+	h := header()
+	data, err := decodeChunked(h, []byte(body))
+	if err != nil || string(data) != "hello" || h.Get("Content-Encoding") != "" {
+		t.Fatalf("bad decoding: %q, %v, %v", data, h, err)
+	}
+	if err := checkChecksum(h, data); err != nil {
+		t.Error(err)
+	}
+	h = header()
+	data, err = decodeChunked(h, []byte(strings.Replace(body, "hello", "hellO", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkChecksum(h, data); !s3.IsCode(err, "BadDigest") {
+		t.Errorf("expected bad digest: %v", err)
+	}
+	for _, bad := range []string{"5\r\nhel", "5\r\nhello\r\n0\r\nx-amz-meta-x:y\r\n\r\n", "5\r\nhello\r\n0\r\n"} {
+		if _, err := decodeChunked(header(), []byte(bad)); err == nil {
+			t.Errorf("decoded %q", bad)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package awstest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xoba/goutil/aws"
+)
+
+const (
+	isoFormat = "20060102T150405Z"
+
+	// how far a request's time may be from the server's
+	maxSkew = 15 * time.Minute
+)
+
+// a request that failed authentication, with the s3 error code and status to report
+type authError struct {
+	Status        int
+	Code, Message string
+}
+
+func (e *authError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func denied(status int, code, message string) error {
+	return &authError{Status: status, Code: code, Message: message}
+}
+
+// checks r's sigv4 signature, in its Authorization header or query string, against the
+// server's keys. body is r's payload, already read.
+func (s *Server) verify(r *http.Request, body []byte) error {
+	token := r.Header.Get("X-Amz-Security-Token")
+	if token == "" {
+		token = r.URL.Query().Get("X-Amz-Security-Token")
+	}
+	if token != s.SessionToken {
+		return denied(403, "InvalidToken", "the provided token is malformed or otherwise invalid")
+	}
+	if r.URL.Query().Get("X-Amz-Signature") != "" {
+		return s.verifyPresigned(r)
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return denied(403, "AccessDenied", "no Authorization header")
+	}
+	fields, err := parseAuthorization(auth)
+	if err != nil {
+		return err
+	}
+	svc, err := s.scope(fields["Credential"])
+	if err != nil {
+		return err
+	}
+	c := clone(r, strings.Split(fields["SignedHeaders"], ";"), body)
+	t, err := requestTime(c.Header)
+	if err != nil {
+		return denied(403, "AccessDenied", "no valid date: "+err.Error())
+	}
+	if skew := time.Since(t); skew > maxSkew || skew < -maxSkew {
+		return denied(403, "RequestTimeTooSkewed", "request time differs from the server's by "+skew.String())
+	}
+	if c.Header.Get("X-Amz-Date") == "" {
+		// Sign wants an http date, and rewrites it into the iso form clients then send
+		c.Header.Set("Date", t.Format(http.TimeFormat))
+	}
+	if p := c.Header.Get("X-Amz-Content-Sha256"); p != "" && p != aws.UnsignedPayload && p != aws.StreamingUnsignedTrailer {
+		if h := sha256.Sum256(body); p != hex.EncodeToString(h[:]) {
+			return denied(400, "XAmzContentSHA256Mismatch", "payload doesn't match x-amz-content-sha256")
+		}
+	}
+	keys := s.keys()
+	if err := svc.Sign(&keys, c); err != nil {
+		return denied(403, "AccessDenied", err.Error())
+	}
+	if !hmac.Equal([]byte(c.Header.Get("Authorization")), []byte(auth)) {
+		return denied(403, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided")
+	}
+	return nil
+}
+
+// checks a presigned url, which must not have expired
+func (s *Server) verifyPresigned(r *http.Request) error {
+	q := r.URL.Query()
+	svc, err := s.scope(q.Get("X-Amz-Credential"))
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(isoFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return denied(400, "AuthorizationQueryParametersError", "bad X-Amz-Date")
+	}
+	secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || secs <= 0 {
+		return denied(400, "AuthorizationQueryParametersError", "bad X-Amz-Expires")
+	}
+	switch now := time.Now(); {
+	case now.After(t.Add(time.Duration(secs) * time.Second)):
+		return denied(403, "AccessDenied", "request has expired")
+	case t.After(now.Add(maxSkew)):
+		return denied(403, "AccessDenied", "request is not yet valid")
+	}
+	sig := q.Get("X-Amz-Signature")
+	q.Del("X-Amz-Signature")
+	c := clone(r, strings.Split(q.Get("X-Amz-SignedHeaders"), ";"), nil)
+	c.URL.RawQuery = q.Encode()
+	keys := s.keys()
+	if err := svc.Presign(&keys, c, t, time.Duration(secs)*time.Second); err != nil {
+		return denied(403, "AccessDenied", err.Error())
+	}
+	signed := c.URL.Query()
+	if signed.Get("X-Amz-SignedHeaders") != q.Get("X-Amz-SignedHeaders") || !hmac.Equal([]byte(signed.Get("X-Amz-Signature")), []byte(sig)) {
+		return denied(403, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided")
+	}
+	return nil
+}
+
+func (s *Server) keys() aws.Keys {
+	return aws.Keys{AccessKey: s.Auth.AccessKey, SecretKey: s.Auth.SecretKey}
+}
+
+// the service a credential like "AKID/20130524/us-east-1/s3/aws4_request" is scoped to,
+// if its access key is the server's
+func (s *Server) scope(credential string) (*aws.Service, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, denied(400, "AuthorizationHeaderMalformed", "bad credential: "+credential)
+	}
+	if parts[0] != s.Auth.AccessKey {
+		return nil, denied(403, "InvalidAccessKeyId", "unknown access key: "+parts[0])
+	}
+	return &aws.Service{Name: parts[3], Region: parts[2]}, nil
+}
+
+// the fields of an Authorization header like
+// "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=..., Signature=..."
+func parseAuthorization(auth string) (map[string]string, error) {
+	const prefix = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(auth, prefix) {
+		return nil, denied(400, "AuthorizationHeaderMalformed", "only AWS4-HMAC-SHA256 is supported")
+	}
+	out := make(map[string]string)
+	for _, f := range strings.Split(auth[len(prefix):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, denied(400, "AuthorizationHeaderMalformed", "bad field: "+f)
+		}
+		out[kv[0]] = kv[1]
+	}
+	for _, k := range []string{"Credential", "SignedHeaders", "Signature"} {
+		if out[k] == "" {
+			return nil, denied(400, "AuthorizationHeaderMalformed", "no "+k)
+		}
+	}
+	return out, nil
+}
+
+// a copy of r with just the signed headers, as the client had it when signing
+func clone(r *http.Request, signed []string, body []byte) *http.Request {
+	u := *r.URL
+	c := &http.Request{
+		Method: r.Method,
+		URL:    &u,
+		Host:   r.Host,
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	for _, h := range signed {
+		k := http.CanonicalHeaderKey(h)
+		if v, ok := r.Header[k]; ok && k != "Host" {
+			c.Header[k] = append([]string(nil), v...)
+		}
+	}
+	return c
+}
+
+// from X-Amz-Date, or Date in iso or http form
+func requestTime(h http.Header) (time.Time, error) {
+	if d := h.Get("X-Amz-Date"); d != "" {
+		return time.Parse(isoFormat, d)
+	}
+	d := h.Get("Date")
+	if t, err := time.Parse(isoFormat, d); err == nil {
+		return t, nil
+	}
+	return time.Parse(http.TimeFormat, d)
+}
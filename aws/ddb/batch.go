@@ -0,0 +1,182 @@
+package ddb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/xoba/goutil"
+)
+
+const (
+	// the most keys in a BatchGetItem request, and items in a BatchWriteItem request
+	MaxBatchGet   = 100
+	MaxBatchWrite = 25
+
+	DefaultBatchConcurrency = 4
+)
+
+type BatchGetRequest struct {
+	Keys            []Key
+	ConsistentRead  bool
+	AttributesToGet []string // empty means all, but must include the key attributes if not
+	Concurrency     int      // requests at once; zero means DefaultBatchConcurrency
+}
+
+// each item is either put or deleted
+type BatchWriteRequest struct {
+	Puts        []map[string]Value
+	Deletes     []Key
+	Concurrency int // requests at once; zero means DefaultBatchConcurrency
+}
+
+type keysAndAttributes struct {
+	Keys            []Key
+	ConsistentRead  bool     `json:",omitempty"`
+	AttributesToGet []string `json:",omitempty"`
+}
+
+type batchGetInput struct {
+	RequestItems map[string]keysAndAttributes
+}
+
+type batchGetOutput struct {
+	Responses       map[string][]map[string]Value
+	UnprocessedKeys map[string]keysAndAttributes
+}
+
+type writeRequest struct {
+	PutRequest    *putRequest    `json:",omitempty"`
+	DeleteRequest *deleteRequest `json:",omitempty"`
+}
+
+type putRequest struct {
+	Item map[string]Value
+}
+
+type deleteRequest struct {
+	Key Key
+}
+
+type batchWriteInput struct {
+	RequestItems map[string][]writeRequest
+}
+
+type batchWriteOutput struct {
+	UnprocessedItems map[string][]writeRequest
+}
+
+// reads items by key, in chunks of MaxBatchGet, returning those found in no particular
+// order. keys dynamodb leaves unprocessed, as when throttled, are requested again after
+// backing off as d.Strat allows.
+func (d DynamoDB) BatchGetItem(r BatchGetRequest) ([]map[string]Value, error) {
+	keys, err := dedupe(r.Keys)
+	if err != nil {
+		return nil, err
+	}
+	var lock sync.Mutex
+	var items []map[string]Value
+	err = d.batches(len(keys), MaxBatchGet, r.Concurrency, func(i, j int) error {
+		ka := keysAndAttributes{Keys: keys[i:j], ConsistentRead: r.ConsistentRead, AttributesToGet: r.AttributesToGet}
+		bs := d.Strat.NewInstance()
+		for {
+			var out batchGetOutput
+			in := batchGetInput{RequestItems: map[string]keysAndAttributes{d.Table: ka}}
+			if err := d.do("BatchGetItem", in, &out); err != nil {
+				return err
+			}
+			lock.Lock()
+			items = append(items, out.Responses[d.Table]...)
+			lock.Unlock()
+			left, ok := out.UnprocessedKeys[d.Table]
+			if !ok || len(left.Keys) == 0 {
+				return nil
+			}
+			if !bs.Retry() {
+				return fmt.Errorf("%d keys unprocessed", len(left.Keys))
+			}
+			ka = left
+		}
+	})
+	return items, err
+}
+
+// puts and deletes items, in chunks of MaxBatchWrite, retrying unprocessed items like
+// BatchGetItem. writes aren't conditional, and an item may appear only once in all.
+func (d DynamoDB) BatchWriteItem(r BatchWriteRequest) error {
+	var writes []writeRequest
+	for _, item := range r.Puts {
+		writes = append(writes, writeRequest{PutRequest: &putRequest{Item: item}})
+	}
+	for _, k := range r.Deletes {
+		writes = append(writes, writeRequest{DeleteRequest: &deleteRequest{Key: k}})
+	}
+	return d.batches(len(writes), MaxBatchWrite, r.Concurrency, func(i, j int) error {
+		chunk := writes[i:j]
+		bs := d.Strat.NewInstance()
+		for {
+			var out batchWriteOutput
+			if err := d.do("BatchWriteItem", batchWriteInput{RequestItems: map[string][]writeRequest{d.Table: chunk}}, &out); err != nil {
+				return err
+			}
+			left := out.UnprocessedItems[d.Table]
+			if len(left) == 0 {
+				return nil
+			}
+			if !bs.Retry() {
+				return fmt.Errorf("%d items unprocessed", len(left))
+			}
+			chunk = left
+		}
+	})
+}
+
+// calls f concurrently on chunks [i, j) of n things, returning the first error, as is
+// or with a count of the others, after all are tried
+func (d DynamoDB) batches(n, size, concurrency int, f func(i, j int) error) error {
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	var lock sync.Mutex
+	var errs []error
+	q := goutil.NewWorkQueue(concurrency)
+	for i := 0; i < n; i += size {
+		i, j := i, i+size
+		if j > n {
+			j = n
+		}
+		q.Submit(func() {
+			if err := f(i, j); err != nil {
+				lock.Lock()
+				defer lock.Unlock()
+				errs = append(errs, err)
+			}
+		})
+	}
+	q.Wait()
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%w (and %d other errors)", errs[0], len(errs)-1)
+	}
+}
+
+// keys without duplicates, which dynamodb rejects
+func dedupe(keys []Key) ([]Key, error) {
+	seen := make(map[string]bool)
+	var out []Key
+	for _, k := range keys {
+		buf, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[string(buf)] {
+			seen[string(buf)] = true
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
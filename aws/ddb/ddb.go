@@ -1,13 +1,17 @@
-// code for accessing dynamo db.
+// code for accessing dynamo db, through its 2012-08-10 api.
 package ddb
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/xoba/goutil"
@@ -15,464 +19,224 @@ import (
 )
 
 type DynamoDB struct {
-	Table string
-	Auth  aws.Auth
-	Strat goutil.RetryStrategy
-}
+	Table       string
+	Auth        aws.Auth
+	Credentials aws.Provider // if set, used instead of Auth
+	Strat       goutil.RetryStrategy
+
+	// empty means DefaultRegion
+	Region string
 
-type ValueType byte
+	// base url of the service, e.g. "http://localhost:8000" for dynamodb local;
+	// empty means the regional endpoint, e.g. DefaultEndpoint
+	Endpoint string
+
+	// name of the table's hash key attribute, for the methods taking a string key
+	// (GetItem, UpdateItem, IncrementItem and DeleteItem). if empty, their first call
+	// for a table looks it up with an extra DescribeTable request, which needs the
+	// dynamodb:DescribeTable permission.
+	HashKey string
+
+	ctx context.Context // see WithContext
+}
 
 const (
-	_ = iota
-	S
-	N
+	DefaultRegion   = "us-east-1"
+	DefaultEndpoint = "https://dynamodb.us-east-1.amazonaws.com"
 )
 
-type Value struct {
-	Type ValueType
-	S    string
-	N    float64
-}
+const targetPrefix = "DynamoDB_20120810."
 
-type sType struct {
-	S string `json:",omitempty"`
-	N string `json:",omitempty"`
+func (d DynamoDB) region() string {
+	if d.Region == "" {
+		return DefaultRegion
+	}
+	return d.Region
 }
 
-func createSType(v Value) (out sType) {
-	switch v.Type {
-	case S:
-		out.S = v.S
-	case N:
-		out.N = fmt.Sprintf("%f", v.N)
+func (d DynamoDB) endpoint() string {
+	if d.Endpoint == "" {
+		return "https://dynamodb." + d.region() + ".amazonaws.com/"
 	}
-	return
+	return strings.TrimSuffix(d.Endpoint, "/") + "/"
 }
 
-func SV(s string) Value {
-	return Value{Type: S, S: s}
-}
-func NV(n float64) Value {
-	return Value{Type: N, N: n}
+// a copy of d whose requests, retries and waits end once ctx is done
+func (d DynamoDB) WithContext(ctx context.Context) DynamoDB {
+	if ctx == nil {
+		panic("nil context")
+	}
+	d.ctx = ctx
+	return d
 }
 
-func (v Value) String() string {
-	switch v.Type {
-	case S:
-		return v.S
-	case N:
-		return fmt.Sprintf("%f", v.N)
-	default:
-		return "n/a"
+// the context requests are bound to, by default context.Background()
+func (d DynamoDB) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
 	}
+	return d.ctx
 }
 
-func GetDefault(table string, a aws.Auth) DynamoDB {
-	return DynamoDB{Table: table, Auth: a, Strat: &goutil.RetryBackoffStrat{BackoffFactor: 2, Delay: 10 * time.Millisecond, Retries: 5}}
+// p may be a static aws.Auth
+func GetDefault(table string, p aws.Provider) DynamoDB {
+	return DynamoDB{Table: table, Credentials: p, Strat: &goutil.RetryBackoffStrat{BackoffFactor: 2, Delay: 10 * time.Millisecond, Retries: 5}}
 }
 
+// sets v as the value of an item's attribute, creating the item if need be.
+// may call DescribeTable; see HashKey.
 func (d DynamoDB) UpdateItem(key, attr string, v Value) error {
-	f := func() (interface{}, error) {
-		err := d.updateItem(key, attr, v)
-		return err, err
+	k, err := d.stringKey(key)
+	if err != nil {
+		return err
 	}
-	_, err := d.retry("update", f)
+	_, err = d.Update(UpdateItemRequest{Key: k, Updates: map[string]Update{attr: {Action: Put, Value: v}}})
 	return err
 }
 
+// adds v to a numeric attribute, which is treated as zero if missing.
+// may call DescribeTable; see HashKey.
 func (d DynamoDB) IncrementItem(key, attr string, v float64) error {
-	f := func() (interface{}, error) {
-		err := d.incItem(key, attr, v)
-		return err, err
+	k, err := d.stringKey(key)
+	if err != nil {
+		return err
 	}
-	_, err := d.retry("inc", f)
+	_, err = d.Update(UpdateItemRequest{Key: k, Updates: map[string]Update{attr: {Action: Add, Value: NV(v)}}})
 	return err
 }
 
+// may call DescribeTable; see HashKey
 func (d DynamoDB) DeleteItem(key string) error {
-	f := func() (interface{}, error) {
-		return nil, d.deleteItem(key)
-	}
-	_, err := d.retry("delete", f)
+	k, err := d.stringKey(key)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = d.Delete(DeleteItemRequest{Key: k})
+	return err
 }
 
 func (d DynamoDB) PutItem(item map[string]Value) error {
-	f := func() (interface{}, error) {
-		err := d.putItem(item)
-		return err, err
-	}
-	_, err := d.retry("put", f)
+	_, err := d.Put(PutItemRequest{Item: item})
 	return err
 }
 
-type updateRequest struct {
-	TableName        string
-	Key              keyType
-	AttributeUpdates map[string]attrUpdate
-}
-
-type attrUpdate struct {
-	Value  sType
-	Action string
-}
-
-func (d DynamoDB) updateItem(key, attr string, v Value) error {
-
-	now := time.Now()
-
-	transport := http.DefaultTransport
-
-	kt := keyType{HashKeyElement: sType{S: key}}
-
-	update := make(map[string]attrUpdate)
-	update[attr] = attrUpdate{Value: createSType(v), Action: "PUT"}
-
-	content, err := json.MarshalIndent(updateRequest{TableName: d.Table, Key: kt, AttributeUpdates: update}, "", "  ")
-
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com/", bytes.NewReader(content))
-
-	if err != nil {
-		return err
-	}
-
-	req.Header.Add("Date", formatTime(now))
-	req.Header.Add("X-Amz-Target", "DynamoDB_20111205.UpdateItem")
-	req.Header.Add("Content-Type", "application/x-amz-json-1.0")
-
-	keys := d.keys()
-
-	svc := aws.Service{Name: "dynamodb", Region: "us-east-1"}
-
-	err = svc.Sign(&keys, req)
-
-	if err != nil {
-		return err
-	}
-
-	resp, err := transport.RoundTrip(req)
-
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return errors.New("status " + resp.Status)
-	}
-
-	return nil
-}
-
-func (d DynamoDB) incItem(key, attr string, v float64) error {
-
-	now := time.Now()
-
-	transport := http.DefaultTransport
-
-	kt := keyType{HashKeyElement: sType{S: key}}
-
-	update := make(map[string]attrUpdate)
-	update[attr] = attrUpdate{Value: sType{N: fmt.Sprintf("%f", v)}, Action: "ADD"}
-
-	content, err := json.MarshalIndent(updateRequest{TableName: d.Table, Key: kt, AttributeUpdates: update}, "", "  ")
-
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com/", bytes.NewReader(content))
-
-	if err != nil {
-		return err
-	}
-
-	req.Header.Add("Date", formatTime(now))
-	req.Header.Add("X-Amz-Target", "DynamoDB_20111205.UpdateItem")
-	req.Header.Add("Content-Type", "application/x-amz-json-1.0")
-
-	keys := d.keys()
-
-	svc := aws.Service{Name: "dynamodb", Region: "us-east-1"}
-
-	err = svc.Sign(&keys, req)
-
-	if err != nil {
-		return err
-	}
-
-	resp, err := transport.RoundTrip(req)
-
+// three return values: item, whether or not item was found, and error if any.
+// reads are consistent. may call DescribeTable; see HashKey.
+func (d DynamoDB) GetItem(key string) (map[string]Value, bool, error) {
+	k, err := d.stringKey(key)
 	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return errors.New("status " + resp.Status)
+		return nil, false, err
 	}
-
-	return nil
+	return d.Get(GetItemRequest{Key: k, ConsistentRead: true})
 }
 
-func (d DynamoDB) putItem(item map[string]Value) error {
-
-	now := time.Now()
-
-	transport := http.DefaultTransport
-
-	m := make(map[string]sType)
-
-	for key, value := range item {
-
-		switch value.Type {
-		case S:
-			m[key] = sType{S: value.S}
-		case N:
-			m[key] = sType{N: fmt.Sprintf("%f", value.N)}
-		default:
-			return errors.New("illegal type")
+// a key for the string-keyed methods, which only work on tables without range keys
+func (d DynamoDB) stringKey(key string) (Key, error) {
+	name := d.HashKey
+	if name == "" {
+		schema, err := d.keySchema()
+		if err != nil {
+			return nil, err
+		}
+		if schema.rangeKey != "" {
+			return nil, fmt.Errorf("table %s has range key %q; use a Key", d.Table, schema.rangeKey)
 		}
+		name = schema.hashKey
 	}
+	return Key{name: SV(key)}, nil
+}
 
-	content, err := json.MarshalIndent(putRequest{TableName: d.Table, Item: m}, "", "  ")
-
-	if err != nil {
-		return err
-	}
+type keySchema struct {
+	hashKey, rangeKey string
+}
 
-	req, err := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com/", bytes.NewReader(content))
+// tables' key schemas, by endpoint and table name, which don't change
+var schemas = struct {
+	sync.Mutex
+	m map[string]keySchema
+}{m: make(map[string]keySchema)}
 
-	if err != nil {
-		return err
+func (d DynamoDB) keySchema() (keySchema, error) {
+	id := d.endpoint() + " " + d.Table
+	schemas.Lock()
+	schema, ok := schemas.m[id]
+	schemas.Unlock()
+	if ok {
+		return schema, nil
 	}
-
-	req.Header.Add("Date", formatTime(now))
-	req.Header.Add("X-Amz-Target", "DynamoDB_20111205.PutItem")
-	req.Header.Add("Content-Type", "application/x-amz-json-1.0")
-
-	keys := d.keys()
-
-	svc := aws.Service{Name: "dynamodb", Region: "us-east-1"}
-
-	err = svc.Sign(&keys, req)
-
+	t, err := d.DescribeTable()
 	if err != nil {
-		return err
+		return schema, err
 	}
+	k := t.Key()
+	schema.hashKey, schema.rangeKey = k.Hash.Name, k.Range.Name
+	schemas.Lock()
+	schemas.m[id] = schema
+	schemas.Unlock()
+	return schema, nil
+}
 
-	resp, err := transport.RoundTrip(req)
+// drops d.Table's cached key schema, as when the table is deleted or recreated
+func (d DynamoDB) forgetSchema() {
+	schemas.Lock()
+	delete(schemas.m, d.endpoint()+" "+d.Table)
+	schemas.Unlock()
+}
 
+// posts a request for an operation like "GetItem", with retries, decoding the response into out unless nil
+func (d DynamoDB) do(op string, in, out interface{}) error {
+	content, err := json.Marshal(in)
 	if err != nil {
 		return err
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return errors.New("status " + resp.Status)
+	f := func() (interface{}, error) {
+		return nil, d.call(op, content, out)
 	}
-
-	return nil
+	_, err = d.retry(op, f)
+	return err
 }
 
-func (d DynamoDB) deleteItem(mykey string) error {
-
-	now := time.Now()
-
-	transport := http.DefaultTransport
-
-	myid := sType{S: mykey}
-	key := keyType{myid}
-	content, err := json.Marshal(deleteRequest{TableName: d.Table, Key: key})
-
+func (d DynamoDB) call(op string, content []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(d.Context(), "POST", d.endpoint(), bytes.NewReader(content))
 	if err != nil {
 		return err
 	}
-
-	req, err := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com/", bytes.NewReader(content))
-	if err != nil {
+	req.Header.Set("X-Amz-Target", targetPrefix+op)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	if err := d.signer().Sign(req, hashHex(content), time.Now()); err != nil {
 		return err
 	}
-
-	req.Header.Add("Date", formatTime(now))
-	req.Header.Add("X-Amz-Target", "DynamoDB_20111205.DeleteItem")
-	req.Header.Add("Content-Type", "application/x-amz-json-1.0")
-
-	keys := d.keys()
-
-	svc := aws.Service{Name: "dynamodb", Region: "us-east-1"}
-
-	err = svc.Sign(&keys, req)
-
+	resp, err := http.DefaultTransport.RoundTrip(req)
 	if err != nil {
 		return err
 	}
-
-	resp, err := transport.RoundTrip(req)
-
-	if err != nil {
-		return err
-	}
-
 	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return errors.New("status " + resp.Status)
-	}
-
-	return nil
-
-}
-
-// three return values: item, whether or not item was found, and error if any
-func (d DynamoDB) GetItem(key string) (map[string]Value, bool, error) {
-	f := func() (interface{}, error) {
-		out, has, err := d.getItem(key)
-		return getItemResult{Map: out, Has: has}, err
-	}
-	v, err := d.retry("get", f)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, false, err
-	}
-	x := v.(getItemResult)
-	return x.Map, x.Has, nil
-}
-
-type getItemResult struct {
-	Map map[string]Value
-	Has bool
-}
-
-func (d DynamoDB) getItem(mykey string) (out map[string]Value, hasItem bool, err error) {
-
-	out = make(map[string]Value)
-	hasItem = true
-
-	now := time.Now()
-
-	transport := http.DefaultTransport
-
-	myid := sType{S: mykey}
-	key := keyType{myid}
-	content, err := json.Marshal(getRequest{TableName: d.Table, Key: key, ConsistentRead: true})
-
-	if err != nil {
-		return
-	}
-
-	req, err := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com/", bytes.NewReader(content))
-
-	if err != nil {
-		return
-	}
-
-	req.Header.Add("Date", formatTime(now))
-	req.Header.Add("X-Amz-Target", "DynamoDB_20111205.GetItem")
-	req.Header.Add("Content-Type", "application/x-amz-json-1.0")
-
-	keys := d.keys()
-
-	svc := aws.Service{Name: "dynamodb", Region: "us-east-1"}
-
-	err = svc.Sign(&keys, req)
-
-	if err != nil {
-		return
-	}
-
-	resp, err := transport.RoundTrip(req)
-
-	if err != nil {
-		return
+		return err
 	}
-
-	defer resp.Body.Close()
-
 	if resp.StatusCode != 200 {
-		err = errors.New("status " + resp.Status)
-		return
+		return responseError(resp, body)
 	}
-
-	var buf bytes.Buffer
-	buf.ReadFrom(resp.Body)
-
-	var v map[string]interface{}
-
-	err = json.Unmarshal(buf.Bytes(), &v)
-	if err != nil {
-		return
+	if out == nil {
+		return nil
 	}
-
-	item, ok := v["Item"].(map[string]interface{})
-
-	if !ok {
-		hasItem = false
-		return
-	}
-
-	for key, value := range item {
-
-		v, ok := value.(map[string]interface{})
-		if !ok {
-			err = errors.New("bad kv")
-			return
-		}
-
-		switch {
-		case v["N"] != nil:
-			n, err2 := strconv.ParseFloat(v["N"].(string), 64)
-			if err2 != nil {
-				err = err2
-				return
-			}
-			out[key] = Value{Type: N, N: n}
-		case v["S"] != nil:
-			out[key] = Value{Type: S, S: v["S"].(string)}
-
-		}
-	}
-
-	return
-}
-
-type deleteRequest struct {
-	TableName string
-	Key       keyType
-}
-
-type putRequest struct {
-	TableName string
-	Item      map[string]sType
-}
-
-type getRequest struct {
-	TableName      string
-	Key            keyType
-	ConsistentRead bool
+	return json.Unmarshal(body, out)
 }
 
-type keyType struct {
-	HashKeyElement sType
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
 }
 
-func formatTime(t time.Time) string {
-	return t.UTC().Format(http.TimeFormat)
+func (d DynamoDB) retry(msg string, f func() (interface{}, error)) (v interface{}, err error) {
+	return goutil.RetryIfContext(d.Context(), msg, d.Strat.NewInstance(), Retryable, f)
 }
 
-func (s DynamoDB) retry(msg string, f func() (interface{}, error)) (v interface{}, err error) {
-	return goutil.Retry(msg, s.Strat.NewInstance(), f)
-}
-
-func (d DynamoDB) keys() aws.Keys {
-	return aws.Keys{AccessKey: d.Auth.AccessKey, SecretKey: d.Auth.SecretKey}
+func (d DynamoDB) signer() *aws.Signer {
+	p := d.Credentials
+	if p == nil {
+		p = d.Auth
+	}
+	return aws.NewSigner("dynamodb", d.region(), p)
 }
@@ -1,8 +1,198 @@
 package ddb
 
 import (
+	"encoding/json"
+	"math"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestBogus(t *testing.T) {
 }
+
+func TestValueJSON(t *testing.T) {
+	tests := []struct {
+		v        Value
+		expected string
+	}{
+		{DV("1"), `{"N":"1"}`},
+		{NV(0.0000001), `{"N":"0.0000001"}`},
+		{IV(1 << 62), `{"N":"4611686018427387904"}`},
+		{BV(nil), `{"B":""}`},
+		{NullV(), `{"NULL":true}`},
+		{LV(), `{"L":[]}`},
+		{MV(map[string]Value{"a": SV("")}), `{"M":{"a":{"S":""}}}`},
+	}
+	for _, test := range tests {
+		buf, err := json.Marshal(test.v)
+		if err != nil || string(buf) != test.expected {
+			t.Errorf("expected %s, got %s, %v", test.expected, buf, err)
+		}
+	}
+	for _, v := range []Value{DV("1.2.3"), DV(""), SSV(), {}} {
+		if _, err := json.Marshal(v); err == nil {
+			t.Errorf("marshaled %#v", v)
+		}
+	}
+	var v Value
+	if err := json.Unmarshal([]byte(`{"X":1}`), &v); err == nil {
+		t.Error("unmarshaled an unknown type")
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	var p placeholders
+	cond := And(Exists("id"), Or(If("version", Cond(EQ, IV(3))), Not(If("tags", Cond(Contains, SV("x"))))))
+	s, err := cond.build(&p)
+	const expected = "(attribute_exists(#n0)) AND ((#n1 = :v0) OR (NOT (contains(#n2, :v1))))"
+	if err != nil || s != expected {
+		t.Errorf("expected %q, got %q, %v", expected, s, err)
+	}
+	u, err := updateExpression(map[string]Update{"a": {Value: SV("x")}, "b": {Action: Delete}, "c": {Action: Add, Value: IV(1)}, "version": {Value: IV(4)}}, &p)
+	const update = "SET #n3 = :v2, #n1 = :v4 REMOVE #n4 ADD #n5 :v3"
+	if err != nil || u != update {
+		t.Errorf("expected %q, got %q, %v", update, u, err)
+	}
+	if len(p.names) != 6 || p.names["#n1"] != "version" || p.values[":v4"].N != "4" {
+		t.Errorf("bad placeholders: %v, %v", p.names, p.values)
+	}
+	if _, err := If("a", Cond(Between, IV(1))).build(&p); err == nil {
+		t.Error("built BETWEEN with one value")
+	}
+}
+
+type base struct {
+	Created time.Time `ddb:"created"`
+}
+
+type event struct {
+	base
+	User    string            `ddb:"user,hash"`
+	Seq     uint64            `ddb:"seq,range"`
+	Tags    []string          `ddb:"tags,set"`
+	Scores  []float64         `ddb:"scores"`
+	Note    string            `ddb:"note,omitempty"`
+	Data    []byte            `ddb:"data"`
+	Props   map[string]int    `ddb:"props"`
+	Next    *event            `ddb:"next"`
+	Extra   interface{}       `ddb:"extra"`
+	Raw     Value             `ddb:"raw"`
+	Ignored string            `ddb:"-"`
+	Nested  struct{ OK bool } `ddb:"nested"`
+}
+
+type inner struct {
+	ID   string `ddb:"id"`
+	Name string
+	Size int
+}
+
+type other struct {
+	Name string `ddb:"Name"`
+	Size int
+}
+
+type Exported struct {
+	ID string `ddb:"id"`
+}
+
+type outer struct {
+	*inner
+	other
+	ID string `ddb:"id,hash"` // shadows inner's
+}
+
+func TestEmbedding(t *testing.T) {
+	// outer's id is shallowest, other's Name is tagged, and Size is ambiguous
+	item, err := Marshal(outer{inner: &inner{ID: "in", Name: "x", Size: 1}, other: other{Name: "y", Size: 2}, ID: "out"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(item, map[string]Value{"id": SV("out"), "Name": SV("y")}) {
+		t.Errorf("bad item: %v", item)
+	}
+	if item, err := Marshal(outer{ID: "out"}); err != nil || len(item) != 2 {
+		t.Errorf("bad item with nil embedded pointer: %v, %v", item, err)
+	}
+	var out outer
+	if err := Unmarshal(map[string]Value{"id": SV("a"), "Name": SV("b")}, &out); err != nil || out.ID != "a" || out.other.Name != "b" || out.inner != nil {
+		t.Errorf("bad unmarshal: %+v, %v", out, err)
+	}
+	var w struct{ *Exported }
+	if err := Unmarshal(map[string]Value{"id": SV("a")}, &w); err != nil || w.Exported == nil || w.ID != "a" {
+		t.Errorf("bad unmarshal into embedded pointer: %+v, %v", w, err)
+	}
+	// like encoding/json, which can't allocate unexported ones either
+	var u struct{ *inner }
+	if err := Unmarshal(map[string]Value{"id": SV("a")}, &u); err == nil {
+		t.Error("set an embedded pointer to an unexported struct")
+	}
+	if k, err := KeyOf(outer{ID: "k"}); err != nil || k["id"].S != "k" {
+		t.Errorf("bad key: %v, %v", k, err)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	e := event{
+		base:   base{Created: time.Date(2014, 1, 2, 3, 4, 5, 6, time.UTC)},
+		User:   "joe",
+		Seq:    1<<64 - 1,
+		Scores: []float64{0.5, 1e-7},
+		Data:   []byte("x"),
+		Props:  map[string]int{"a": 1},
+		Next:   &event{User: "sue", Tags: []string{"t"}},
+		Extra:  "y",
+		Raw:    NSV("1", "2"),
+	}
+	e.Nested.OK = true
+	item, err := Marshal(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := item["tags"]; ok || item["note"].Type != 0 || item["Ignored"].Type != 0 {
+		t.Errorf("unexpected attributes: %v", item)
+	}
+	if item["seq"].N != "18446744073709551615" || item["scores"].L[1].N != "0.0000001" || item["created"].S != "2014-01-02T03:04:05.000000006Z" {
+		t.Errorf("bad attributes: %v", item)
+	}
+	if next := item["next"].M; next["tags"].Type != SS || next["next"].Type != NULL {
+		t.Errorf("bad nested item: %v", next)
+	}
+	var out event
+	if err := Unmarshal(item, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, e) {
+		t.Errorf("expected %+v, got %+v", e, out)
+	}
+	k, err := KeyOf(e)
+	if err != nil || len(k) != 2 || k["user"].S != "joe" {
+		t.Errorf("bad key: %v, %v", k, err)
+	}
+	if err := Unmarshal(map[string]Value{"user": IV(1)}, &out); err == nil {
+		t.Error("unmarshaled a number into a string")
+	}
+	if item, err := Marshal(struct{ F, G float64 }{1e300, -1.5e-300}); err != nil || item["F"].N != "1e+300" || NV(1e21).N != "1e+21" || NV(1e20).N != "100000000000000000000" {
+		t.Errorf("bad large numbers: %v, %v", item, err)
+	} else if f, ok := interfaceValue(item["F"]).(float64); !ok || f != 1e300 {
+		t.Errorf("bad number read back: %v", interfaceValue(item["F"]))
+	}
+	if _, err := Marshal(struct{ F float64 }{math.NaN()}); err == nil {
+		t.Error("marshaled NaN")
+	}
+	if _, err := Marshal(struct{ F []float32 }{[]float32{float32(math.Inf(-1))}}); err == nil {
+		t.Error("marshaled -Inf")
+	}
+	if _, err := KeyOf(struct {
+		A string `ddb:"a,hash"`
+		B string `ddb:"b,hash"`
+	}{"x", "y"}); err == nil {
+		t.Error("made a key with two hash fields")
+	}
+	if _, err := KeyOf(struct {
+		A string `ddb:"a,range"`
+	}{"x"}); err == nil {
+		t.Error("made a key without a hash field")
+	}
+}
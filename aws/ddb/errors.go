@@ -0,0 +1,110 @@
+package ddb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// an error response from dynamodb
+type Error struct {
+	StatusCode int
+	Type       string // e.g. "com.amazonaws.dynamodb.v20120810#ResourceNotFoundException"
+	Message    string
+	RequestId  string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("ddb: %d %s: %s (request %s)", e.StatusCode, e.Code(), msg, e.RequestId)
+}
+
+// the type without its namespace, e.g. "ResourceNotFoundException"
+func (e *Error) Code() string {
+	return e.Type[strings.LastIndex(e.Type, "#")+1:]
+}
+
+// whether dynamodb may succeed if the request is retried
+func (e *Error) Temporary() bool {
+	switch e.Code() {
+	case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded",
+		"InternalServerError", "InternalFailure", "ServiceUnavailable":
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// builds an *Error from an unsuccessful response's body, like
+// {"__type": "com.amazonaws.dynamodb.v20120810#ResourceNotFoundException", "message": "..."}
+func responseError(resp *http.Response, body []byte) error {
+	var v struct {
+		Type     string `json:"__type"`
+		Message  string `json:"message"`
+		Message2 string `json:"Message"`
+	}
+	json.Unmarshal(body, &v)
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Type:       v.Type,
+		Message:    v.Message,
+		RequestId:  resp.Header.Get("X-Amzn-Requestid"),
+	}
+	if e.Message == "" {
+		e.Message = v.Message2
+	}
+	if e.Type == "" {
+		e.Type = http.StatusText(resp.StatusCode)
+	}
+	if e.Code() == "ConditionalCheckFailedException" {
+		return &ConditionalCheckFailedError{Err: e}
+	}
+	return e
+}
+
+// a write's condition didn't hold
+type ConditionalCheckFailedError struct {
+	Err *Error
+}
+
+func (e *ConditionalCheckFailedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConditionalCheckFailedError) Unwrap() error {
+	return e.Err
+}
+
+func IsConditionalCheckFailed(err error) bool {
+	var e *ConditionalCheckFailedError
+	return errors.As(err, &e)
+}
+
+// whether err is an *Error with the given code, e.g. "ResourceNotFoundException"
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code() == code
+}
+
+func IsResourceNotFound(err error) bool {
+	return IsCode(err, "ResourceNotFoundException")
+}
+
+// whether a failed request is worth retrying: throttling, server errors and network failures
+func Retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,211 @@
+package ddb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a condition expression, for conditional writes and for filtering queries and scans,
+// built from conditions on attributes:
+//
+//	ddb.And(ddb.Exists("id"), ddb.If("version", ddb.Cond(ddb.EQ, ddb.IV(3))))
+//
+// the zero Expression is no condition at all.
+type Expression struct {
+	op    string // "AND", "OR" or "NOT" for compound expressions
+	name  string
+	cond  Condition
+	terms []Expression
+}
+
+// a condition on an attribute, such as a comparison. see Operator.
+func If(name string, c Condition) Expression {
+	return Expression{name: name, cond: c}
+}
+
+func Exists(name string) Expression {
+	return If(name, Cond(NotNull))
+}
+
+func NotExists(name string) Expression {
+	return If(name, Cond(Null))
+}
+
+func And(terms ...Expression) Expression {
+	return Expression{op: "AND", terms: terms}
+}
+
+func Or(terms ...Expression) Expression {
+	return Expression{op: "OR", terms: terms}
+}
+
+func Not(e Expression) Expression {
+	return Expression{op: "NOT", terms: []Expression{e}}
+}
+
+func (e Expression) IsZero() bool {
+	return e.op == "" && e.name == ""
+}
+
+// the attribute names and values an expression refers to, as placeholders like "#n0" and ":v0"
+type placeholders struct {
+	names  map[string]string
+	values map[string]Value
+	byName map[string]string
+}
+
+func (p *placeholders) name(n string) string {
+	if ph, ok := p.byName[n]; ok {
+		return ph
+	}
+	if p.names == nil {
+		p.names, p.byName = make(map[string]string), make(map[string]string)
+	}
+	ph := "#n" + strconv.Itoa(len(p.names))
+	p.names[ph], p.byName[n] = n, ph
+	return ph
+}
+
+func (p *placeholders) value(v Value) string {
+	if p.values == nil {
+		p.values = make(map[string]Value)
+	}
+	ph := ":v" + strconv.Itoa(len(p.values))
+	p.values[ph] = v
+	return ph
+}
+
+var comparisons = map[Operator]string{EQ: "=", NE: "<>", LT: "<", LE: "<=", GT: ">", GE: ">="}
+
+// the expression's text, with placeholders
+func (e Expression) build(p *placeholders) (string, error) {
+	switch e.op {
+	case "AND", "OR":
+		if len(e.terms) == 0 {
+			return "", fmt.Errorf("empty %s", e.op)
+		}
+		var out []string
+		for _, t := range e.terms {
+			s, err := t.build(p)
+			if err != nil {
+				return "", err
+			}
+			out = append(out, "("+s+")")
+		}
+		return strings.Join(out, " "+e.op+" "), nil
+	case "NOT":
+		s, err := e.terms[0].build(p)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + s + ")", nil
+	}
+	if e.name == "" {
+		return "", errors.New("no attribute name")
+	}
+	n, vs := p.name(e.name), e.cond.Values
+	want := func(k int) error {
+		if len(vs) != k {
+			return fmt.Errorf("%s takes %d values, not %d", e.cond.Operator, k, len(vs))
+		}
+		return nil
+	}
+	switch op := e.cond.Operator; op {
+	case EQ, NE, LT, LE, GT, GE:
+		if err := want(1); err != nil {
+			return "", err
+		}
+		return n + " " + comparisons[op] + " " + p.value(vs[0]), nil
+	case Between:
+		if err := want(2); err != nil {
+			return "", err
+		}
+		return n + " BETWEEN " + p.value(vs[0]) + " AND " + p.value(vs[1]), nil
+	case In:
+		if len(vs) == 0 {
+			return "", errors.New("IN takes at least one value")
+		}
+		var out []string
+		for _, v := range vs {
+			out = append(out, p.value(v))
+		}
+		return n + " IN (" + strings.Join(out, ", ") + ")", nil
+	case BeginsWith, Contains, NotContains:
+		if err := want(1); err != nil {
+			return "", err
+		}
+		f := "begins_with"
+		switch op {
+		case Contains:
+			f = "contains"
+		case NotContains:
+			f = "NOT contains"
+		}
+		return f + "(" + n + ", " + p.value(vs[0]) + ")", nil
+	case Null:
+		return "attribute_not_exists(" + n + ")", want(0)
+	case NotNull:
+		return "attribute_exists(" + n + ")", want(0)
+	default:
+		return "", fmt.Errorf("unknown operator %q", op)
+	}
+}
+
+// a key condition expression like "#n0 = :v0 AND #n1 BETWEEN :v1 AND :v2", in the
+// order of the attributes' names
+func keyConditionExpression(conds map[string]Condition, p *placeholders) (string, error) {
+	var names []string
+	for name := range conds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []string
+	for _, name := range names {
+		switch op := conds[name].Operator; op {
+		case EQ, LT, LE, GT, GE, BeginsWith, Between:
+		default:
+			return "", fmt.Errorf("%s can't be used in a key condition", op)
+		}
+		s, err := If(name, conds[name]).build(p)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, " AND "), nil
+}
+
+// an update expression like "SET #n0 = :v0 REMOVE #n1", in the order of the attributes' names
+func updateExpression(updates map[string]Update, p *placeholders) (string, error) {
+	var names []string
+	for name := range updates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clauses := make(map[string][]string)
+	for _, name := range names {
+		u := updates[name]
+		switch {
+		case u.Action == "" || u.Action == Put:
+			clauses["SET"] = append(clauses["SET"], p.name(name)+" = "+p.value(u.Value))
+		case u.Action == Add:
+			clauses["ADD"] = append(clauses["ADD"], p.name(name)+" "+p.value(u.Value))
+		case u.Action == Delete && u.Value.Type == 0:
+			clauses["REMOVE"] = append(clauses["REMOVE"], p.name(name))
+		case u.Action == Delete:
+			clauses["DELETE"] = append(clauses["DELETE"], p.name(name)+" "+p.value(u.Value))
+		default:
+			return "", fmt.Errorf("unknown action %q", u.Action)
+		}
+	}
+	var out []string
+	for _, c := range []string{"SET", "REMOVE", "ADD", "DELETE"} {
+		if len(clauses[c]) > 0 {
+			out = append(out, c+" "+strings.Join(clauses[c], ", "))
+		}
+	}
+	return strings.Join(out, " "), nil
+}
@@ -0,0 +1,195 @@
+package ddb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// an item's primary key: its hash key attribute and, for tables with one, its range key
+type Key map[string]Value
+
+// which attributes a write returns, as they were before or after it
+type ReturnValues string
+
+const (
+	ReturnNone       ReturnValues = "NONE"
+	ReturnAllOld     ReturnValues = "ALL_OLD"
+	ReturnUpdatedOld ReturnValues = "UPDATED_OLD" // UpdateItem only
+	ReturnAllNew     ReturnValues = "ALL_NEW"     // UpdateItem only
+	ReturnUpdatedNew ReturnValues = "UPDATED_NEW" // UpdateItem only
+)
+
+// what an update does to an attribute
+type Action string
+
+const (
+	Put    Action = "PUT"
+	Add    Action = "ADD"    // adds to a number or set, treating a missing one as zero or empty
+	Delete Action = "DELETE" // removes the attribute, or with a set value, those elements
+)
+
+type Update struct {
+	Action Action
+	Value  Value // not needed to delete
+}
+
+type GetItemRequest struct {
+	Key             Key
+	ConsistentRead  bool
+	AttributesToGet []string // empty means all
+}
+
+// writes, like those of UpdateItemRequest and DeleteItemRequest, fail with a
+// *ConditionalCheckFailedError unless their If expressions, if any, hold for the item as it was
+type PutItemRequest struct {
+	Item         map[string]Value
+	If           Expression
+	ReturnValues ReturnValues // NONE or ALL_OLD
+}
+
+type UpdateItemRequest struct {
+	Key          Key
+	Updates      map[string]Update
+	If           Expression
+	ReturnValues ReturnValues
+}
+
+type DeleteItemRequest struct {
+	Key          Key
+	If           Expression
+	ReturnValues ReturnValues // NONE or ALL_OLD
+}
+
+type getItemInput struct {
+	TableName       string
+	Key             Key
+	ConsistentRead  bool     `json:",omitempty"`
+	AttributesToGet []string `json:",omitempty"`
+}
+
+type writeInput struct {
+	TableName                 string
+	Key                       Key               `json:",omitempty"`
+	Item                      map[string]Value  `json:",omitempty"`
+	UpdateExpression          string            `json:",omitempty"`
+	ConditionExpression       string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues map[string]Value  `json:",omitempty"`
+	ReturnValues              ReturnValues      `json:",omitempty"`
+}
+
+type writeOutput struct {
+	Attributes map[string]Value
+}
+
+// an item, whether it was found, and any error
+func (d DynamoDB) Get(r GetItemRequest) (map[string]Value, bool, error) {
+	if len(r.Key) == 0 {
+		return nil, false, errors.New("no key")
+	}
+	var out struct {
+		Item map[string]Value
+	}
+	if err := d.do("GetItem", getItemInput{TableName: d.Table, Key: r.Key, ConsistentRead: r.ConsistentRead, AttributesToGet: r.AttributesToGet}, &out); err != nil {
+		return nil, false, err
+	}
+	if out.Item == nil {
+		return nil, false, nil
+	}
+	return out.Item, true, nil
+}
+
+// writes an item, replacing any with the same key, returning the attributes asked for by r.ReturnValues
+func (d DynamoDB) Put(r PutItemRequest) (map[string]Value, error) {
+	if len(r.Item) == 0 {
+		return nil, errors.New("no item")
+	}
+	return d.write("PutItem", writeInput{TableName: d.Table, Item: r.Item, ReturnValues: r.ReturnValues}, r.If, nil)
+}
+
+// changes an item's attributes, creating it if need be, returning the attributes asked for by r.ReturnValues
+func (d DynamoDB) Update(r UpdateItemRequest) (map[string]Value, error) {
+	if len(r.Key) == 0 {
+		return nil, errors.New("no key")
+	}
+	if len(r.Updates) == 0 {
+		return nil, errors.New("no updates")
+	}
+	return d.write("UpdateItem", writeInput{TableName: d.Table, Key: r.Key, ReturnValues: r.ReturnValues}, r.If, r.Updates)
+}
+
+// deletes an item, if it exists, returning the attributes asked for by r.ReturnValues
+func (d DynamoDB) Delete(r DeleteItemRequest) (map[string]Value, error) {
+	if len(r.Key) == 0 {
+		return nil, errors.New("no key")
+	}
+	return d.write("DeleteItem", writeInput{TableName: d.Table, Key: r.Key, ReturnValues: r.ReturnValues}, r.If, nil)
+}
+
+func (d DynamoDB) write(op string, in writeInput, cond Expression, updates map[string]Update) (map[string]Value, error) {
+	var p placeholders
+	var err error
+	if len(updates) > 0 {
+		if in.UpdateExpression, err = updateExpression(updates, &p); err != nil {
+			return nil, err
+		}
+	}
+	if !cond.IsZero() {
+		if in.ConditionExpression, err = cond.build(&p); err != nil {
+			return nil, err
+		}
+	}
+	in.ExpressionAttributeNames, in.ExpressionAttributeValues = p.names, p.values
+	var out writeOutput
+	if err := d.do(op, in, &out); err != nil {
+		return nil, err
+	}
+	return out.Attributes, nil
+}
+
+// reads an item, lets f change it, and puts it back with its version attribute incremented,
+// on condition that the version hasn't changed meanwhile; a missing item is given to f as
+// just its key, and is written with version 1. conflicting writes are retried from the
+// read, as d.Strat allows. f may be called more than once, and its errors are returned as is;
+// it mustn't change the key attributes.
+func (d DynamoDB) ReadModifyWrite(key Key, version string, f func(item map[string]Value) error) (map[string]Value, error) {
+	bs := d.Strat.NewInstance()
+	for {
+		item, ok, err := d.Get(GetItemRequest{Key: key, ConsistentRead: true})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			item = make(map[string]Value)
+			for k, v := range key {
+				item[k] = v
+			}
+		}
+		old, ok := item[version]
+		cond := NotExists(version)
+		var n int64
+		if ok {
+			if n, err = old.Int(); err != nil {
+				return nil, fmt.Errorf("bad version %v: %v", old, err)
+			}
+			cond = If(version, Cond(EQ, old))
+		}
+		if err := f(item); err != nil {
+			return nil, err
+		}
+		for k, v := range key {
+			if w, ok := item[k]; !ok || !reflect.DeepEqual(v, w) {
+				return nil, fmt.Errorf("key attribute %q changed", k)
+			}
+		}
+		item[version] = IV(n + 1)
+		_, err = d.Put(PutItemRequest{Item: item, If: cond})
+		if err == nil {
+			return item, nil
+		}
+		if !IsConditionalCheckFailed(err) || !bs.Retry() {
+			return nil, err
+		}
+	}
+}
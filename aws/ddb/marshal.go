@@ -0,0 +1,582 @@
+package ddb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type field struct {
+	name      string
+	index     []int
+	tagged    bool // named by its tag
+	omitEmpty bool
+	set       bool
+	role      string // "hash", "range" or empty
+}
+
+// fields by struct type
+var fieldCache sync.Map
+
+// a struct's attributes, with those of embedded structs, or pointers to them, promoted as
+// encoding/json does: of fields with the same name, the shallowest wins, or the tagged one
+// of those, and if that's still ambiguous, none do.
+func fields(t reflect.Type) []field {
+	if fs, ok := fieldCache.Load(t); ok {
+		return fs.([]field)
+	}
+	var all []field
+	collectFields(t, nil, map[reflect.Type]bool{t: true}, &all)
+	sort.SliceStable(all, func(i, j int) bool {
+		x, y := all[i], all[j]
+		if x.name != y.name {
+			return x.name < y.name
+		}
+		if len(x.index) != len(y.index) {
+			return len(x.index) < len(y.index)
+		}
+		return x.tagged && !y.tagged
+	})
+	var fs []field
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].name == all[i].name {
+			j++
+		}
+		// the first is dominant unless the next is as deep and as tagged
+		if j == i+1 || len(all[i+1].index) > len(all[i].index) || (all[i].tagged && !all[i+1].tagged) {
+			fs = append(fs, all[i])
+		}
+		i = j
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		x, y := fs[i].index, fs[j].index
+		for k := 0; k < len(x) && k < len(y); k++ {
+			if x[k] != y[k] {
+				return x[k] < y[k]
+			}
+		}
+		return len(x) < len(y)
+	})
+	fieldCache.Store(t, fs)
+	return fs
+}
+
+// appends the fields of t, a struct at index within the outermost one, skipping
+// embedded types already on the path, so recursive ones end
+func collectFields(t reflect.Type, index []int, path map[reflect.Type]bool, out *[]field) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("ddb")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		fi := append(append([]int{}, index...), i)
+		if sf.Anonymous {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if parts[0] == "" && ft.Kind() == reflect.Struct {
+				if !path[ft] {
+					path[ft] = true
+					collectFields(ft, fi, path, out)
+					delete(path, ft)
+				}
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		f := field{name: parts[0], index: fi, tagged: parts[0] != ""}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		for _, o := range parts[1:] {
+			switch o {
+			case "omitempty":
+				f.omitEmpty = true
+			case "set":
+				f.set = true
+			case "hash", "range":
+				f.role = o
+			}
+		}
+		*out = append(*out, f)
+	}
+}
+
+// the field of a struct at index, or false if it's in an embedded struct whose pointer is nil
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+// the field of a struct at index, allocating nil pointers to embedded structs on the way
+func settableField(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, fmt.Errorf("can't set embedded pointer to unexported struct %v", rv.Type().Elem())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
+
+// the struct v points to, or is
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return rv, fmt.Errorf("%T is not a struct or pointer to one", v)
+	}
+	return rv, nil
+}
+
+// the item for a struct or pointer to one. Marshal and Unmarshal convert between structs
+// and items: exported fields are attributes named as in their "ddb" tags, or else as the
+// fields are, with comma-separated options:
+//
+//	type Event struct {
+//		User   string    `ddb:"user,hash"`  // the table's hash key
+//		Time   time.Time `ddb:"time,range"` // and range key
+//		Tags   []string  `ddb:",set"`       // a string set, rather than a list
+//		Note   string    `ddb:",omitempty"` // omitted if empty
+//		Secret string    `ddb:"-"`          // not an attribute
+//	}
+//
+// strings are S, numbers are N, []byte is B, bool is BOOL, time.Time is S in RFC 3339
+// form, slices and arrays are L (or SS, NS or BS with the "set" option, in which case
+// they're omitted when empty), maps with string keys and structs are M, nil pointers,
+// slices, maps and interfaces are NULL, and Values are themselves. fields of embedded
+// structs, or of non-nil pointers to them, are treated as the outer struct's, as with
+// encoding/json.
+func Marshal(v interface{}) (map[string]Value, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return marshalStruct(rv)
+}
+
+func marshalStruct(rv reflect.Value) (map[string]Value, error) {
+	item := make(map[string]Value)
+	for _, f := range fields(rv.Type()) {
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok {
+			continue
+		}
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		if k := fv.Kind(); f.set && (k == reflect.Slice || k == reflect.Array) && fv.Len() == 0 {
+			continue // there are no empty sets
+		}
+		var av Value
+		var err error
+		if f.set {
+			av, err = marshalSet(fv)
+		} else {
+			av, err = marshalValue(fv)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		item[f.name] = av
+	}
+	return item, nil
+}
+
+var (
+	valueType = reflect.TypeOf(Value{})
+	timeType  = reflect.TypeOf(time.Time{})
+	bytesType = reflect.TypeOf([]byte(nil))
+)
+
+func marshalValue(rv reflect.Value) (Value, error) {
+	switch rv.Type() {
+	case valueType:
+		return rv.Interface().(Value), nil
+	case timeType:
+		return SV(rv.Interface().(time.Time).Format(time.RFC3339Nano)), nil
+	}
+	switch rv.Kind() {
+	case reflect.String:
+		return SV(rv.String()), nil
+	case reflect.Bool:
+		return BoolV(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IV(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return DV(strconv.FormatUint(rv.Uint(), 10)), nil
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return Value{}, fmt.Errorf("unsupported number %v", f)
+		}
+		return DV(formatFloat(rv.Float(), rv.Type().Bits())), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return NullV(), nil
+		}
+		return marshalValue(rv.Elem())
+	case reflect.Slice:
+		if rv.IsNil() {
+			return NullV(), nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return BV(rv.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		l := make([]Value, rv.Len())
+		for i := range l {
+			v, err := marshalValue(rv.Index(i))
+			if err != nil {
+				return Value{}, err
+			}
+			l[i] = v
+		}
+		return LV(l...), nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return Value{}, fmt.Errorf("unsupported map key type %v", rv.Type().Key())
+		}
+		if rv.IsNil() {
+			return NullV(), nil
+		}
+		m := make(map[string]Value)
+		for _, k := range rv.MapKeys() {
+			v, err := marshalValue(rv.MapIndex(k))
+			if err != nil {
+				return Value{}, err
+			}
+			m[k.String()] = v
+		}
+		return MV(m), nil
+	case reflect.Struct:
+		m, err := marshalStruct(rv)
+		if err != nil {
+			return Value{}, err
+		}
+		return MV(m), nil
+	}
+	return Value{}, fmt.Errorf("unsupported type %v", rv.Type())
+}
+
+// a slice or array of strings, numbers or []byte as a set
+func marshalSet(rv reflect.Value) (Value, error) {
+	if k := rv.Kind(); k != reflect.Slice && k != reflect.Array {
+		return Value{}, fmt.Errorf("set of %v", rv.Type())
+	}
+	var out Value
+	for i := 0; i < rv.Len(); i++ {
+		v, err := marshalValue(rv.Index(i))
+		if err != nil {
+			return Value{}, err
+		}
+		switch v.Type {
+		case S:
+			out.Type, out.SS = SS, append(out.SS, v.S)
+		case N:
+			out.Type, out.NS = NS, append(out.NS, v.N)
+		case B:
+			out.Type, out.BS = BS, append(out.BS, v.B)
+		default:
+			return Value{}, fmt.Errorf("set of %v", rv.Type())
+		}
+	}
+	return out, nil
+}
+
+// sets the fields of the struct v points to from an item. attributes without fields are
+// ignored, as are fields without attributes.
+func Unmarshal(item map[string]Value, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%T is not a pointer to a struct", v)
+	}
+	return unmarshalStruct(item, rv.Elem())
+}
+
+func unmarshalStruct(item map[string]Value, rv reflect.Value) error {
+	for _, f := range fields(rv.Type()) {
+		av, ok := item[f.name]
+		if !ok {
+			continue
+		}
+		fv, err := settableField(rv, f.index)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+		if err := unmarshalValue(av, fv); err != nil {
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+func unmarshalValue(av Value, rv reflect.Value) error {
+	switch {
+	case rv.Type() == valueType:
+		rv.Set(reflect.ValueOf(av))
+		return nil
+	case av.Type == NULL:
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("can't store %v in %v", av.Type, rv.Type())
+	}
+	switch rv.Type() {
+	case timeType:
+		if av.Type != S {
+			return mismatch()
+		}
+		t, err := time.Parse(time.RFC3339Nano, av.S)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(rv.Type().Elem())
+		if err := unmarshalValue(av, p.Elem()); err != nil {
+			return err
+		}
+		rv.Set(p)
+		return nil
+	case reflect.Interface:
+		if rv.NumMethod() > 0 {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(interfaceValue(av)))
+		return nil
+	case reflect.String:
+		if av.Type != S {
+			return mismatch()
+		}
+		rv.SetString(av.S)
+		return nil
+	case reflect.Bool:
+		if av.Type != BOOL {
+			return mismatch()
+		}
+		rv.SetBool(av.BOOL)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return setNumber(av, rv, func(n string) error {
+			i, err := strconv.ParseInt(n, 10, rv.Type().Bits())
+			rv.SetInt(i)
+			return err
+		})
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return setNumber(av, rv, func(n string) error {
+			i, err := strconv.ParseUint(n, 10, rv.Type().Bits())
+			rv.SetUint(i)
+			return err
+		})
+	case reflect.Float32, reflect.Float64:
+		return setNumber(av, rv, func(n string) error {
+			f, err := strconv.ParseFloat(n, rv.Type().Bits())
+			rv.SetFloat(f)
+			return err
+		})
+	case reflect.Slice, reflect.Array:
+		if rv.Type() == bytesType || (rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 && av.Type == B) {
+			if av.Type != B {
+				return mismatch()
+			}
+			rv.SetBytes(append([]byte(nil), av.B...))
+			return nil
+		}
+		elems := elements(av)
+		if elems == nil {
+			return mismatch()
+		}
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), len(elems), len(elems)))
+		} else if len(elems) > rv.Len() {
+			return fmt.Errorf("%d elements for %v", len(elems), rv.Type())
+		}
+		for i, e := range elems {
+			if err := unmarshalValue(e, rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if av.Type != M || rv.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), len(av.M))
+		for k, e := range av.M {
+			x := reflect.New(rv.Type().Elem()).Elem()
+			if err := unmarshalValue(e, x); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()), x)
+		}
+		rv.Set(m)
+		return nil
+	case reflect.Struct:
+		if av.Type != M {
+			return mismatch()
+		}
+		return unmarshalStruct(av.M, rv)
+	}
+	return mismatch()
+}
+
+func setNumber(av Value, rv reflect.Value, set func(n string) error) error {
+	if av.Type != N {
+		return fmt.Errorf("can't store %v in %v", av.Type, rv.Type())
+	}
+	return set(av.N)
+}
+
+// the elements of a list or set, as values, or nil for other types
+func elements(av Value) []Value {
+	out := []Value{}
+	switch av.Type {
+	case L:
+		return av.L
+	case SS:
+		for _, s := range av.SS {
+			out = append(out, SV(s))
+		}
+	case NS:
+		for _, n := range av.NS {
+			out = append(out, DV(n))
+		}
+	case BS:
+		for _, b := range av.BS {
+			out = append(out, BV(b))
+		}
+	default:
+		return nil
+	}
+	return out
+}
+
+// a value for an empty interface: string, float64 (or the decimal string, if a float64
+// can't hold it exactly), []byte, bool, nil, []interface{} or map[string]interface{}
+func interfaceValue(av Value) interface{} {
+	switch av.Type {
+	case S:
+		return av.S
+	case N:
+		f, err := strconv.ParseFloat(av.N, 64)
+		if err != nil || formatFloat(f, 64) != av.N {
+			return av.N
+		}
+		return f
+	case B:
+		return av.B
+	case BOOL:
+		return av.BOOL
+	case M:
+		m := make(map[string]interface{})
+		for k, e := range av.M {
+			m[k] = interfaceValue(e)
+		}
+		return m
+	}
+	if elems := elements(av); elems != nil {
+		out := make([]interface{}, len(elems))
+		for i, e := range elems {
+			out[i] = interfaceValue(e)
+		}
+		return out
+	}
+	return nil
+}
+
+// the key of a struct or pointer to one, from its one field tagged "hash" and at most
+// one tagged "range"
+func KeyOf(v interface{}) (Key, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, err
+	}
+	k := make(Key)
+	roles := make(map[string]int)
+	for _, f := range fields(rv.Type()) {
+		if f.role == "" {
+			continue
+		}
+		if roles[f.role]++; roles[f.role] > 1 {
+			return nil, fmt.Errorf("%T has more than one field tagged %s", v, f.role)
+		}
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok {
+			return nil, fmt.Errorf("%s: in a nil embedded struct", f.name)
+		}
+		av, err := marshalValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		switch av.Type {
+		case S, N, B:
+		default:
+			return nil, fmt.Errorf("%s: key of type %v", f.name, av.Type)
+		}
+		k[f.name] = av
+	}
+	if roles["hash"] == 0 {
+		return nil, fmt.Errorf("%T has no field tagged hash", v)
+	}
+	return k, nil
+}
+
+// puts a struct or pointer to one as an item
+func (d DynamoDB) PutStruct(v interface{}) error {
+	item, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = d.Put(PutItemRequest{Item: item})
+	return err
+}
+
+// reads the item whose key is in the hash and range fields of the struct v points to,
+// into the struct, returning whether it was found. reads are consistent.
+func (d DynamoDB) GetStruct(v interface{}) (bool, error) {
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr {
+		return false, errors.New("GetStruct needs a pointer")
+	}
+	k, err := KeyOf(v)
+	if err != nil {
+		return false, err
+	}
+	item, ok, err := d.Get(GetItemRequest{Key: k, ConsistentRead: true})
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, Unmarshal(item, v)
+}
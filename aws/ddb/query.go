@@ -0,0 +1,289 @@
+package ddb
+
+import (
+	"strings"
+	"sync"
+)
+
+// how a Condition compares an attribute with its values
+type Operator string
+
+const (
+	EQ          Operator = "EQ"
+	NE          Operator = "NE"
+	LT          Operator = "LT"
+	LE          Operator = "LE"
+	GT          Operator = "GT"
+	GE          Operator = "GE"
+	BeginsWith  Operator = "BEGINS_WITH"
+	Between     Operator = "BETWEEN" // inclusive, with two values
+	In          Operator = "IN"
+	Null        Operator = "NULL" // the attribute doesn't exist; no values
+	NotNull     Operator = "NOT_NULL"
+	Contains    Operator = "CONTAINS"
+	NotContains Operator = "NOT_CONTAINS"
+)
+
+// a comparison of an attribute, for key conditions and expressions. key conditions may
+// only use EQ, LT, LE, GT, GE, BEGINS_WITH and BETWEEN.
+type Condition struct {
+	Operator Operator `json:"ComparisonOperator"`
+	Values   []Value  `json:"AttributeValueList,omitempty"`
+}
+
+func Cond(op Operator, values ...Value) Condition {
+	return Condition{Operator: op, Values: values}
+}
+
+type QueryRequest struct {
+	IndexName string // empty means the table itself
+
+	// an EQ condition on the hash key, and optionally one on the range key
+	KeyConditions map[string]Condition
+
+	// a condition on other attributes, applied after reading, so filtered items
+	// still consume capacity
+	Filter Expression
+
+	Reverse         bool // descending order of range key
+	Limit           int  // the most items to return in all, zero meaning no limit
+	ConsistentRead  bool
+	AttributesToGet []string
+	StartKey        Key // resumes after this key, e.g. a previous LastEvaluatedKey
+}
+
+type ScanRequest struct {
+	IndexName       string
+	Filter          Expression
+	Limit           int // the most items to return in all, zero meaning no limit
+	ConsistentRead  bool
+	AttributesToGet []string
+	StartKey        Key
+
+	// for one part of a parallel scan, segment 0 <= Segment < TotalSegments;
+	// see Segments
+	Segment, TotalSegments int
+}
+
+// units of read or write capacity consumed by a request
+type ConsumedCapacity struct {
+	TableName     string
+	CapacityUnits float64
+}
+
+type pageInput struct {
+	TableName                 string
+	IndexName                 string            `json:",omitempty"`
+	KeyConditionExpression    string            `json:",omitempty"`
+	FilterExpression          string            `json:",omitempty"`
+	ProjectionExpression      string            `json:",omitempty"`
+	ExpressionAttributeNames  map[string]string `json:",omitempty"`
+	ExpressionAttributeValues map[string]Value  `json:",omitempty"`
+	ScanIndexForward          *bool             `json:",omitempty"`
+	Limit                     int               `json:",omitempty"`
+	ConsistentRead            bool              `json:",omitempty"`
+	ExclusiveStartKey         Key               `json:",omitempty"`
+	Segment                   *int              `json:",omitempty"`
+	TotalSegments             int               `json:",omitempty"`
+	ReturnConsumedCapacity    string
+}
+
+// sets the key condition, filter and projection expressions, and their placeholders
+func (in *pageInput) expressions(keys map[string]Condition, filter Expression, names []string) error {
+	var p placeholders
+	var err error
+	if len(keys) > 0 {
+		if in.KeyConditionExpression, err = keyConditionExpression(keys, &p); err != nil {
+			return err
+		}
+	}
+	if !filter.IsZero() {
+		if in.FilterExpression, err = filter.build(&p); err != nil {
+			return err
+		}
+	}
+	var projection []string
+	for _, n := range names {
+		projection = append(projection, p.name(n))
+	}
+	in.ProjectionExpression = strings.Join(projection, ", ")
+	in.ExpressionAttributeNames, in.ExpressionAttributeValues = p.names, p.values
+	return nil
+}
+
+type pageOutput struct {
+	Items            []map[string]Value
+	Count            int
+	ScannedCount     int
+	LastEvaluatedKey Key
+	ConsumedCapacity *ConsumedCapacity
+}
+
+// reads the items matching a query, a page at a time
+func (d DynamoDB) Query(r QueryRequest) *Iterator {
+	forward := !r.Reverse
+	in := pageInput{
+		TableName:              d.Table,
+		IndexName:              r.IndexName,
+		ScanIndexForward:       &forward,
+		ConsistentRead:         r.ConsistentRead,
+		ExclusiveStartKey:      r.StartKey,
+		ReturnConsumedCapacity: "TOTAL",
+	}
+	err := in.expressions(r.KeyConditions, r.Filter, r.AttributesToGet)
+	return &Iterator{d: d, op: "Query", limit: r.Limit, in: in, err: err}
+}
+
+// reads every item in the table or index, or in one segment of it, a page at a time
+func (d DynamoDB) Scan(r ScanRequest) *Iterator {
+	in := pageInput{
+		TableName:              d.Table,
+		IndexName:              r.IndexName,
+		ConsistentRead:         r.ConsistentRead,
+		ExclusiveStartKey:      r.StartKey,
+		ReturnConsumedCapacity: "TOTAL",
+	}
+	if r.TotalSegments > 0 {
+		segment := r.Segment
+		in.Segment, in.TotalSegments = &segment, r.TotalSegments
+	}
+	err := in.expressions(nil, r.Filter, r.AttributesToGet)
+	return &Iterator{d: d, op: "Scan", limit: r.Limit, in: in, err: err}
+}
+
+// iterators for each of n segments of a scan, which may be read concurrently
+func (d DynamoDB) Segments(r ScanRequest, n int) []*Iterator {
+	var out []*Iterator
+	for i := 0; i < n; i++ {
+		r.Segment, r.TotalSegments = i, n
+		out = append(out, d.Scan(r))
+	}
+	return out
+}
+
+// scans n segments concurrently, calling f, from as many goroutines, for each item.
+// stops at the first error, from f or a scan.
+func (d DynamoDB) ParallelScan(r ScanRequest, n int, f func(item map[string]Value) error) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	done := make(chan struct{})
+	for _, it := range d.Segments(r, n) {
+		wg.Add(1)
+		go func(it *Iterator) {
+			defer wg.Done()
+			for it.Next() {
+				if err := f(it.Item()); err != nil {
+					errs <- err
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+			if err := it.Err(); err != nil {
+				errs <- err
+			}
+		}(it)
+	}
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+	err := <-errs
+	close(done)
+	for range errs {
+	}
+	return err
+}
+
+// streams the items of a query or scan, following LastEvaluatedKey from page to
+// page, like bufio.Scanner:
+//
+//	it := d.Query(ddb.QueryRequest{KeyConditions: ...})
+//	for it.Next() {
+//		item := it.Item()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator struct {
+	d        DynamoDB
+	op       string
+	in       pageInput
+	limit    int
+	items    []map[string]Value
+	current  map[string]Value
+	returned int
+	started  bool
+	more     bool
+	err      error
+	scanned  int
+	capacity float64
+}
+
+// advances to the next item, returning false when done or on error
+func (it *Iterator) Next() bool {
+	for len(it.items) == 0 {
+		if it.err != nil || (it.started && !it.more) || it.full() {
+			return false
+		}
+		it.fetch()
+	}
+	it.current = it.items[0]
+	it.items = it.items[1:]
+	it.returned++
+	return true
+}
+
+func (it *Iterator) full() bool {
+	return it.limit > 0 && it.returned >= it.limit
+}
+
+func (it *Iterator) fetch() {
+	if it.limit > 0 {
+		it.in.Limit = it.limit - it.returned
+	}
+	var out pageOutput
+	err := it.d.do(it.op, it.in, &out)
+	it.started = true
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.items = out.Items
+	if it.limit > 0 && len(it.items) > it.limit-it.returned {
+		it.items = it.items[:it.limit-it.returned]
+	}
+	it.scanned += out.ScannedCount
+	if out.ConsumedCapacity != nil {
+		it.capacity += out.ConsumedCapacity.CapacityUnits
+	}
+	it.more = len(out.LastEvaluatedKey) > 0
+	it.in.ExclusiveStartKey = out.LastEvaluatedKey
+}
+
+// the current item
+func (it *Iterator) Item() map[string]Value {
+	return it.current
+}
+
+// the key to resume from, as a request's StartKey, after the last page read; nil once
+// the query or scan is complete
+func (it *Iterator) LastEvaluatedKey() Key {
+	return it.in.ExclusiveStartKey
+}
+
+// the read capacity units consumed so far
+func (it *Iterator) ConsumedCapacity() float64 {
+	return it.capacity
+}
+
+// how many items have been read so far, before filtering
+func (it *Iterator) ScannedCount() int {
+	return it.scanned
+}
+
+// the first error encountered, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
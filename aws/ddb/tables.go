@@ -0,0 +1,456 @@
+package ddb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/xoba/goutil"
+)
+
+type TableStatus string
+
+const (
+	Creating TableStatus = "CREATING"
+	Updating TableStatus = "UPDATING"
+	Deleting TableStatus = "DELETING"
+	Active   TableStatus = "ACTIVE"
+)
+
+// how a table's reads and writes are paid for
+type BillingMode string
+
+const (
+	Provisioned   BillingMode = "PROVISIONED"
+	PayPerRequest BillingMode = "PAY_PER_REQUEST" // on-demand
+)
+
+// which attributes an index holds besides the keys
+type ProjectionType string
+
+const (
+	ProjectAll      ProjectionType = "ALL"
+	ProjectKeysOnly ProjectionType = "KEYS_ONLY"
+	ProjectInclude  ProjectionType = "INCLUDE" // the keys and NonKeyAttributes
+)
+
+const (
+	DefaultWaitInterval = 5 * time.Second
+	DefaultWaitTimeout  = 10 * time.Minute
+)
+
+// a key attribute, whose type must be S, N or B
+type KeyAttribute struct {
+	Name string
+	Type ValueType
+}
+
+// a table's or an index's key: a hash attribute, and perhaps a range attribute
+type KeySchema struct {
+	Hash  KeyAttribute
+	Range KeyAttribute // zero if none
+}
+
+// provisioned capacity units per second
+type Throughput struct {
+	Read  int64 `json:"ReadCapacityUnits"`
+	Write int64 `json:"WriteCapacityUnits"`
+}
+
+type Projection struct {
+	Type             ProjectionType `json:"ProjectionType"`
+	NonKeyAttributes []string       `json:",omitempty"`
+}
+
+type GlobalIndex struct {
+	Name       string
+	Key        KeySchema
+	Projection Projection  // zero means ProjectAll
+	Throughput *Throughput // required for provisioned tables
+}
+
+// a local index shares its table's hash key
+type LocalIndex struct {
+	Name       string
+	Range      KeyAttribute
+	Projection Projection // zero means ProjectAll
+}
+
+type CreateTableRequest struct {
+	Key KeySchema
+
+	// empty means Provisioned if Throughput is set, and PayPerRequest if not
+	Billing    BillingMode
+	Throughput *Throughput
+
+	GlobalIndexes []GlobalIndex
+	LocalIndexes  []LocalIndex
+}
+
+// changes to make to a table; zero fields are left alone
+type UpdateTableRequest struct {
+	Billing       BillingMode
+	Throughput    *Throughput
+	CreateIndexes []GlobalIndex
+	DeleteIndexes []string // names of global indexes
+}
+
+type KeySchemaElement struct {
+	AttributeName string
+	KeyType       string // "HASH" or "RANGE"
+}
+
+type AttributeDefinition struct {
+	AttributeName string
+	AttributeType string // "S", "N" or "B"
+}
+
+// a table as dynamodb describes it
+type TableDescription struct {
+	TableName            string
+	TableArn             string
+	TableStatus          TableStatus
+	KeySchema            []KeySchemaElement
+	AttributeDefinitions []AttributeDefinition
+	BillingModeSummary   *struct {
+		BillingMode BillingMode
+	}
+	ProvisionedThroughput  *Throughput
+	GlobalSecondaryIndexes []IndexDescription
+	LocalSecondaryIndexes  []IndexDescription
+	ItemCount              int64
+	TableSizeBytes         int64
+	CreationDateTime       float64 // seconds since the epoch
+}
+
+type IndexDescription struct {
+	IndexName             string
+	IndexStatus           TableStatus // global indexes only
+	KeySchema             []KeySchemaElement
+	Projection            Projection
+	ProvisionedThroughput *Throughput
+	ItemCount             int64
+}
+
+// the table's key, with types as given by its attribute definitions
+func (t *TableDescription) Key() KeySchema {
+	var k KeySchema
+	for _, e := range t.KeySchema {
+		a := KeyAttribute{Name: e.AttributeName}
+		for _, def := range t.AttributeDefinitions {
+			if def.AttributeName == e.AttributeName {
+				a.Type = scalarTypes[def.AttributeType]
+			}
+		}
+		switch e.KeyType {
+		case "HASH":
+			k.Hash = a
+		case "RANGE":
+			k.Range = a
+		}
+	}
+	return k
+}
+
+// tables made before on-demand billing have no summary, and are provisioned
+func (t *TableDescription) Billing() BillingMode {
+	if t.BillingModeSummary == nil || t.BillingModeSummary.BillingMode == "" {
+		return Provisioned
+	}
+	return t.BillingModeSummary.BillingMode
+}
+
+// whether the table and all its global indexes are active
+func (t *TableDescription) Active() bool {
+	if t.TableStatus != Active {
+		return false
+	}
+	for _, x := range t.GlobalSecondaryIndexes {
+		if x.IndexStatus != Active {
+			return false
+		}
+	}
+	return true
+}
+
+var scalarTypes = map[string]ValueType{"S": S, "N": N, "B": B}
+
+// the types of key attributes, for AttributeDefinitions
+type definitions map[string]ValueType
+
+func (defs definitions) add(a KeyAttribute) error {
+	switch a.Type {
+	case S, N, B:
+	default:
+		return fmt.Errorf("key attribute %q has type %v; must be S, N or B", a.Name, a.Type)
+	}
+	if t, ok := defs[a.Name]; ok && t != a.Type {
+		return fmt.Errorf("key attribute %q has types %v and %v", a.Name, t, a.Type)
+	}
+	defs[a.Name] = a.Type
+	return nil
+}
+
+func (defs definitions) list() []AttributeDefinition {
+	var out []AttributeDefinition
+	for name, t := range defs {
+		out = append(out, AttributeDefinition{AttributeName: name, AttributeType: t.String()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AttributeName < out[j].AttributeName })
+	return out
+}
+
+func (defs definitions) schema(k KeySchema) ([]KeySchemaElement, error) {
+	if k.Hash.Name == "" {
+		return nil, errors.New("no hash key")
+	}
+	if err := defs.add(k.Hash); err != nil {
+		return nil, err
+	}
+	out := []KeySchemaElement{{k.Hash.Name, "HASH"}}
+	if k.Range.Name != "" {
+		if err := defs.add(k.Range); err != nil {
+			return nil, err
+		}
+		out = append(out, KeySchemaElement{k.Range.Name, "RANGE"})
+	}
+	return out, nil
+}
+
+type indexInput struct {
+	IndexName             string
+	KeySchema             []KeySchemaElement
+	Projection            Projection
+	ProvisionedThroughput *Throughput `json:",omitempty"`
+}
+
+func (defs definitions) global(x GlobalIndex) (*indexInput, error) {
+	schema, err := defs.schema(x.Key)
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %v", x.Name, err)
+	}
+	return &indexInput{IndexName: x.Name, KeySchema: schema, Projection: x.Projection.orAll(), ProvisionedThroughput: x.Throughput}, nil
+}
+
+func (p Projection) orAll() Projection {
+	if p.Type == "" {
+		p.Type = ProjectAll
+	}
+	return p
+}
+
+type createTableInput struct {
+	TableName              string
+	KeySchema              []KeySchemaElement
+	AttributeDefinitions   []AttributeDefinition
+	BillingMode            BillingMode
+	ProvisionedThroughput  *Throughput  `json:",omitempty"`
+	GlobalSecondaryIndexes []indexInput `json:",omitempty"`
+	LocalSecondaryIndexes  []indexInput `json:",omitempty"`
+}
+
+type tableOutput struct {
+	Table            *TableDescription
+	TableDescription *TableDescription
+}
+
+// creates d.Table, returning while it's still being created; see WaitUntilActive
+func (d DynamoDB) CreateTable(r CreateTableRequest) (*TableDescription, error) {
+	defs := make(definitions)
+	schema, err := defs.schema(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	in := createTableInput{TableName: d.Table, KeySchema: schema, BillingMode: r.Billing, ProvisionedThroughput: r.Throughput}
+	if in.BillingMode == "" {
+		in.BillingMode = PayPerRequest
+		if r.Throughput != nil {
+			in.BillingMode = Provisioned
+		}
+	}
+	for _, x := range r.GlobalIndexes {
+		gsi, err := defs.global(x)
+		if err != nil {
+			return nil, err
+		}
+		in.GlobalSecondaryIndexes = append(in.GlobalSecondaryIndexes, *gsi)
+	}
+	for _, x := range r.LocalIndexes {
+		schema, err := defs.schema(KeySchema{Hash: r.Key.Hash, Range: x.Range})
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %v", x.Name, err)
+		}
+		in.LocalSecondaryIndexes = append(in.LocalSecondaryIndexes, indexInput{IndexName: x.Name, KeySchema: schema, Projection: x.Projection.orAll()})
+	}
+	in.AttributeDefinitions = defs.list()
+	var out tableOutput
+	if err := d.do("CreateTable", in, &out); err != nil {
+		return nil, err
+	}
+	d.forgetSchema()
+	return out.TableDescription, nil
+}
+
+func (d DynamoDB) DescribeTable() (*TableDescription, error) {
+	var out tableOutput
+	if err := d.do("DescribeTable", map[string]string{"TableName": d.Table}, &out); err != nil {
+		return nil, err
+	}
+	return out.Table, nil
+}
+
+type indexUpdate struct {
+	Create *indexInput `json:",omitempty"`
+	Delete *indexName  `json:",omitempty"`
+}
+
+type indexName struct {
+	IndexName string
+}
+
+type updateTableInput struct {
+	TableName                   string
+	AttributeDefinitions        []AttributeDefinition `json:",omitempty"`
+	BillingMode                 BillingMode           `json:",omitempty"`
+	ProvisionedThroughput       *Throughput           `json:",omitempty"`
+	GlobalSecondaryIndexUpdates []indexUpdate         `json:",omitempty"`
+}
+
+// changes a table's billing or throughput, or adds or removes global indexes.
+// dynamodb allows only one index to be created or deleted at a time.
+func (d DynamoDB) UpdateTable(r UpdateTableRequest) (*TableDescription, error) {
+	in := updateTableInput{TableName: d.Table, BillingMode: r.Billing, ProvisionedThroughput: r.Throughput}
+	defs := make(definitions)
+	for _, x := range r.CreateIndexes {
+		gsi, err := defs.global(x)
+		if err != nil {
+			return nil, err
+		}
+		in.GlobalSecondaryIndexUpdates = append(in.GlobalSecondaryIndexUpdates, indexUpdate{Create: gsi})
+	}
+	for _, name := range r.DeleteIndexes {
+		in.GlobalSecondaryIndexUpdates = append(in.GlobalSecondaryIndexUpdates, indexUpdate{Delete: &indexName{name}})
+	}
+	in.AttributeDefinitions = defs.list()
+	var out tableOutput
+	if err := d.do("UpdateTable", in, &out); err != nil {
+		return nil, err
+	}
+	return out.TableDescription, nil
+}
+
+// deletes d.Table and all its items, returning while it's still being deleted;
+// see WaitUntilDeleted
+func (d DynamoDB) DeleteTable() error {
+	d.forgetSchema()
+	return d.do("DeleteTable", map[string]string{"TableName": d.Table}, nil)
+}
+
+// names of all the tables in the region, in order
+func (d DynamoDB) ListTables() ([]string, error) {
+	var names []string
+	var start string
+	for {
+		in := struct {
+			ExclusiveStartTableName string `json:",omitempty"`
+		}{start}
+		var out struct {
+			TableNames             []string
+			LastEvaluatedTableName string
+		}
+		if err := d.do("ListTables", in, &out); err != nil {
+			return nil, err
+		}
+		names = append(names, out.TableNames...)
+		if out.LastEvaluatedTableName == "" {
+			return names, nil
+		}
+		start = out.LastEvaluatedTableName
+	}
+}
+
+// polls d.Table every interval or so until it and its global indexes are active, or
+// timeout passes, or d's context is done. zero durations mean DefaultWaitInterval and
+// DefaultWaitTimeout.
+func (d DynamoDB) WaitUntilActive(interval, timeout time.Duration) (*TableDescription, error) {
+	var t *TableDescription
+	err := d.wait(interval, timeout, func() (bool, error) {
+		var err error
+		t, err = d.DescribeTable()
+		if IsResourceNotFound(err) {
+			return false, nil
+		}
+		return err == nil && t.Active(), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for table %s to be active: %w", d.Table, err)
+	}
+	return t, nil
+}
+
+// polls like WaitUntilActive until d.Table no longer exists
+func (d DynamoDB) WaitUntilDeleted(interval, timeout time.Duration) error {
+	err := d.wait(interval, timeout, func() (bool, error) {
+		_, err := d.DescribeTable()
+		if IsResourceNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for table %s to be deleted: %w", d.Table, err)
+	}
+	return nil
+}
+
+func (d DynamoDB) wait(interval, timeout time.Duration, done func() (bool, error)) error {
+	if interval <= 0 {
+		interval = DefaultWaitInterval
+	}
+	if timeout <= 0 {
+		timeout = DefaultWaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		if !goutil.SleepRandContext(d.Context(), interval/2) {
+			return d.Context().Err()
+		}
+	}
+}
+
+type TimeToLiveDescription struct {
+	TimeToLiveStatus string // "ENABLING", "ENABLED", "DISABLING" or "DISABLED"
+	AttributeName    string
+}
+
+// enables or disables expiry of d.Table's items by attr, a number of seconds since the
+// epoch. dynamodb deletes expired items in the background, typically within days.
+func (d DynamoDB) UpdateTimeToLive(attr string, enabled bool) error {
+	type spec struct {
+		AttributeName string
+		Enabled       bool
+	}
+	in := struct {
+		TableName               string
+		TimeToLiveSpecification spec
+	}{d.Table, spec{attr, enabled}}
+	return d.do("UpdateTimeToLive", in, nil)
+}
+
+func (d DynamoDB) DescribeTimeToLive() (*TimeToLiveDescription, error) {
+	var out struct {
+		TimeToLiveDescription TimeToLiveDescription
+	}
+	if err := d.do("DescribeTimeToLive", map[string]string{"TableName": d.Table}, &out); err != nil {
+		return nil, err
+	}
+	return &out.TimeToLiveDescription, nil
+}
@@ -0,0 +1,284 @@
+package ddb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ValueType byte
+
+const (
+	_ = iota
+	S
+	N
+	B
+	SS
+	NS
+	BS
+	BOOL
+	NULL
+	L
+	M
+)
+
+var typeNames = []string{S: "S", N: "N", B: "B", SS: "SS", NS: "NS", BS: "BS", BOOL: "BOOL", NULL: "NULL", L: "L", M: "M"}
+
+func (t ValueType) String() string {
+	if int(t) < len(typeNames) && typeNames[t] != "" {
+		return typeNames[t]
+	}
+	return "ValueType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// an attribute value, of which only the field for its type is used. keys may be any of
+// the scalar types S, N and B. numbers are kept as their exact decimal strings, since
+// dynamodb's have up to 38 digits of precision.
+type Value struct {
+	Type ValueType
+	S    string
+	N    string
+	B    []byte
+	SS   []string
+	NS   []string
+	BS   [][]byte
+	BOOL bool
+	L    []Value
+	M    map[string]Value
+}
+
+// a float as a number's digits, in exponent form if it's large, as dynamodb allows
+// only 38 significant digits
+func formatFloat(f float64, bits int) string {
+	if math.Abs(f) >= 1e21 {
+		return strconv.FormatFloat(f, 'e', -1, bits)
+	}
+	return strconv.FormatFloat(f, 'f', -1, bits)
+}
+
+func SV(s string) Value {
+	return Value{Type: S, S: s}
+}
+func NV(n float64) Value {
+	return Value{Type: N, N: formatFloat(n, 64)}
+}
+func IV(n int64) Value {
+	return Value{Type: N, N: strconv.FormatInt(n, 10)}
+}
+
+// a number given as a decimal string, e.g. "12345678901234567890.5"
+func DV(n string) Value {
+	return Value{Type: N, N: n}
+}
+func BV(b []byte) Value {
+	return Value{Type: B, B: b}
+}
+func SSV(ss ...string) Value {
+	return Value{Type: SS, SS: ss}
+}
+func NSV(ns ...string) Value {
+	return Value{Type: NS, NS: ns}
+}
+func BSV(bs ...[]byte) Value {
+	return Value{Type: BS, BS: bs}
+}
+func BoolV(b bool) Value {
+	return Value{Type: BOOL, BOOL: b}
+}
+func NullV() Value {
+	return Value{Type: NULL}
+}
+func LV(l ...Value) Value {
+	return Value{Type: L, L: l}
+}
+func MV(m map[string]Value) Value {
+	return Value{Type: M, M: m}
+}
+
+// a number's value as a float64, which may be inexact
+func (v Value) Float() (float64, error) {
+	if v.Type != N {
+		return 0, fmt.Errorf("%v is not a number", v.Type)
+	}
+	return strconv.ParseFloat(v.N, 64)
+}
+
+// a number's value as an int64, if it's an integer that fits
+func (v Value) Int() (int64, error) {
+	if v.Type != N {
+		return 0, fmt.Errorf("%v is not a number", v.Type)
+	}
+	return strconv.ParseInt(v.N, 10, 64)
+}
+
+func (v Value) String() string {
+	switch v.Type {
+	case S:
+		return v.S
+	case N:
+		return v.N
+	case B:
+		return base64.StdEncoding.EncodeToString(v.B)
+	case SS:
+		return fmt.Sprint(v.SS)
+	case NS:
+		return fmt.Sprint(v.NS)
+	case BS:
+		var out []string
+		for _, b := range v.BS {
+			out = append(out, base64.StdEncoding.EncodeToString(b))
+		}
+		return fmt.Sprint(out)
+	case BOOL:
+		return strconv.FormatBool(v.BOOL)
+	case NULL:
+		return "null"
+	case L:
+		return fmt.Sprint(v.L)
+	case M:
+		var keys []string
+		for k := range v.M {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var out []string
+		for _, k := range keys {
+			out = append(out, k+":"+v.M[k].String())
+		}
+		return "map[" + strings.Join(out, " ") + "]"
+	default:
+		return "n/a"
+	}
+}
+
+// the wire form, e.g. {"S": "x"} or {"N": "1.5"}
+func (v Value) MarshalJSON() ([]byte, error) {
+	var x interface{}
+	switch v.Type {
+	case S:
+		x = v.S
+	case N:
+		if !validNumber(v.N) {
+			return nil, fmt.Errorf("illegal number %q", v.N)
+		}
+		x = v.N
+	case B:
+		x = nonNil(v.B)
+	case SS:
+		if len(v.SS) == 0 {
+			return nil, errors.New("empty SS")
+		}
+		x = v.SS
+	case NS:
+		if len(v.NS) == 0 {
+			return nil, errors.New("empty NS")
+		}
+		for _, n := range v.NS {
+			if !validNumber(n) {
+				return nil, fmt.Errorf("illegal number %q", n)
+			}
+		}
+		x = v.NS
+	case BS:
+		if len(v.BS) == 0 {
+			return nil, errors.New("empty BS")
+		}
+		x = v.BS
+	case BOOL:
+		x = v.BOOL
+	case NULL:
+		x = true
+	case L:
+		x = v.L
+		if v.L == nil {
+			x = []Value{}
+		}
+	case M:
+		x = v.M
+		if v.M == nil {
+			x = map[string]Value{}
+		}
+	default:
+		return nil, fmt.Errorf("illegal type %v", v.Type)
+	}
+	return json.Marshal(map[string]interface{}{v.Type.String(): x})
+}
+
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+func (v *Value) UnmarshalJSON(buf []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return err
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("bad attribute value: %s", buf)
+	}
+	*v = Value{}
+	for k, raw := range m {
+		var err error
+		switch k {
+		case "S":
+			v.Type, err = S, json.Unmarshal(raw, &v.S)
+		case "N":
+			v.Type, err = N, json.Unmarshal(raw, &v.N)
+		case "B":
+			v.Type, err = B, json.Unmarshal(raw, &v.B)
+		case "SS":
+			v.Type, err = SS, json.Unmarshal(raw, &v.SS)
+		case "NS":
+			v.Type, err = NS, json.Unmarshal(raw, &v.NS)
+		case "BS":
+			v.Type, err = BS, json.Unmarshal(raw, &v.BS)
+		case "BOOL":
+			v.Type, err = BOOL, json.Unmarshal(raw, &v.BOOL)
+		case "NULL":
+			v.Type = NULL
+		case "L":
+			v.Type, err = L, json.Unmarshal(raw, &v.L)
+		case "M":
+			v.Type, err = M, json.Unmarshal(raw, &v.M)
+		default:
+			return fmt.Errorf("unknown attribute type %q", k)
+		}
+		if err != nil {
+			return fmt.Errorf("bad %s attribute: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// whether n is a decimal string like "-1.5e10"
+func validNumber(n string) bool {
+	mantissa := n
+	if i := strings.IndexAny(n, "eE"); i >= 0 {
+		if _, err := strconv.Atoi(n[i+1:]); err != nil {
+			return false
+		}
+		mantissa = n[:i]
+	}
+	if strings.HasPrefix(mantissa, "-") || strings.HasPrefix(mantissa, "+") {
+		mantissa = mantissa[1:]
+	}
+	digits := 0
+	for i, c := range mantissa {
+		switch {
+		case '0' <= c && c <= '9':
+			digits++
+		case c == '.' && !strings.Contains(mantissa[i+1:], "."):
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
@@ -0,0 +1,359 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// bucket-level operations
+type BucketInterface interface {
+	CreateBucket(req CreateBucketRequest) error
+	DeleteBucket(bucket string) error // the bucket must be empty
+
+	GetBucketPolicy(bucket string) (*Policy, error)
+	PutBucketPolicy(bucket string, p Policy) error
+	DeleteBucketPolicy(bucket string) error
+
+	GetBucketLifecycle(bucket string) (*LifecycleConfiguration, error)
+	PutBucketLifecycle(bucket string, c LifecycleConfiguration) error
+	DeleteBucketLifecycle(bucket string) error
+
+	GetBucketCors(bucket string) (*CORSConfiguration, error)
+	PutBucketCors(bucket string, c CORSConfiguration) error
+	DeleteBucketCors(bucket string) error
+
+	// versioning can be suspended but never removed
+	GetBucketVersioning(bucket string) (*VersioningConfiguration, error)
+	PutBucketVersioning(bucket string, c VersioningConfiguration) error
+}
+
+type CreateBucketRequest struct {
+	Bucket string
+	Region string // location constraint; empty means the client's region
+}
+
+// an iam policy document, as json
+type Policy struct {
+	Version   string `json:",omitempty"` // e.g. "2012-10-17"
+	Id        string `json:",omitempty"`
+	Statement []Statement
+}
+
+type Statement struct {
+	Sid       string      `json:",omitempty"`
+	Effect    string      // "Allow" or "Deny"
+	Principal *Principal  `json:",omitempty"`
+	Action    StringList  `json:",omitempty"` // e.g. "s3:GetObject"
+	Resource  StringList  `json:",omitempty"` // e.g. "arn:aws:s3:::bucket/*"
+	Condition interface{} `json:",omitempty"` // e.g. {"IpAddress": {"aws:SourceIp": "10.0.0.0/8"}}
+}
+
+// everyone ("*"), or principals by type, e.g. {"AWS": ["arn:aws:iam::123456789012:root"]}
+type Principal struct {
+	Everyone bool
+	Values   map[string]StringList
+}
+
+func (p Principal) MarshalJSON() ([]byte, error) {
+	if p.Everyone {
+		return []byte(`"*"`), nil
+	}
+	return json.Marshal(p.Values)
+}
+
+func (p *Principal) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != "*" {
+			return fmt.Errorf("illegal principal: %q", s)
+		}
+		*p = Principal{Everyone: true}
+		return nil
+	}
+	*p = Principal{}
+	return json.Unmarshal(b, &p.Values)
+}
+
+// one or more strings, which policies write as a string when there's just one
+type StringList []string
+
+func (l StringList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// the policy MakePublic sets, allowing anyone to read the bucket's objects
+func PublicReadPolicy(bucket string) Policy {
+	return Policy{
+		Version: "2008-10-17",
+		Statement: []Statement{{
+			Sid:       "AllowPublicRead",
+			Effect:    "Allow",
+			Principal: &Principal{Values: map[string]StringList{"AWS": {"*"}}},
+			Action:    StringList{"s3:GetObject"},
+			Resource:  StringList{fmt.Sprintf("arn:aws:s3:::%s/*", bucket)},
+		}},
+	}
+}
+
+type LifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration" json:"-"`
+	Rules   []LifecycleRule `xml:"Rule"`
+}
+
+type LifecycleRule struct {
+	ID                             string                          `xml:",omitempty"`
+	Status                         string                          // "Enabled" or "Disabled"
+	Filter                         LifecycleFilter                 // empty means the whole bucket
+	Expiration                     *LifecycleExpiration            `xml:",omitempty"`
+	Transitions                    []LifecycleTransition           `xml:"Transition,omitempty"`
+	NoncurrentVersionExpiration    *NoncurrentVersionExpiration    `xml:",omitempty"`
+	NoncurrentVersionTransitions   []NoncurrentVersionTransition   `xml:"NoncurrentVersionTransition,omitempty"`
+	AbortIncompleteMultipartUpload *AbortIncompleteMultipartUpload `xml:",omitempty"`
+}
+
+type LifecycleFilter struct {
+	Prefix string `xml:",omitempty"`
+	Tag    *Tag   `xml:",omitempty"`
+}
+
+type Tag struct {
+	Key, Value string
+}
+
+type LifecycleExpiration struct {
+	Days                      int    `xml:",omitempty"`
+	Date                      string `xml:",omitempty"` // iso 8601, at midnight utc
+	ExpiredObjectDeleteMarker bool   `xml:",omitempty"`
+}
+
+type LifecycleTransition struct {
+	Days         int    `xml:",omitempty"`
+	Date         string `xml:",omitempty"`
+	StorageClass string // e.g. "GLACIER"
+}
+
+type NoncurrentVersionExpiration struct {
+	NoncurrentDays int
+}
+
+type NoncurrentVersionTransition struct {
+	NoncurrentDays int
+	StorageClass   string
+}
+
+type AbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int
+}
+
+type CORSConfiguration struct {
+	XMLName xml.Name   `xml:"CORSConfiguration" json:"-"`
+	Rules   []CORSRule `xml:"CORSRule"`
+}
+
+type CORSRule struct {
+	ID             string   `xml:",omitempty"`
+	AllowedMethods []string `xml:"AllowedMethod"` // e.g. "GET"
+	AllowedOrigins []string `xml:"AllowedOrigin"` // e.g. "https://example.com" or "*"
+	AllowedHeaders []string `xml:"AllowedHeader,omitempty"`
+	ExposeHeaders  []string `xml:"ExposeHeader,omitempty"`
+	MaxAgeSeconds  int      `xml:",omitempty"`
+}
+
+const (
+	VersioningEnabled   = "Enabled"
+	VersioningSuspended = "Suspended"
+)
+
+type VersioningConfiguration struct {
+	XMLName   xml.Name `xml:"VersioningConfiguration" json:"-"`
+	Status    string   `xml:",omitempty"` // empty if versioning was never enabled
+	MfaDelete string   `xml:",omitempty"`
+}
+
+type createBucketConfiguration struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string
+}
+
+func (s SmartS3) CreateBucket(req CreateBucketRequest) error {
+	if req.Bucket == "" {
+		return errors.New("no bucket name")
+	}
+	region := req.Region
+	if region == "" {
+		region = s.region()
+	}
+	var body []byte
+	if region != "us-east-1" {
+		var err error
+		if body, err = xml.Marshal(createBucketConfiguration{LocationConstraint: region}); err != nil {
+			return err
+		}
+	}
+	_, err := s.bucketOp("PUT", req.Bucket, "", body)
+	return err
+}
+
+func (s SmartS3) DeleteBucket(bucket string) error {
+	_, err := s.bucketOp("DELETE", bucket, "", nil)
+	return err
+}
+
+func (s SmartS3) GetBucketPolicy(bucket string) (*Policy, error) {
+	buf, err := s.bucketOp("GET", bucket, "policy", nil)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s SmartS3) PutBucketPolicy(bucket string, p Policy) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.bucketOp("PUT", bucket, "policy", buf)
+	return err
+}
+
+func (s SmartS3) DeleteBucketPolicy(bucket string) error {
+	_, err := s.bucketOp("DELETE", bucket, "policy", nil)
+	return err
+}
+
+func (s SmartS3) GetBucketLifecycle(bucket string) (*LifecycleConfiguration, error) {
+	var c LifecycleConfiguration
+	if err := s.getBucketXML(bucket, "lifecycle", &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s SmartS3) PutBucketLifecycle(bucket string, c LifecycleConfiguration) error {
+	return s.putBucketXML(bucket, "lifecycle", c)
+}
+
+func (s SmartS3) DeleteBucketLifecycle(bucket string) error {
+	_, err := s.bucketOp("DELETE", bucket, "lifecycle", nil)
+	return err
+}
+
+func (s SmartS3) GetBucketCors(bucket string) (*CORSConfiguration, error) {
+	var c CORSConfiguration
+	if err := s.getBucketXML(bucket, "cors", &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s SmartS3) PutBucketCors(bucket string, c CORSConfiguration) error {
+	return s.putBucketXML(bucket, "cors", c)
+}
+
+func (s SmartS3) DeleteBucketCors(bucket string) error {
+	_, err := s.bucketOp("DELETE", bucket, "cors", nil)
+	return err
+}
+
+func (s SmartS3) GetBucketVersioning(bucket string) (*VersioningConfiguration, error) {
+	var c VersioningConfiguration
+	if err := s.getBucketXML(bucket, "versioning", &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s SmartS3) PutBucketVersioning(bucket string, c VersioningConfiguration) error {
+	return s.putBucketXML(bucket, "versioning", c)
+}
+
+func (s SmartS3) getBucketXML(bucket, subresource string, v interface{}) error {
+	buf, err := s.bucketOp("GET", bucket, subresource, nil)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf, v)
+}
+
+func (s SmartS3) putBucketXML(bucket, subresource string, v interface{}) error {
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.bucketOp("PUT", bucket, subresource, buf)
+	return err
+}
+
+// a request on a bucket or one of its subresources (e.g. "policy"), returning the response body
+func (s SmartS3) bucketOp(method, bucket, subresource string, body []byte) ([]byte, error) {
+	if bucket == "" {
+		return nil, errors.New("no bucket name")
+	}
+	f := func() (interface{}, error) {
+		return s.bucketRequest(method, bucket, subresource, body)
+	}
+	v, err := s.retry(fmt.Sprintf("%s %s?%s", method, bucket, subresource), f)
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (s SmartS3) bucketRequest(method, bucket, subresource string, body []byte) ([]byte, error) {
+	u, err := s.createURL(Object{Bucket: bucket})
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = subresource
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payload := emptySHA256
+	if body != nil {
+		// some subresources, like lifecycle, require an md5
+		sum := md5.Sum(body)
+		hreq.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		payload = hashHex(body)
+	}
+	if err := s.sign(hreq, payload); err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, responseError(resp)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, resp.Body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,215 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/xoba/goutil"
+)
+
+const (
+	// most keys a DeleteObjects request may name
+	MaxDeleteObjects = 1000
+
+	DefaultDeleteConcurrency = 4
+)
+
+type DeleteObjectsRequest struct {
+	Bucket  string
+	Objects []ObjectIdentifier
+	Quiet   bool // if true, only failures are reported
+}
+
+type ObjectIdentifier struct {
+	Key       string
+	VersionId string `xml:",omitempty"`
+}
+
+type DeleteObjectsResult struct {
+	Deleted []DeletedObject
+	Errors  []DeleteError `xml:"Error"`
+}
+
+type DeletedObject struct {
+	Key, VersionId        string
+	DeleteMarker          bool
+	DeleteMarkerVersionId string
+}
+
+// failure to delete one key of a DeleteObjects request
+type DeleteError struct {
+	Key, VersionId, Code, Message string
+}
+
+func (e DeleteError) Error() string {
+	return fmt.Sprintf("s3: can't delete %q: %s: %s", e.Key, e.Code, e.Message)
+}
+
+// the per-key failures as a single error, or nil if there weren't any
+func (r *DeleteObjectsResult) Err() error {
+	switch len(r.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return r.Errors[0]
+	default:
+		return fmt.Errorf("%w (and %d more)", r.Errors[0], len(r.Errors)-1)
+	}
+}
+
+func (s SmartS3) DeleteObjects(req DeleteObjectsRequest) (*DeleteObjectsResult, error) {
+	if err := checkDeleteObjects(req); err != nil {
+		return nil, err
+	}
+	f := func() (interface{}, error) {
+		return s.deleteObjects(req)
+	}
+	v, err := s.retry(str(req), f)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*DeleteObjectsResult), nil
+}
+
+func checkDeleteObjects(req DeleteObjectsRequest) error {
+	if req.Bucket == "" {
+		return errors.New("no bucket name")
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > MaxDeleteObjects {
+		return fmt.Errorf("can't delete %d objects at once", len(req.Objects))
+	}
+	for _, o := range req.Objects {
+		if o.Key == "" {
+			return errors.New("illegal key")
+		}
+	}
+	return nil
+}
+
+func (s SmartS3) deleteObjects(req DeleteObjectsRequest) (*DeleteObjectsResult, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Delete"`
+		Quiet   bool
+		Object  []ObjectIdentifier
+	}{Quiet: req.Quiet, Object: req.Objects})
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.createURL(Object{Bucket: req.Bucket})
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = "delete"
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(body)
+	hreq.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	hreq.Header.Set("Content-Type", "application/xml")
+	if err := s.sign(hreq, hashHex(body)); err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, responseError(resp)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, resp.Body); err != nil {
+		return nil, err
+	}
+	// per-key failures are also <Error> elements, so only look for an embedded error outside a <DeleteResult>
+	if !bytes.Contains(buf.Bytes(), []byte("<DeleteResult")) {
+		if err := embeddedError(resp.StatusCode, buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	var out DeleteObjectsResult
+	if err := xml.Unmarshal(buf.Bytes(), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+type DeletePrefixRequest struct {
+	Bucket      string
+	Prefix      string // empty means the whole bucket
+	Concurrency int    // DeleteObjects requests at once; zero means DefaultDeleteConcurrency
+}
+
+// deletes every object whose key starts with the prefix, listing and deleting in batches,
+// returning the number of objects deleted. keys that fail are reported after the rest are tried,
+// by the first error, as is or with a count of the others.
+func DeletePrefix(i Interface, req DeletePrefixRequest) (int, error) {
+	if req.Bucket == "" {
+		return 0, errors.New("no bucket name")
+	}
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultDeleteConcurrency
+	}
+
+	var lock sync.Mutex
+	var deleted int
+	var errs []error
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err)
+	}
+
+	q := goutil.NewWorkQueue(concurrency)
+	submit := func(batch []ObjectIdentifier) {
+		q.Submit(func() {
+			r, err := i.DeleteObjects(DeleteObjectsRequest{Bucket: req.Bucket, Objects: batch, Quiet: true})
+			if err != nil {
+				fail(err)
+				return
+			}
+			if err := r.Err(); err != nil {
+				fail(err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			deleted += len(batch) - len(r.Errors)
+		})
+	}
+
+	var batch []ObjectIdentifier
+	l := NewLister(i, ListV2Request{Bucket: req.Bucket, Prefix: req.Prefix, MaxKeys: MaxDeleteObjects})
+	for l.Next() {
+		batch = append(batch, ObjectIdentifier{Key: l.Key()})
+		if len(batch) == MaxDeleteObjects {
+			submit(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		submit(batch)
+	}
+	q.Wait()
+
+	if err := l.Err(); err != nil {
+		return deleted, err
+	}
+	switch len(errs) {
+	case 0:
+		return deleted, nil
+	case 1:
+		return deleted, errs[0]
+	default:
+		return deleted, fmt.Errorf("%w (and %d other errors)", errs[0], len(errs)-1)
+	}
+}
@@ -0,0 +1,110 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// an error response from s3
+type Error struct {
+	StatusCode int `xml:"-"`
+	Code       string
+	Message    string
+	Resource   string
+	RequestId  string
+	HostId     string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %d %s: %s (request %s)", e.StatusCode, e.Code, msg, e.RequestId)
+}
+
+// whether s3 may succeed if the request is retried
+func (e *Error) Temporary() bool {
+	switch e.Code {
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return e.StatusCode >= 500 || e.StatusCode == 429
+}
+
+// builds an *Error from an unsuccessful response, which has no body for HEAD requests
+func responseError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	if buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20)); err == nil && len(buf) > 0 {
+		xml.Unmarshal(buf, e)
+	}
+	if e.Code == "" {
+		switch {
+		case resp.StatusCode == 404 && resp.Request != nil && resp.Request.Method == "HEAD":
+			e.Code = "NoSuchKey"
+		case resp.StatusCode == 304:
+			e.Code = "NotModified"
+		case resp.StatusCode == 412:
+			e.Code = "PreconditionFailed"
+		default:
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+	}
+	if e.RequestId == "" {
+		e.RequestId = resp.Header.Get("X-Amz-Request-Id")
+	}
+	if e.HostId == "" {
+		e.HostId = resp.Header.Get("X-Amz-Id-2")
+	}
+	return e
+}
+
+// s3 may report an error with a 200 status for copies and multipart completions,
+// since it's already started responding
+func embeddedError(status int, body []byte) error {
+	if !bytes.Contains(body, []byte("<Error>")) {
+		return nil
+	}
+	e := &Error{StatusCode: status}
+	if err := xml.Unmarshal(body, e); err != nil {
+		return err
+	}
+	return e
+}
+
+// whether err is an *Error with the given code
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+func IsNoSuchKey(err error) bool {
+	return IsCode(err, "NoSuchKey")
+}
+
+func IsNoSuchBucket(err error) bool {
+	return IsCode(err, "NoSuchBucket")
+}
+
+// whether a failed request is worth retrying: throttling, server errors, corruption and network failures
+func Retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary()
+	}
+	var ce *ChecksumError
+	if errors.As(err, &ce) {
+		return ce.Temporary()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
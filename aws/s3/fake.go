@@ -0,0 +1,1071 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xoba/goutil"
+)
+
+// an Interface backed by memory or a local directory rather than s3, for hermetic tests
+// and offline tools. buckets must be created with MakeBucket or CreateBucket before use.
+// bucket configuration is recorded but not enforced, and only the latest version of each
+// object is kept, even if versioning is enabled.
+type FakeS3 struct {
+	*fakeStore
+	ctx context.Context // see WithContext
+}
+
+// shared by copies of a FakeS3 bound to different contexts
+type fakeStore struct {
+	lock    sync.Mutex
+	b       backend
+	uploads map[string]*fakeUpload
+}
+
+// storage for FakeS3; implementations needn't be thread-safe
+type backend interface {
+	buckets() ([]Bucket, error)
+	createBucket(name string, t time.Time) error
+	deleteBucket(name string) error
+	hasBucket(name string) (bool, error)
+	config(bucket string) (*fakeConfig, error) // never nil for an existing bucket
+	setConfig(bucket string, c fakeConfig) error
+	put(o Object, data []byte, m fakeMeta) error
+	get(o Object) ([]byte, *fakeMeta, error) // nil meta if there's no such object
+	meta(o Object) (*fakeMeta, error)        // nil if there's no such object
+	del(o Object) error
+	keys(bucket string) ([]string, error) // sorted
+}
+
+type fakeMeta struct {
+	ETag               string
+	ContentType        string            `json:",omitempty"`
+	ContentEncoding    string            `json:",omitempty"`
+	CacheControl       string            `json:",omitempty"`
+	ContentDisposition string            `json:",omitempty"`
+	Metadata           map[string]string `json:",omitempty"`
+	StorageClass       string            `json:",omitempty"`
+	Encryption         *Encryption       `json:",omitempty"`
+	CustomerKeyMD5     string            `json:",omitempty"`
+	Key                string            `json:",omitempty"` // only for keys a dirBackend hashes
+	Size               int
+	LastModified       time.Time
+}
+
+type fakeConfig struct {
+	Region     string                   `json:",omitempty"`
+	Policy     *Policy                  `json:",omitempty"`
+	Lifecycle  *LifecycleConfiguration  `json:",omitempty"`
+	Cors       *CORSConfiguration       `json:",omitempty"`
+	Versioning *VersioningConfiguration `json:",omitempty"`
+}
+
+// a copy of c sharing nothing with it, by way of json, as a dirBackend stores it
+func (c fakeConfig) clone() (fakeConfig, error) {
+	var out fakeConfig
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return out, err
+	}
+	return out, json.Unmarshal(buf, &out)
+}
+
+// a copy of m sharing nothing with it
+func (m fakeMeta) clone() fakeMeta {
+	if m.Metadata != nil {
+		md := make(map[string]string, len(m.Metadata))
+		for k, v := range m.Metadata {
+			md[k] = v
+		}
+		m.Metadata = md
+	}
+	if m.Encryption != nil {
+		e := *m.Encryption
+		e.CustomerKey = append([]byte(nil), e.CustomerKey...)
+		m.Encryption = &e
+	}
+	return m
+}
+
+type fakeUpload struct {
+	put   BasePut
+	parts map[int][]byte
+}
+
+// a fake whose objects live in memory
+func NewMemoryS3() *FakeS3 {
+	return newFake(&memBackend{m: make(map[string]*memBucket)})
+}
+
+func newFake(b backend) *FakeS3 {
+	return &FakeS3{fakeStore: &fakeStore{
+		b:       b,
+		uploads: make(map[string]*fakeUpload),
+	}}
+}
+
+// operations on the copy fail once ctx is done
+func (f *FakeS3) WithContext(ctx context.Context) Interface {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c := *f
+	c.ctx = ctx
+	return &c
+}
+
+func (f *FakeS3) checkContext() error {
+	if f.ctx == nil {
+		return nil
+	}
+	return f.ctx.Err()
+}
+
+func (f *FakeS3) MakeBucket(name string) error {
+	if err := f.checkContext(); err != nil {
+		return err
+	}
+	if err := checkBucketName(name); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.b.createBucket(name, now())
+}
+
+// whether the bucket's policy lets anyone get objects, as MakePublic's does
+func (f *FakeS3) IsPublic(bucket string) bool {
+	if checkBucketName(bucket) != nil {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c, err := f.b.config(bucket)
+	if err != nil || c == nil || c.Policy == nil {
+		return false
+	}
+	for _, st := range c.Policy.Statement {
+		if st.Effect != "Allow" || st.Principal == nil || !(st.Principal.Everyone || contains(st.Principal.Values["AWS"], "*")) {
+			continue
+		}
+		if contains(st.Action, "s3:GetObject") || contains(st.Action, "s3:*") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// s3 only keeps time to the second
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func md5Hex(b []byte) string {
+	h := md5.Sum(b)
+	return hex.EncodeToString(h[:])
+}
+
+func (f *FakeS3) checkBucket(name string) error {
+	if err := f.checkContext(); err != nil {
+		return err
+	}
+	if err := checkBucketName(name); err != nil {
+		return err
+	}
+	ok, err := f.b.hasBucket(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fakeError(404, "NoSuchBucket", "no such bucket: %q", name)
+	}
+	return nil
+}
+
+// whether a bucket name is safe as a directory name; s3's own rules are stricter
+func checkBucketName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fakeError(400, "InvalidBucketName", "illegal bucket name: %q", name)
+	}
+	return nil
+}
+
+func fakeError(status int, code, format string, args ...interface{}) error {
+	return &Error{StatusCode: status, Code: code, Message: fmt.Sprintf(format, args...), RequestId: "fake"}
+}
+
+func noSuchKey(o Object) error {
+	return fakeError(404, "NoSuchKey", "no such key: %s/%s", o.Bucket, o.Key)
+}
+
+func (f *FakeS3) Copy(req CopyRequest) error {
+	if err := checkObject(req.From); err != nil {
+		return err
+	}
+	if err := checkObject(req.To); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.From.Bucket); err != nil {
+		return err
+	}
+	if err := f.checkBucket(req.To.Bucket); err != nil {
+		return err
+	}
+	data, m, err := f.b.get(req.From)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return noSuchKey(req.From)
+	}
+	if err := m.checkCustomerKey(req.SourceEncryption); err != nil {
+		return err
+	}
+	if req.ReplaceMetadata {
+		h := req.Headers
+		h.Object = req.To
+		*m = newFakeMeta(h, data, m.ETag)
+	} else {
+		m.LastModified = now()
+		m.setStorage(req.Headers)
+	}
+	return f.b.put(req.To, data, *m)
+}
+
+func (f *FakeS3) Put(req PutRequest) error {
+	if err := checkObject(req.Object); err != nil {
+		return err
+	}
+	if req.Checksum != "" {
+		// nothing is corrupted in memory, but the algorithm should be valid
+		if _, err := req.Checksum.newHash(); err != nil {
+			return err
+		}
+	}
+	r, err := req.ReaderFact.CreateReader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) != req.ReaderFact.Len() {
+		return fakeError(400, "IncompleteBody", "expected %d bytes, got %d", req.ReaderFact.Len(), len(data))
+	}
+	if err := checkMD5(req.ContentMD5, data); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.Object.Bucket); err != nil {
+		return err
+	}
+	etag := md5Hex(data)
+	if e := req.Encryption; e != nil && (e.ServerSideEncryption == SSEKMS || len(e.CustomerKey) > 0) {
+		// like s3's, such etags aren't the md5's of the contents
+		etag = md5Hex(append([]byte("encrypted "), data...))
+	}
+	return f.b.put(req.Object, data, newFakeMeta(req.BasePut, data, etag))
+}
+
+func newFakeMeta(req BasePut, data []byte, etag string) fakeMeta {
+	ct := req.ContentType
+	if ct == "" {
+		ct = mimeType(req.Object.Key)
+	}
+	if ct == "" {
+		ct = "binary/octet-stream"
+	}
+	m := fakeMeta{
+		ETag:               etag,
+		ContentType:        ct,
+		ContentEncoding:    req.ContentEncoding,
+		CacheControl:       req.CacheControl,
+		ContentDisposition: req.ContentDisposition,
+		Size:               len(data),
+		LastModified:       now(),
+	}
+	for k, v := range req.Metadata {
+		if m.Metadata == nil {
+			m.Metadata = make(map[string]string)
+		}
+		m.Metadata[strings.ToLower(k)] = v
+	}
+	m.setStorage(req)
+	return m
+}
+
+func (m *fakeMeta) setStorage(req BasePut) {
+	if req.StorageClass != "" {
+		m.StorageClass = req.StorageClass
+	}
+	if e := req.Encryption; e != nil {
+		m.Encryption = nil
+		m.CustomerKeyMD5 = ""
+		if e.ServerSideEncryption != "" {
+			m.Encryption = &Encryption{ServerSideEncryption: e.ServerSideEncryption, KMSKeyId: e.KMSKeyId}
+		}
+		if len(e.CustomerKey) > 0 {
+			m.CustomerKeyMD5 = md5Hex(e.CustomerKey)
+		}
+	}
+}
+
+// objects encrypted with SSE-C can only be read with the same key
+func (m *fakeMeta) checkCustomerKey(e *Encryption) error {
+	if m.CustomerKeyMD5 == "" {
+		return nil
+	}
+	if e == nil || md5Hex(e.CustomerKey) != m.CustomerKeyMD5 {
+		return fakeError(400, "InvalidRequest", "object is encrypted with a customer key")
+	}
+	return nil
+}
+
+// checks optional md5, hex or base64, like s3 does
+func checkMD5(expected string, data []byte) error {
+	if expected == "" {
+		return nil
+	}
+	var d []byte
+	var err error
+	if len(expected) == 32 {
+		d, err = hex.DecodeString(expected)
+	} else {
+		d, err = base64.StdEncoding.DecodeString(expected)
+	}
+	if err != nil {
+		return fakeError(400, "InvalidDigest", "bad md5 %q: %v", expected, err)
+	}
+	if h := md5.Sum(data); !bytes.Equal(d, h[:]) {
+		return fakeError(400, "BadDigest", "expected %x, got %x", d, h)
+	}
+	return nil
+}
+
+func (f *FakeS3) PutObject(req PutObjectRequest) error {
+	return f.Put(PutRequest{
+		BasePut:    req.BasePut,
+		ReaderFact: goutil.BufferReaderFact{Buffer: req.Data},
+	})
+}
+
+func (f *FakeS3) Head(req Object) (*HeadResponse, error) {
+	return f.HeadObject(HeadRequest{Object: req})
+}
+
+func (f *FakeS3) HeadObject(req HeadRequest) (*HeadResponse, error) {
+	if err := checkObject(req.Object); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.Object.Bucket); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(req.Object, req.VersionId); err != nil {
+		return nil, err
+	}
+	m, err := f.b.meta(req.Object)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, noSuchKey(req.Object)
+	}
+	if err := m.checkCustomerKey(req.Encryption); err != nil {
+		return nil, err
+	}
+	if err := req.Conditions.check(m.ETag, m.LastModified); err != nil {
+		return nil, err
+	}
+	return &HeadResponse{
+		ETag:               m.ETag,
+		ContentType:        m.ContentType,
+		ContentLength:      m.Size,
+		LastModified:       m.LastModified,
+		ContentEncoding:    m.ContentEncoding,
+		CacheControl:       m.CacheControl,
+		ContentDisposition: m.ContentDisposition,
+		Metadata:           m.Metadata,
+		StorageClass:       m.StorageClass,
+		Encryption:         m.Encryption,
+	}, nil
+}
+
+// buckets here are never versioned, so objects only have the null version
+func checkVersion(o Object, versionId string) error {
+	if versionId != "" && versionId != NullVersion {
+		return fakeError(404, "NoSuchVersion", "no such version of %s/%s: %q", o.Bucket, o.Key, versionId)
+	}
+	return nil
+}
+
+func (f *FakeS3) Get(req GetRequest) (io.ReadCloser, error) {
+	buf, err := f.GetObject(req)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (f *FakeS3) GetObject(req GetRequest) ([]byte, error) {
+	if err := checkObject(req.Object); err != nil {
+		return nil, err
+	}
+	if err := checkRange(req.Range); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.Object.Bucket); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(req.Object, req.VersionId); err != nil {
+		return nil, err
+	}
+	data, m, err := f.b.get(req.Object)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, noSuchKey(req.Object)
+	}
+	if err := m.checkCustomerKey(req.Encryption); err != nil {
+		return nil, err
+	}
+	if err := req.Conditions.check(m.ETag, m.LastModified); err != nil {
+		return nil, err
+	}
+	if r := req.Range; r != nil {
+		if r.Start >= int64(len(data)) {
+			return nil, fakeError(416, "InvalidRange", "invalid range %v for %d bytes", *r, len(data))
+		}
+		end := r.End
+		if end < 0 || end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		data = data[r.Start : end+1]
+	}
+	out := make([]byte, len(data))
+	copy(out, data)
+	return out, nil
+}
+
+func (f *FakeS3) List(req ListRequest) (ListBucketResult, error) {
+	out := ListBucketResult{
+		Name:      req.Bucket,
+		Prefix:    req.Prefix,
+		Marker:    req.Marker,
+		Delimiter: req.Delimiter,
+		MaxKeys:   maxKeys(req.MaxKeys),
+	}
+	if req.Bucket == "" {
+		return out, errors.New("no bucket name")
+	}
+	var last string
+	var err error
+	out.Contents, out.CommonPrefixes, out.IsTruncated, last, err = f.list(req.Bucket, req.Prefix, req.Delimiter, req.Marker, out.MaxKeys)
+	if out.IsTruncated && req.Delimiter != "" {
+		out.NextMarker = last
+	}
+	return out, err
+}
+
+func (f *FakeS3) ListV2(req ListV2Request) (ListV2Result, error) {
+	out := ListV2Result{
+		Name:              req.Bucket,
+		Prefix:            req.Prefix,
+		Delimiter:         req.Delimiter,
+		StartAfter:        req.StartAfter,
+		ContinuationToken: req.ContinuationToken,
+		MaxKeys:           maxKeys(req.MaxKeys),
+	}
+	if req.Bucket == "" {
+		return out, errors.New("no bucket name")
+	}
+	after := req.StartAfter
+	if req.ContinuationToken != "" {
+		b, err := base64.StdEncoding.DecodeString(req.ContinuationToken)
+		if err != nil {
+			return out, fakeError(400, "InvalidArgument", "bad continuation token: %v", err)
+		}
+		after = string(b)
+	}
+	var last string
+	var err error
+	out.Contents, out.CommonPrefixes, out.IsTruncated, last, err = f.list(req.Bucket, req.Prefix, req.Delimiter, after, out.MaxKeys)
+	out.KeyCount = int64(len(out.Contents) + len(out.CommonPrefixes))
+	if out.IsTruncated {
+		out.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+	}
+	return out, err
+}
+
+// each key has just its null version, since buckets here are never versioned
+func (f *FakeS3) ListVersions(req ListVersionsRequest) (ListVersionsResult, error) {
+	out := ListVersionsResult{
+		Name:            req.Bucket,
+		Prefix:          req.Prefix,
+		Delimiter:       req.Delimiter,
+		KeyMarker:       req.KeyMarker,
+		VersionIdMarker: req.VersionIdMarker,
+		MaxKeys:         maxKeys(req.MaxKeys),
+	}
+	if req.Bucket == "" {
+		return out, errors.New("no bucket name")
+	}
+	contents, prefixes, truncated, last, err := f.list(req.Bucket, req.Prefix, req.Delimiter, req.KeyMarker, out.MaxKeys)
+	for _, c := range contents {
+		out.Versions = append(out.Versions, ObjectVersion{
+			Key:          c.Key,
+			VersionId:    NullVersion,
+			ETag:         c.ETag,
+			StorageClass: c.StorageClass,
+			IsLatest:     true,
+			Size:         c.Size,
+			LastModified: c.LastModified,
+		})
+	}
+	out.CommonPrefixes = prefixes
+	out.IsTruncated = truncated
+	if truncated {
+		out.NextKeyMarker = last
+		out.NextVersionIdMarker = NullVersion
+	}
+	return out, err
+}
+
+func maxKeys(n int64) int64 {
+	if n <= 0 || n > 1000 {
+		return 1000
+	}
+	return n
+}
+
+// lists keys after the marker, like s3 does; last is the last key or prefix returned
+func (f *FakeS3) list(bucket, prefix, delimiter, after string, max int64) (contents []ListBucketResultContents, prefixes []CommonPrefix, truncated bool, last string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err = f.checkBucket(bucket); err != nil {
+		return
+	}
+	keys, err := f.b.keys(bucket)
+	if err != nil {
+		return
+	}
+	var count int64
+	for _, k := range keys {
+		if k <= after || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		cp := ""
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				cp = k[:len(prefix)+i+len(delimiter)]
+				if cp <= after || cp == last {
+					continue
+				}
+			}
+		}
+		if count == max {
+			truncated = true
+			return
+		}
+		count++
+		if cp != "" {
+			prefixes = append(prefixes, CommonPrefix{Prefix: cp})
+			last = cp
+			continue
+		}
+		var m *fakeMeta
+		m, err = f.b.meta(Object{Bucket: bucket, Key: k})
+		if err != nil {
+			return
+		}
+		if m == nil {
+			continue
+		}
+		class := m.StorageClass
+		if class == "" {
+			class = "STANDARD"
+		}
+		contents = append(contents, ListBucketResultContents{
+			Key:          k,
+			ETag:         `"` + m.ETag + `"`,
+			StorageClass: class,
+			Size:         m.Size,
+			LastModified: m.LastModified,
+		})
+		last = k
+	}
+	return
+}
+
+func (f *FakeS3) Delete(req DeleteRequest) error {
+	if err := checkObject(req.Object); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.Object.Bucket); err != nil {
+		return err
+	}
+	if req.VersionId != "" && req.VersionId != NullVersion {
+		// like s3, deleting a missing version succeeds
+		return nil
+	}
+	return f.b.del(req.Object)
+}
+
+func (f *FakeS3) DeleteObjects(req DeleteObjectsRequest) (*DeleteObjectsResult, error) {
+	if err := checkDeleteObjects(req); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.Bucket); err != nil {
+		return nil, err
+	}
+	out := &DeleteObjectsResult{}
+	for _, o := range req.Objects {
+		if o.VersionId == "" || o.VersionId == NullVersion {
+			if err := f.b.del(Object{Bucket: req.Bucket, Key: o.Key}); err != nil {
+				out.Errors = append(out.Errors, DeleteError{Key: o.Key, VersionId: o.VersionId, Code: "InternalError", Message: err.Error()})
+				continue
+			}
+		}
+		if !req.Quiet {
+			out.Deleted = append(out.Deleted, DeletedObject{Key: o.Key, VersionId: o.VersionId})
+		}
+	}
+	return out, nil
+}
+
+func (f *FakeS3) Buckets() (*ListAllMyBucketsResult, error) {
+	if err := f.checkContext(); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list, err := f.b.buckets()
+	if err != nil {
+		return nil, err
+	}
+	return &ListAllMyBucketsResult{Owner: Owner{ID: "fake", DisplayName: "fake"}, Buckets: list}, nil
+}
+
+func (f *FakeS3) MakePublic(bucket string) error {
+	return f.PutBucketPolicy(bucket, PublicReadPolicy(bucket))
+}
+
+func (f *FakeS3) CreateBucket(req CreateBucketRequest) error {
+	if err := f.MakeBucket(req.Bucket); err != nil {
+		return err
+	}
+	return f.updateConfig(req.Bucket, func(c *fakeConfig) error {
+		c.Region = req.Region
+		return nil
+	})
+}
+
+func (f *FakeS3) DeleteBucket(bucket string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(bucket); err != nil {
+		return err
+	}
+	keys, err := f.b.keys(bucket)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fakeError(409, "BucketNotEmpty", "bucket not empty: %q", bucket)
+	}
+	return f.b.deleteBucket(bucket)
+}
+
+func (f *FakeS3) bucketConfig(bucket string) (*fakeConfig, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	return f.b.config(bucket)
+}
+
+func (f *FakeS3) updateConfig(bucket string, update func(c *fakeConfig) error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(bucket); err != nil {
+		return err
+	}
+	c, err := f.b.config(bucket)
+	if err != nil {
+		return err
+	}
+	if err := update(c); err != nil {
+		return err
+	}
+	return f.b.setConfig(bucket, *c)
+}
+
+func (f *FakeS3) GetBucketPolicy(bucket string) (*Policy, error) {
+	c, err := f.bucketConfig(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if c.Policy == nil {
+		return nil, fakeError(404, "NoSuchBucketPolicy", "no policy for %q", bucket)
+	}
+	return c.Policy, nil
+}
+
+func (f *FakeS3) PutBucketPolicy(bucket string, p Policy) error {
+	if len(p.Statement) == 0 {
+		return fakeError(400, "MalformedPolicy", "policy has no statements")
+	}
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Policy = &p
+		return nil
+	})
+}
+
+func (f *FakeS3) DeleteBucketPolicy(bucket string) error {
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Policy = nil
+		return nil
+	})
+}
+
+func (f *FakeS3) GetBucketLifecycle(bucket string) (*LifecycleConfiguration, error) {
+	c, err := f.bucketConfig(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if c.Lifecycle == nil {
+		return nil, fakeError(404, "NoSuchLifecycleConfiguration", "no lifecycle for %q", bucket)
+	}
+	return c.Lifecycle, nil
+}
+
+func (f *FakeS3) PutBucketLifecycle(bucket string, l LifecycleConfiguration) error {
+	for _, r := range l.Rules {
+		if r.Status != "Enabled" && r.Status != "Disabled" {
+			return fakeError(400, "MalformedXML", "illegal rule status: %q", r.Status)
+		}
+	}
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Lifecycle = &l
+		return nil
+	})
+}
+
+func (f *FakeS3) DeleteBucketLifecycle(bucket string) error {
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Lifecycle = nil
+		return nil
+	})
+}
+
+func (f *FakeS3) GetBucketCors(bucket string) (*CORSConfiguration, error) {
+	c, err := f.bucketConfig(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if c.Cors == nil {
+		return nil, fakeError(404, "NoSuchCORSConfiguration", "no cors configuration for %q", bucket)
+	}
+	return c.Cors, nil
+}
+
+func (f *FakeS3) PutBucketCors(bucket string, x CORSConfiguration) error {
+	for _, r := range x.Rules {
+		if len(r.AllowedMethods) == 0 || len(r.AllowedOrigins) == 0 {
+			return fakeError(400, "MalformedXML", "cors rules need methods and origins")
+		}
+	}
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Cors = &x
+		return nil
+	})
+}
+
+func (f *FakeS3) DeleteBucketCors(bucket string) error {
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Cors = nil
+		return nil
+	})
+}
+
+func (f *FakeS3) GetBucketVersioning(bucket string) (*VersioningConfiguration, error) {
+	c, err := f.bucketConfig(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if c.Versioning == nil {
+		return &VersioningConfiguration{}, nil
+	}
+	return c.Versioning, nil
+}
+
+func (f *FakeS3) PutBucketVersioning(bucket string, v VersioningConfiguration) error {
+	if v.Status != VersioningEnabled && v.Status != VersioningSuspended {
+		return fakeError(400, "IllegalVersioningConfigurationException", "illegal status: %q", v.Status)
+	}
+	return f.updateConfig(bucket, func(c *fakeConfig) error {
+		c.Versioning = &v
+		return nil
+	})
+}
+
+func (f *FakeS3) InitiateMultipart(req BasePut) (*Multipart, error) {
+	if err := checkObject(req.Object); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkBucket(req.Object.Bucket); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	m := &Multipart{Object: req.Object, UploadId: hex.EncodeToString(id)}
+	f.uploads[m.UploadId] = &fakeUpload{put: req, parts: make(map[int][]byte)}
+	return m, nil
+}
+
+func (f *FakeS3) upload(m Multipart) (*fakeUpload, error) {
+	if err := f.checkContext(); err != nil {
+		return nil, err
+	}
+	u, ok := f.uploads[m.UploadId]
+	if !ok || u.put.Object != m.Object {
+		return nil, fakeError(404, "NoSuchUpload", "no such upload: %q", m.UploadId)
+	}
+	return u, nil
+}
+
+func (f *FakeS3) UploadPart(req UploadPartRequest) (*Part, error) {
+	if err := checkMultipart(req.Multipart); err != nil {
+		return nil, err
+	}
+	if req.PartNumber < 1 || req.PartNumber > MaxParts {
+		return nil, fakeError(400, "InvalidArgument", "illegal part number: %d", req.PartNumber)
+	}
+	r, err := req.ReaderFact.CreateReader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	u, err := f.upload(req.Multipart)
+	if err != nil {
+		return nil, err
+	}
+	u.parts[req.PartNumber] = data
+	return &Part{PartNumber: req.PartNumber, ETag: md5Hex(data)}, nil
+}
+
+func (f *FakeS3) CompleteMultipart(req CompleteMultipartRequest) error {
+	if err := checkMultipart(req.Multipart); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errors.New("no parts")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	u, err := f.upload(req.Multipart)
+	if err != nil {
+		return err
+	}
+	parts := make([]Part, len(req.Parts))
+	copy(parts, req.Parts)
+	sort.Sort(byPartNumber(parts))
+	var data, sums []byte
+	for i, p := range parts {
+		b, ok := u.parts[p.PartNumber]
+		if !ok || md5Hex(b) != strings.Replace(p.ETag, `"`, "", -1) {
+			return fakeError(400, "InvalidPart", "invalid part: %d", p.PartNumber)
+		}
+		if i > 0 && p.PartNumber == parts[i-1].PartNumber {
+			return fakeError(400, "InvalidPartOrder", "duplicate part: %d", p.PartNumber)
+		}
+		if i < len(parts)-1 && len(b) < MinPartSize {
+			return fakeError(400, "EntityTooSmall", "part %d too small: %d bytes", p.PartNumber, len(b))
+		}
+		h := md5.Sum(b)
+		sums = append(sums, h[:]...)
+		data = append(data, b...)
+	}
+	if err := f.checkBucket(req.Object.Bucket); err != nil {
+		return err
+	}
+	etag := fmt.Sprintf("%s-%d", md5Hex(sums), len(parts))
+	if err := f.b.put(req.Object, data, newFakeMeta(u.put, data, etag)); err != nil {
+		return err
+	}
+	delete(f.uploads, req.UploadId)
+	return nil
+}
+
+type byPartNumber []Part
+
+func (p byPartNumber) Len() int {
+	return len(p)
+}
+func (p byPartNumber) Less(i, j int) bool {
+	return p[i].PartNumber < p[j].PartNumber
+}
+func (p byPartNumber) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (f *FakeS3) AbortMultipart(m Multipart) error {
+	if err := checkMultipart(m); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := f.upload(m); err != nil {
+		return err
+	}
+	delete(f.uploads, m.UploadId)
+	return nil
+}
+
+type memBackend struct {
+	m map[string]*memBucket
+}
+
+type memBucket struct {
+	created time.Time
+	objects map[string]memObject
+	config  fakeConfig
+}
+
+type memObject struct {
+	data []byte
+	meta fakeMeta
+}
+
+func (b *memBackend) buckets() (out []Bucket, err error) {
+	for name, x := range b.m {
+		out = append(out, Bucket{Name: name, CreationDate: goutil.FormatIsoUtc(x.created)})
+	}
+	sort.Sort(byBucketName(out))
+	return
+}
+
+func (b *memBackend) createBucket(name string, t time.Time) error {
+	if _, ok := b.m[name]; ok {
+		return fakeError(409, "BucketAlreadyOwnedByYou", "bucket already exists: %q", name)
+	}
+	b.m[name] = &memBucket{created: t, objects: make(map[string]memObject)}
+	return nil
+}
+
+func (b *memBackend) deleteBucket(name string) error {
+	delete(b.m, name)
+	return nil
+}
+
+func (b *memBackend) config(bucket string) (*fakeConfig, error) {
+	c, err := b.m[bucket].config.clone()
+	return &c, err
+}
+
+func (b *memBackend) setConfig(bucket string, c fakeConfig) error {
+	c, err := c.clone()
+	if err != nil {
+		return err
+	}
+	b.m[bucket].config = c
+	return nil
+}
+
+func (b *memBackend) hasBucket(name string) (bool, error) {
+	_, ok := b.m[name]
+	return ok, nil
+}
+
+func (b *memBackend) put(o Object, data []byte, m fakeMeta) error {
+	c := make([]byte, len(data))
+	copy(c, data)
+	b.m[o.Bucket].objects[o.Key] = memObject{data: c, meta: m.clone()}
+	return nil
+}
+
+func (b *memBackend) get(o Object) ([]byte, *fakeMeta, error) {
+	x, ok := b.m[o.Bucket].objects[o.Key]
+	if !ok {
+		return nil, nil, nil
+	}
+	m := x.meta.clone()
+	return x.data, &m, nil
+}
+
+func (b *memBackend) meta(o Object) (*fakeMeta, error) {
+	_, m, err := b.get(o)
+	return m, err
+}
+
+func (b *memBackend) del(o Object) error {
+	delete(b.m[o.Bucket].objects, o.Key)
+	return nil
+}
+
+func (b *memBackend) keys(bucket string) (out []string, err error) {
+	for k := range b.m[bucket].objects {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return
+}
+
+type byBucketName []Bucket
+
+func (b byBucketName) Len() int {
+	return len(b)
+}
+func (b byBucketName) Less(i, j int) bool {
+	return b[i].Name < b[j].Name
+}
+func (b byBucketName) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
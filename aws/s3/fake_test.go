@@ -0,0 +1,498 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xoba/goutil"
+)
+
+func fakes(t *testing.T) (map[string]*FakeS3, func()) {
+	dir, err := ioutil.TempDir("", "fakes3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewLocalS3(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]*FakeS3{"memory": NewMemoryS3(), "local": local}
+	for _, f := range out {
+		if err := f.MakeBucket("b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out, func() { os.RemoveAll(dir) }
+}
+
+func put(t *testing.T, i Interface, key, data string) {
+	err := i.PutObject(PutObjectRequest{BasePut: BasePut{Object: Object{"b", key}}, Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeObjects(t *testing.T) {
+	m, cleanup := fakes(t)
+	defer cleanup()
+	for name, f := range m {
+		put(t, f, "a b/c.txt", "hello")
+		h, err := f.Head(Object{"b", "a b/c.txt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ETag != "5d41402abc4b2a76b9719d911017c592" || h.ContentLength != 5 || h.ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("%s: bad head: %#v", name, h)
+		}
+		if err := f.Copy(CopyRequest{From: Object{"b", "a b/c.txt"}, To: Object{"b", "d"}}); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := f.GetObject(GetRequest{Object: Object{"b", "d"}, Range: &ByteRange{Start: 1, End: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ell" {
+			t.Errorf("%s: bad range: %q", name, buf)
+		}
+		if err := f.Delete(DeleteRequest{Object: Object{"b", "d"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Head(Object{"b", "d"}); err == nil {
+			t.Errorf("%s: deleted object still exists", name)
+		}
+		if _, err := f.Head(Object{"nosuchbucket", "d"}); err == nil {
+			t.Errorf("%s: failed to detect missing bucket", name)
+		}
+		if err := f.PutObject(PutObjectRequest{BasePut: BasePut{Object: Object{"b", "x"}, ContentMD5: "00000000000000000000000000000000"}, Data: []byte("x")}); err == nil {
+			t.Errorf("%s: failed to detect bad md5", name)
+		}
+
+		long := strings.Repeat("k", 1000)
+		for _, k := range []string{long, ".", ".."} {
+			put(t, f, k, "v")
+			if buf, err := f.GetObject(GetRequest{Object: Object{"b", k}}); err != nil || string(buf) != "v" {
+				t.Errorf("%s: bad get of %.10q: %q, %v", name, k, buf, err)
+			}
+		}
+		if l, err := f.List(ListRequest{Bucket: "b", Prefix: "kk"}); err != nil || len(l.Contents) != 1 || l.Contents[0].Key != long {
+			t.Errorf("%s: bad list of a long key: %v", name, err)
+		}
+		for _, b := range []string{".", "..", "a/b"} {
+			if err := f.PutObject(PutObjectRequest{BasePut: BasePut{Object: Object{b, "x"}}, Data: []byte("x")}); !IsCode(err, "InvalidBucketName") {
+				t.Errorf("%s: put to bucket %q: %v", name, b, err)
+			}
+			if _, err := f.List(ListRequest{Bucket: b}); !IsCode(err, "InvalidBucketName") {
+				t.Errorf("%s: list of bucket %q: %v", name, b, err)
+			}
+		}
+	}
+}
+
+func TestFakeList(t *testing.T) {
+	m, cleanup := fakes(t)
+	defer cleanup()
+	for name, f := range m {
+		for _, k := range []string{"a", "b/1", "b/2", "c/1", "d"} {
+			put(t, f, k, k)
+		}
+		r, err := f.List(ListRequest{Bucket: "b", Delimiter: "/", MaxKeys: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.IsTruncated || len(r.Contents) != 1 || len(r.CommonPrefixes) != 1 || r.NextMarker != "b/" {
+			t.Errorf("%s: bad list: %#v", name, r)
+		}
+		var keys []string
+		l := NewLister(f, ListV2Request{Bucket: "b", Delimiter: "/", MaxKeys: 1})
+		for l.Next() {
+			keys = append(keys, l.Key())
+		}
+		if err := l.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(keys) != "[a b/ c/ d]" {
+			t.Errorf("%s: bad keys: %v", name, keys)
+		}
+		b, err := f.Buckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b.Buckets) != 1 || b.Buckets[0].Name != "b" {
+			t.Errorf("%s: bad buckets: %#v", name, b)
+		}
+	}
+}
+
+func TestFakeUploadDownload(t *testing.T) {
+	m, cleanup := fakes(t)
+	defer cleanup()
+	data := make([]byte, 2*MinPartSize+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for name, f := range m {
+		o := Object{"b", "big"}
+		err := Upload(f, UploadRequest{
+			PutRequest: PutRequest{BasePut: BasePut{Object: o}, ReaderFact: goutil.BufferReaderFact{Buffer: data}},
+			Threshold:  MinPartSize,
+			PartSize:   MinPartSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := f.Head(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ContentLength != len(data) || h.ETag[len(h.ETag)-2:] != "-3" {
+			t.Errorf("%s: bad head: %#v", name, h)
+		}
+		var buf bytes.Buffer
+		if _, err := Download(f, DownloadRequest{GetRequest: GetRequest{Object: o}, PartSize: 1 << 20}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: bad download", name)
+		}
+		err = Upload(f, UploadRequest{
+			PutRequest: PutRequest{BasePut: BasePut{Object: o}, ReaderFact: failingFact{len(data)}},
+			Threshold:  MinPartSize,
+			PartSize:   MinPartSize,
+		})
+		if !errors.Is(err, errFailingFact) {
+			t.Errorf("%s: part error lost its identity: %v", name, err)
+		}
+	}
+}
+
+var errFailingFact = errors.New("can't read")
+
+// a reader factory whose readers can't be created
+type failingFact struct {
+	n int
+}
+
+func (f failingFact) CreateReader() (io.ReadCloser, error) {
+	return nil, errFailingFact
+}
+
+func (f failingFact) Len() int {
+	return f.n
+}
+
+func TestFakeMetadata(t *testing.T) {
+	f := NewMemoryS3()
+	f.MakeBucket("b")
+	o := Object{"b", "k"}
+	err := f.PutObject(PutObjectRequest{
+		BasePut: BasePut{
+			Object:       o,
+			CacheControl: "max-age=60",
+			Metadata:     map[string]string{"Color": "blue"},
+			StorageClass: "STANDARD_IA",
+			Encryption:   &Encryption{ServerSideEncryption: SSES3},
+		},
+		Data: []byte("x"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := f.Head(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Metadata["color"] != "blue" || h.CacheControl != "max-age=60" || h.StorageClass != "STANDARD_IA" || h.Encryption.ServerSideEncryption != SSES3 {
+		t.Errorf("bad head: %#v", h)
+	}
+	h.Metadata["color"], h.Encryption.ServerSideEncryption = "green", SSEKMS
+	if h, _ := f.Head(o); h.Metadata["color"] != "blue" || h.Encryption.ServerSideEncryption != SSES3 {
+		t.Errorf("changing a head changed the object: %#v", h)
+	}
+	to := Object{"b", "k2"}
+	err = f.Copy(CopyRequest{From: o, To: to, ReplaceMetadata: true, Headers: BasePut{Metadata: map[string]string{"color": "red"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := f.Head(to); h.Metadata["color"] != "red" || h.CacheControl != "" {
+		t.Errorf("failed to replace metadata: %#v", h)
+	}
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	h := make(http.Header)
+	BasePut{Object: Object{"b", "k.json"}, Metadata: map[string]string{"a-b": "c"}, Encryption: &Encryption{CustomerKey: make([]byte, 32)}}.addHeaders(h)
+	if h.Get("Content-Type") != "application/json" || h.Get("X-Amz-Meta-A-B") != "c" || h.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == "" {
+		t.Errorf("bad headers: %v", h)
+	}
+	if m := metadata(h); m["a-b"] != "c" {
+		t.Errorf("bad metadata: %v", m)
+	}
+}
+
+func TestFakeConditionsAndVersions(t *testing.T) {
+	m, cleanup := fakes(t)
+	defer cleanup()
+	for name, f := range m {
+		put(t, f, "k", "hello")
+		o := Object{"b", "k"}
+		h, err := f.Head(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.GetObject(GetRequest{Object: o, Conditions: Conditions{IfNoneMatch: h.ETag}}); !IsNotModified(err) {
+			t.Errorf("%s: expected not modified, got %v", name, err)
+		}
+		if _, err := f.HeadObject(HeadRequest{Object: o, Conditions: Conditions{IfModifiedSince: h.LastModified}}); !IsNotModified(err) {
+			t.Errorf("%s: expected not modified, got %v", name, err)
+		}
+		if _, err := f.GetObject(GetRequest{Object: o, Conditions: Conditions{IfMatch: `"other"`}}); !IsPreconditionFailed(err) {
+			t.Errorf("%s: expected precondition failure, got %v", name, err)
+		}
+		if buf, err := f.GetObject(GetRequest{Object: o, VersionId: NullVersion, Conditions: Conditions{IfMatch: `"` + h.ETag + `"`}}); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: bad get: %q, %v", name, buf, err)
+		}
+		if _, err := f.GetObject(GetRequest{Object: o, VersionId: "v1"}); !IsNoSuchVersion(err) {
+			t.Errorf("%s: expected no such version, got %v", name, err)
+		}
+		r, err := f.ListVersions(ListVersionsRequest{Bucket: "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Versions) != 1 || r.Versions[0].VersionId != NullVersion || !r.Versions[0].IsLatest {
+			t.Errorf("%s: bad versions: %#v", name, r)
+		}
+		if err := f.Delete(DeleteRequest{Object: o, VersionId: NullVersion}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Head(o); !IsNoSuchKey(err) {
+			t.Errorf("%s: expected no such key, got %v", name, err)
+		}
+	}
+}
+
+func TestFakeDeletePrefix(t *testing.T) {
+	m, cleanup := fakes(t)
+	defer cleanup()
+	for name, f := range m {
+		for i := 0; i < 25; i++ {
+			put(t, f, fmt.Sprintf("out/part-%05d", i), "x")
+		}
+		put(t, f, "other", "y")
+		r, err := f.DeleteObjects(DeleteObjectsRequest{Bucket: "b", Objects: []ObjectIdentifier{{Key: "out/part-00000"}, {Key: "missing"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Deleted) != 2 || r.Err() != nil {
+			t.Errorf("%s: bad result: %#v", name, r)
+		}
+		n, err := DeletePrefix(f, DeletePrefixRequest{Bucket: "b", Prefix: "out/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 24 {
+			t.Errorf("%s: deleted %d objects", name, n)
+		}
+		l, err := f.List(ListRequest{Bucket: "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Contents) != 1 || l.Contents[0].Key != "other" {
+			t.Errorf("%s: bad listing after delete: %#v", name, l)
+		}
+	}
+	if _, err := NewMemoryS3().DeleteObjects(DeleteObjectsRequest{Bucket: "b", Objects: make([]ObjectIdentifier, MaxDeleteObjects+1)}); err == nil {
+		t.Error("failed to detect too many objects")
+	}
+
+	// errors keep their types
+	r := DeleteObjectsResult{Errors: []DeleteError{{Key: "a", Code: "AccessDenied"}, {Key: "b", Code: "AccessDenied"}}}
+	var de DeleteError
+	if err := r.Err(); !errors.As(err, &de) || de.Key != "a" {
+		t.Errorf("bad result error: %v", err)
+	}
+	f := NewMemoryS3()
+	f.MakeBucket("b")
+	for i := 0; i < 2*MaxDeleteObjects; i++ {
+		put(t, f, fmt.Sprintf("k%05d", i), "x")
+	}
+	if n, err := DeletePrefix(failingDeletes{f}, DeletePrefixRequest{Bucket: "b"}); n != 0 || !IsCode(err, "SlowDown") {
+		t.Errorf("bad failed delete: %d, %v", n, err)
+	}
+}
+
+// fails every DeleteObjects request
+type failingDeletes struct {
+	*FakeS3
+}
+
+func (f failingDeletes) DeleteObjects(req DeleteObjectsRequest) (*DeleteObjectsResult, error) {
+	return nil, &Error{StatusCode: 503, Code: "SlowDown", Message: "Please reduce your request rate."}
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		file := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(file), os.ModePerm)
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "a")
+	write("sub/b.txt", "b")
+	write("skip.log", "log")
+	f := NewMemoryS3()
+	f.MakeBucket("b")
+	put(t, f, "p/old.txt", "old")
+	put(t, f, "p/a.txt", "x")
+
+	req := SyncRequest{Dir: dir, Bucket: "b", Prefix: "p", Delete: true, Exclude: []string{"*.log"}, DryRun: true}
+	actions, err := Sync(f, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(actions) != "[upload: a.txt (1 bytes) delete: old.txt (3 bytes) upload: sub/b.txt (1 bytes)]" {
+		t.Errorf("bad dry run: %v", actions)
+	}
+	if _, err := f.Head(Object{"b", "p/old.txt"}); err != nil {
+		t.Errorf("dry run deleted: %v", err)
+	}
+	req.DryRun = false
+	if _, err := Sync(f, req); err != nil {
+		t.Fatal(err)
+	}
+	if actions, err := Sync(f, req); err != nil || len(actions) != 0 {
+		t.Errorf("expected nothing more to do: %v, %v", actions, err)
+	}
+
+	// a kms etag isn't an md5, so the older local file is taken to be the same
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "a.txt"), old, old)
+	err = f.PutObject(PutObjectRequest{BasePut: BasePut{Object: Object{"b", "p/a.txt"}, Encryption: &Encryption{ServerSideEncryption: SSEKMS}}, Data: []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions, err := Sync(f, req); err != nil || len(actions) != 0 {
+		t.Errorf("expected kms object to be the same: %v, %v", actions, err)
+	}
+
+	down := filepath.Join(dir, "down")
+	req = SyncRequest{Dir: down, Bucket: "b", Prefix: "p/", Direction: SyncDown, Include: []string{"sub/*"}}
+	if _, err := Sync(f, req); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(down, "sub", "b.txt")); err != nil || string(buf) != "b" {
+		t.Errorf("bad download: %q, %v", buf, err)
+	}
+	if _, err := os.Stat(filepath.Join(down, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("include failed: %v", err)
+	}
+	if actions, err := Sync(f, req); err != nil || len(actions) != 0 {
+		t.Errorf("expected nothing more to do: %v, %v", actions, err)
+	}
+
+	put(t, f, "p/..", "x")
+	put(t, f, "p/../evil.txt", "x")
+	req = SyncRequest{Dir: down, Bucket: "b", Prefix: "p", Direction: SyncDown}
+	if actions, err := Sync(f, req); err != nil || fmt.Sprint(actions) != "[download: a.txt (1 bytes)]" {
+		t.Errorf("bad download of unsafe keys: %v, %v", actions, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("downloaded outside the directory: %v", err)
+	}
+
+	// errors keep their types
+	write("new.txt", "new")
+	req = SyncRequest{Dir: dir, Bucket: "b", Prefix: "p", Direction: SyncUp}
+	if _, err := Sync(failingPuts{f}, req); !IsCode(err, "AccessDenied") {
+		t.Errorf("expected access denied: %v", err)
+	}
+}
+
+// fails every put
+type failingPuts struct {
+	*FakeS3
+}
+
+func (f failingPuts) Put(req PutRequest) error {
+	return &Error{StatusCode: 403, Code: "AccessDenied", Message: "Access Denied"}
+}
+
+func TestFakeBucketConfig(t *testing.T) {
+	m, cleanup := fakes(t)
+	defer cleanup()
+	for name, f := range m {
+		if err := f.CreateBucket(CreateBucketRequest{Bucket: "c", Region: "us-west-2"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.GetBucketPolicy("c"); !IsCode(err, "NoSuchBucketPolicy") {
+			t.Errorf("%s: expected no policy, got %v", name, err)
+		}
+		if err := f.MakePublic("c"); err != nil {
+			t.Fatal(err)
+		}
+		if !f.IsPublic("c") || f.IsPublic("b") {
+			t.Errorf("%s: bad public status", name)
+		}
+		lc := LifecycleConfiguration{Rules: []LifecycleRule{{ID: "tmp", Status: "Enabled", Filter: LifecycleFilter{Prefix: "tmp/"}, Expiration: &LifecycleExpiration{Days: 7}}}}
+		if err := f.PutBucketLifecycle("c", lc); err != nil {
+			t.Fatal(err)
+		}
+		lc.Rules[0].Expiration.Days = 8
+		l, err := f.GetBucketLifecycle("c")
+		if err != nil || len(l.Rules) != 1 || l.Rules[0].Expiration.Days != 7 {
+			t.Errorf("%s: bad lifecycle: %#v, %v", name, l, err)
+		}
+		l.Rules[0].Status = "Disabled"
+		if l, _ := f.GetBucketLifecycle("c"); l.Rules[0].Status != "Enabled" {
+			t.Errorf("%s: changing a lifecycle changed the bucket's", name)
+		}
+		p, err := f.GetBucketPolicy("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Statement[0].Effect = "Deny"
+		if p, _ := f.GetBucketPolicy("c"); p.Statement[0].Effect != "Allow" {
+			t.Errorf("%s: changing a policy changed the bucket's", name)
+		}
+		cors := CORSConfiguration{Rules: []CORSRule{{AllowedMethods: []string{"GET"}, AllowedOrigins: []string{"*"}}}}
+		if err := f.PutBucketCors("c", cors); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.DeleteBucketCors("c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.GetBucketCors("c"); !IsCode(err, "NoSuchCORSConfiguration") {
+			t.Errorf("%s: expected no cors, got %v", name, err)
+		}
+		if err := f.PutBucketVersioning("c", VersioningConfiguration{Status: VersioningEnabled}); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := f.GetBucketVersioning("c"); err != nil || v.Status != VersioningEnabled {
+			t.Errorf("%s: bad versioning: %#v, %v", name, v, err)
+		}
+		put(t, f, "k", "x")
+		if err := f.DeleteBucket("b"); !IsCode(err, "BucketNotEmpty") {
+			t.Errorf("%s: expected bucket not empty, got %v", name, err)
+		}
+		if err := f.DeleteBucket("c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.GetBucketVersioning("c"); !IsNoSuchBucket(err) {
+			t.Errorf("%s: expected no such bucket, got %v", name, err)
+		}
+	}
+}
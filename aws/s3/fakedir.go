@@ -0,0 +1,235 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xoba/goutil"
+)
+
+// a fake whose buckets are subdirectories of dir. each bucket directory holds object
+// contents under "data" and metadata under "meta", with keys escaped as file names (or
+// hashed, when too long), and bucket configuration in "config.json".
+func NewLocalS3(dir string) (*FakeS3, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return newFake(dirBackend(dir)), nil
+}
+
+type dirBackend string
+
+func (d dirBackend) bucketDir(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+func (d dirBackend) dataPath(o Object) string {
+	return filepath.Join(d.bucketDir(o.Bucket), "data", fileName(o.Key))
+}
+
+func (d dirBackend) metaPath(o Object) string {
+	return filepath.Join(d.bucketDir(o.Bucket), "meta", fileName(o.Key))
+}
+
+const (
+	// the longest file name most file systems allow
+	maxNameLen = 255
+
+	// starts the names of hashed keys; can't collide with escaped keys either
+	hashPrefix = "%hash"
+)
+
+// a key's file name: the escaped key, unless that's too long or "." or "..", in
+// which case it's a hash of the key, and the key is kept in the object's metadata
+func fileName(key string) string {
+	name := escape(key)
+	if len(name) <= maxNameLen && name != "." && name != ".." {
+		return name
+	}
+	h := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(h[:])
+}
+
+func (d dirBackend) buckets() (out []Bucket, err error) {
+	list, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range list {
+		if fi.IsDir() {
+			out = append(out, Bucket{Name: fi.Name(), CreationDate: goutil.FormatIsoUtc(fi.ModTime())})
+		}
+	}
+	sort.Sort(byBucketName(out))
+	return
+}
+
+func (d dirBackend) createBucket(name string, t time.Time) error {
+	if ok, err := d.hasBucket(name); err != nil {
+		return err
+	} else if ok {
+		return fakeError(409, "BucketAlreadyOwnedByYou", "bucket already exists: %q", name)
+	}
+	for _, sub := range []string{"data", "meta"} {
+		if err := os.MkdirAll(filepath.Join(d.bucketDir(name), sub), 0755); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(d.bucketDir(name), t, t)
+}
+
+func (d dirBackend) deleteBucket(name string) error {
+	return os.RemoveAll(d.bucketDir(name))
+}
+
+func (d dirBackend) configPath(bucket string) string {
+	return filepath.Join(d.bucketDir(bucket), "config.json")
+}
+
+func (d dirBackend) config(bucket string) (*fakeConfig, error) {
+	var c fakeConfig
+	buf, err := ioutil.ReadFile(d.configPath(bucket))
+	switch {
+	case os.IsNotExist(err):
+		return &c, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (d dirBackend) setConfig(bucket string, c fakeConfig) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFile(d.configPath(bucket), buf)
+}
+
+func (d dirBackend) hasBucket(name string) (bool, error) {
+	fi, err := os.Stat(d.bucketDir(name))
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+// can't collide with escaped keys, since it's not a valid escape sequence
+const tmpPrefix = "%tmp"
+
+// writes via a temporary file, so readers never see partial contents
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), tmpPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d dirBackend) put(o Object, data []byte, m fakeMeta) error {
+	m.Key = ""
+	if strings.HasPrefix(fileName(o.Key), hashPrefix) {
+		m.Key = o.Key
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(d.dataPath(o), data); err != nil {
+		return err
+	}
+	return writeFile(d.metaPath(o), buf)
+}
+
+func (d dirBackend) get(o Object) ([]byte, *fakeMeta, error) {
+	m, err := d.meta(o)
+	if err != nil || m == nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(d.dataPath(o))
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, m, nil
+}
+
+func (d dirBackend) meta(o Object) (*fakeMeta, error) {
+	return readMeta(d.metaPath(o))
+}
+
+func readMeta(path string) (*fakeMeta, error) {
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var m fakeMeta
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (d dirBackend) del(o Object) error {
+	for _, p := range []string{d.metaPath(o), d.dataPath(o)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d dirBackend) keys(bucket string) (out []string, err error) {
+	list, err := ioutil.ReadDir(filepath.Join(d.bucketDir(bucket), "meta"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range list {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tmpPrefix) {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), hashPrefix) {
+			m, err := readMeta(filepath.Join(d.bucketDir(bucket), "meta", fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if m == nil {
+				continue
+			}
+			out = append(out, m.Key)
+			continue
+		}
+		k, err := url.PathUnescape(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return
+}
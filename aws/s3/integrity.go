@@ -0,0 +1,218 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// how uploads are checked for corruption
+type ChecksumAlgorithm string
+
+const (
+	// hashed while streaming and compared with the etag s3 returns
+	ChecksumMD5 ChecksumAlgorithm = "MD5"
+
+	// computed while streaming and sent after the body, as a trailer, for s3 to check
+	ChecksumSHA256 ChecksumAlgorithm = "SHA256"
+	ChecksumCRC32C ChecksumAlgorithm = "CRC32C"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (a ChecksumAlgorithm) newHash() (hash.Hash, error) {
+	switch a {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(castagnoli), nil
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm: %q", a)
+}
+
+// the header s3 checks the algorithm's base64 digest against
+func (a ChecksumAlgorithm) header() string {
+	switch a {
+	case ChecksumSHA256:
+		return "X-Amz-Checksum-Sha256"
+	case ChecksumCRC32C:
+		return "X-Amz-Checksum-Crc32c"
+	}
+	return "Content-MD5"
+}
+
+// data that doesn't match its checksum, as when it was corrupted in transit
+type ChecksumError struct {
+	Object           Object
+	Algorithm        ChecksumAlgorithm
+	Expected, Actual string // hex
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("s3: %s mismatch for %s/%s: expected %s, got %s", e.Algorithm, e.Object.Bucket, e.Object.Key, e.Expected, e.Actual)
+}
+
+// retrying may fetch or send the data intact
+func (e *ChecksumError) Temporary() bool {
+	return true
+}
+
+func IsChecksumMismatch(err error) bool {
+	var e *ChecksumError
+	return errors.As(err, &e)
+}
+
+// the size of the chunks a body with a trailing checksum is sent in
+const trailerChunkSize = 64 << 10
+
+// encodes a body as unsigned aws-chunked chunks, summing it as it's read, then ends
+// with the checksum as a trailing header, base64-encoded, as s3 wants it:
+//
+//	5\r\nhello\r\n0\r\nx-amz-checksum-crc32c:mnG7TA==\r\n\r\n
+type trailingReader struct {
+	r    io.Reader
+	a    ChecksumAlgorithm
+	h    hash.Hash
+	buf  []byte // holds a chunk's data as it's read
+	out  []byte // encoded but not yet returned
+	done bool
+}
+
+func newTrailingReader(r io.Reader, a ChecksumAlgorithm) (*trailingReader, error) {
+	h, err := a.newHash()
+	if err != nil {
+		return nil, err
+	}
+	return &trailingReader{r: r, a: a, h: h, buf: make([]byte, trailerChunkSize)}, nil
+}
+
+// the trailing header's name
+func (t *trailingReader) trailer() string {
+	return strings.ToLower(t.a.header())
+}
+
+// the length of the encoded body, for n bytes of data
+func (t *trailingReader) length(n int64) int64 {
+	chunk := func(n int64) int64 {
+		return int64(len(strconv.FormatInt(n, 16))) + 2 + n + 2
+	}
+	size := int64(trailerChunkSize)
+	length := (n / size) * chunk(size)
+	if rest := n % size; rest > 0 {
+		length += chunk(rest)
+	}
+	return length + int64(len("0\r\n")+len(t.trailer())+1+base64.StdEncoding.EncodedLen(t.h.Size())+len("\r\n\r\n"))
+}
+
+func (t *trailingReader) Read(p []byte) (int, error) {
+	for len(t.out) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(t.r, t.buf)
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+		default:
+			return 0, err
+		}
+		t.h.Write(t.buf[:n])
+		t.out = append(t.out, strconv.FormatInt(int64(n), 16)+"\r\n"...)
+		t.out = append(t.out, t.buf[:n]...)
+		t.out = append(t.out, "\r\n"...)
+		if n == 0 {
+			t.out = t.out[:len(t.out)-2]
+			t.out = append(t.out, t.trailer()+":"+base64.StdEncoding.EncodeToString(t.h.Sum(nil))+"\r\n\r\n"...)
+			t.done = true
+		}
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+var md5ETag = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// whether an etag is the md5 of an object's contents, which isn't so for
+// multipart uploads or objects encrypted with kms or a customer key
+func verifiableETag(etag string, h http.Header) bool {
+	return md5ETag.MatchString(etag) &&
+		h.Get("X-Amz-Server-Side-Encryption") != SSEKMS &&
+		h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == ""
+}
+
+// the etag if it's the md5 of the object's contents, otherwise empty
+func (h *HeadResponse) md5() string {
+	if !md5ETag.MatchString(h.ETag) || (h.Encryption != nil && h.Encryption.ServerSideEncryption == SSEKMS) {
+		return ""
+	}
+	return h.ETag
+}
+
+// hashes what's read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func newMD5Reader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: md5.New()}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) hex() string {
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+// checks the md5 of what was sent, if known, against the etag s3 returned
+func checkSent(o Object, sent *hashingReader, resp *http.Response) error {
+	if sent == nil {
+		return nil
+	}
+	etag := unquoteETag(resp.Header.Get("Etag"))
+	if !verifiableETag(etag, resp.Header) {
+		return nil
+	}
+	if sum := sent.hex(); sum != etag {
+		return &ChecksumError{Object: o, Algorithm: ChecksumMD5, Expected: sum, Actual: etag}
+	}
+	return nil
+}
+
+// fails the read with a *ChecksumError at eof if the md5 of what was read isn't etag
+type verifyingReader struct {
+	io.ReadCloser
+	hashingReader
+	o    Object
+	etag string
+}
+
+func newVerifyingReader(r io.ReadCloser, o Object, etag string) *verifyingReader {
+	return &verifyingReader{ReadCloser: r, hashingReader: *newMD5Reader(r), o: o, etag: etag}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.hashingReader.Read(p)
+	if err == io.EOF {
+		if sum := r.hex(); sum != r.etag {
+			return n, &ChecksumError{Object: r.o, Algorithm: ChecksumMD5, Expected: r.etag, Actual: sum}
+		}
+	}
+	return n, err
+}
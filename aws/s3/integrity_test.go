@@ -0,0 +1,112 @@
+package s3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws"
+)
+
+func TestTrailingReader(t *testing.T) {
+	big := strings.Repeat("x", trailerChunkSize+1)
+	for _, test := range []struct {
+		a        ChecksumAlgorithm
+		data     string
+		expected string
+	}{
+		{ChecksumSHA256, "hello", "5\r\nhello\r\n0\r\nx-amz-checksum-sha256:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=\r\n\r\n"},
+		{ChecksumCRC32C, "hello", "5\r\nhello\r\n0\r\nx-amz-checksum-crc32c:mnG7TA==\r\n\r\n"},
+		{ChecksumCRC32C, "", "0\r\nx-amz-checksum-crc32c:AAAAAA==\r\n\r\n"},
+		{ChecksumCRC32C, big, "10000\r\n" + big[1:] + "\r\n1\r\nx\r\n0\r\nx-amz-checksum-crc32c:unrwZg==\r\n\r\n"},
+	} {
+		r, err := newTrailingReader(strings.NewReader(test.data), test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := r.length(int64(len(test.data)))
+		buf, err := ioutil.ReadAll(r)
+		if err != nil || string(buf) != test.expected || int64(len(buf)) != n {
+			tail := string(buf)
+			if len(tail) > 80 {
+				tail = "..." + tail[len(tail)-80:]
+			}
+			t.Errorf("bad %s encoding of %d bytes: %q, of %d bytes, not %d; %v", test.a, len(test.data), tail, len(buf), n, err)
+		}
+	}
+	if _, err := newTrailingReader(strings.NewReader(""), "bogus"); err == nil {
+		t.Error("failed to detect bogus algorithm")
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	o := Object{"b", "k"}
+	r := newVerifyingReader(ioutil.NopCloser(strings.NewReader("hello")), o, "5d41402abc4b2a76b9719d911017c592")
+	if buf, err := ioutil.ReadAll(r); err != nil || string(buf) != "hello" {
+		t.Errorf("bad read: %q, %v", buf, err)
+	}
+	r = newVerifyingReader(ioutil.NopCloser(strings.NewReader("hellO")), o, "5d41402abc4b2a76b9719d911017c592")
+	if _, err := ioutil.ReadAll(r); !IsChecksumMismatch(err) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestPutChecksum(t *testing.T) {
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		// as if the body were corrupted in transit
+		w.Header().Set("Etag", `"00000000000000000000000000000000"`)
+	}))
+	defer server.Close()
+	s := SmartS3{
+		Auth:     aws.Auth{AccessKey: "a", SecretKey: "s"},
+		Strat:    goutil.RetryBackoffStrat{Delay: time.Millisecond, Retries: 1},
+		Endpoint: server.URL,
+	}
+	put := func(a ChecksumAlgorithm) error {
+		return s.PutObject(PutObjectRequest{BasePut: BasePut{Object: Object{"b", "k"}, Checksum: a}, Data: []byte("hello")})
+	}
+	if err := put(ChecksumMD5); !IsChecksumMismatch(err) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	// the checksum is computed while streaming, so the reader needn't be read twice
+	err := s.Put(PutRequest{
+		BasePut:    BasePut{Object: Object{"b", "k"}, Checksum: ChecksumSHA256},
+		ReaderFact: goutil.NewSingleReaderFact(strings.NewReader("hello"), 5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Amz-Trailer") != "x-amz-checksum-sha256" || header.Get("X-Amz-Decoded-Content-Length") != "5" ||
+		header.Get("Content-Encoding") != "aws-chunked" || header.Get("X-Amz-Content-Sha256") != aws.StreamingUnsignedTrailer {
+		t.Errorf("bad headers: %v", header)
+	}
+	if !strings.HasSuffix(string(body), "x-amz-checksum-sha256:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=\r\n\r\n") {
+		t.Errorf("bad body: %q", body)
+	}
+}
+
+func TestDownloadVerification(t *testing.T) {
+	f := NewMemoryS3()
+	f.MakeBucket("b")
+	put(t, f, "k", "hello")
+	o := Object{"b", "k"}
+	if _, err := Download(f, DownloadRequest{GetRequest: GetRequest{Object: o}, PartSize: 2}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	req := DownloadRequest{GetRequest: GetRequest{Object: o}, Size: 5, ETag: `"00000000000000000000000000000000"`}
+	if _, err := Download(f, req, ioutil.Discard); !IsChecksumMismatch(err) {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	req.NoVerify = true
+	if _, err := Download(f, req, ioutil.Discard); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+type ListV2Request struct {
+	Bucket            string
+	Prefix            string
+	Delimiter         string
+	MaxKeys           int64
+	StartAfter        string
+	ContinuationToken string
+}
+
+type ListV2Result struct {
+	Name, Prefix, Delimiter, StartAfter      string
+	ContinuationToken, NextContinuationToken string
+	KeyCount, MaxKeys                        int64
+	IsTruncated                              bool
+	Contents                                 []ListBucketResultContents
+	CommonPrefixes                           []CommonPrefix
+}
+
+func (s SmartS3) ListV2(req ListV2Request) (ListV2Result, error) {
+	var out ListV2Result
+	if req.Bucket == "" {
+		return out, errors.New("no bucket name")
+	}
+	f := func() (interface{}, error) {
+		return s.listV2(req)
+	}
+	v, err := s.retry(str(req), f)
+	if err != nil {
+		return out, err
+	}
+	return v.(ListV2Result), nil
+}
+
+func (s SmartS3) listV2(req ListV2Request) (out ListV2Result, err error) {
+	query := make(url.Values)
+	query.Set("list-type", "2")
+	if req.MaxKeys > 0 {
+		query.Set("max-keys", fmt.Sprintf("%d", req.MaxKeys))
+	}
+	if req.Prefix != "" {
+		query.Set("prefix", req.Prefix)
+	}
+	if req.Delimiter != "" {
+		query.Set("delimiter", req.Delimiter)
+	}
+	if req.StartAfter != "" {
+		query.Set("start-after", req.StartAfter)
+	}
+	if req.ContinuationToken != "" {
+		query.Set("continuation-token", req.ContinuationToken)
+	}
+	u, err := s.createURL(Object{Bucket: req.Bucket})
+	if err != nil {
+		return
+	}
+	u.RawQuery = encodeQuery(query)
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("GET", u.String(), nil)
+	if err != nil {
+		return
+	}
+	if err = s.sign(hreq, emptySHA256); err != nil {
+		return
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return out, responseError(resp)
+	}
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, resp.Body); err != nil {
+		return
+	}
+	err = xml.Unmarshal(buf.Bytes(), &out)
+	return
+}
+
+// streams the objects and common prefixes of a listing, a page at a time, like bufio.Scanner:
+//
+//	l := s3.NewLister(ss3, s3.ListV2Request{Bucket: "b", Delimiter: "/"})
+//	for l.Next() {
+//		if p := l.Prefix(); p != "" { ... } else { o := l.Object() ... }
+//	}
+//	if err := l.Err(); err != nil { ... }
+type Lister struct {
+	i       Interface
+	req     ListV2Request
+	entries []listEntry
+	current listEntry
+	started bool
+	more    bool
+	err     error
+}
+
+type listEntry struct {
+	object ListedObject
+	prefix string
+}
+
+func (e listEntry) key() string {
+	if e.prefix != "" {
+		return e.prefix
+	}
+	return e.object.Key
+}
+
+func NewLister(i Interface, req ListV2Request) *Lister {
+	return &Lister{i: i, req: req}
+}
+
+// advances to the next object or common prefix, returning false when done or on error
+func (l *Lister) Next() bool {
+	for len(l.entries) == 0 {
+		if l.err != nil || (l.started && !l.more) {
+			return false
+		}
+		l.fetch()
+	}
+	l.current = l.entries[0]
+	l.entries = l.entries[1:]
+	return true
+}
+
+func (l *Lister) fetch() {
+	r, err := l.i.ListV2(l.req)
+	l.started = true
+	if err != nil {
+		l.err = err
+		return
+	}
+	l.more = r.IsTruncated && r.NextContinuationToken != ""
+	l.req.ContinuationToken = r.NextContinuationToken
+
+	// merge objects and prefixes, which are each sorted already
+	c, p := r.Contents, r.CommonPrefixes
+	for len(c) > 0 || len(p) > 0 {
+		switch {
+		case len(p) == 0 || (len(c) > 0 && c[0].Key < p[0].Prefix):
+			l.entries = append(l.entries, listEntry{object: ListedObject{ListBucketResultContents: c[0], Bucket: l.req.Bucket}})
+			c = c[1:]
+		default:
+			l.entries = append(l.entries, listEntry{prefix: p[0].Prefix})
+			p = p[1:]
+		}
+	}
+}
+
+// the current object, unless the current entry is a common prefix
+func (l *Lister) Object() ListedObject {
+	return l.current.object
+}
+
+// the current common prefix, or empty if the current entry is an object
+func (l *Lister) Prefix() string {
+	return l.current.prefix
+}
+
+// key of the current object, or the current common prefix
+func (l *Lister) Key() string {
+	return l.current.key()
+}
+
+// the first error encountered, if any
+func (l *Lister) Err() error {
+	return l.err
+}
@@ -0,0 +1,110 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// values for Encryption.ServerSideEncryption
+	SSES3  = "AES256"
+	SSEKMS = "aws:kms"
+
+	metaPrefix = "X-Amz-Meta-"
+)
+
+// server-side encryption: SSE-S3, SSE-KMS, or SSE-C with a customer-provided key
+type Encryption struct {
+	ServerSideEncryption string `json:",omitempty"` // SSES3 or SSEKMS; empty for SSE-C
+	KMSKeyId             string `json:",omitempty"` // optional for SSEKMS
+	CustomerKey          []byte `json:"-"`          // 256-bit key for SSE-C
+}
+
+// headers common to puts, copies and multipart initiations
+func (b BasePut) addHeaders(h http.Header) {
+	ct := b.ContentType
+	if len(ct) == 0 {
+		ct = mimeType(b.Object.Key)
+	}
+	if len(ct) > 0 {
+		h.Add("Content-Type", ct)
+	}
+	if len(b.ContentEncoding) > 0 {
+		h.Add("Content-Encoding", b.ContentEncoding)
+	}
+	if len(b.CacheControl) > 0 {
+		h.Add("Cache-Control", b.CacheControl)
+	}
+	if len(b.ContentDisposition) > 0 {
+		h.Add("Content-Disposition", b.ContentDisposition)
+	}
+	for k, v := range b.Metadata {
+		h.Add(metaPrefix+k, v)
+	}
+	b.addStorageHeaders(h)
+}
+
+func (b BasePut) addStorageHeaders(h http.Header) {
+	if len(b.StorageClass) > 0 {
+		h.Add("X-Amz-Storage-Class", b.StorageClass)
+	}
+	if e := b.Encryption; e != nil {
+		if len(e.ServerSideEncryption) > 0 {
+			h.Add("X-Amz-Server-Side-Encryption", e.ServerSideEncryption)
+		}
+		if len(e.KMSKeyId) > 0 {
+			h.Add("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", e.KMSKeyId)
+		}
+		e.addCustomerHeaders(h, "")
+	}
+}
+
+func (c CopyRequest) addHeaders(h http.Header) {
+	if c.ReplaceMetadata {
+		h.Add("X-Amz-Metadata-Directive", "REPLACE")
+		c.Headers.Object = c.To
+		c.Headers.addHeaders(h)
+	} else {
+		c.Headers.addStorageHeaders(h)
+	}
+	c.SourceEncryption.addCustomerHeaders(h, "Copy-Source-")
+}
+
+// adds SSE-C headers if there's a customer key; e may be nil
+func (e *Encryption) addCustomerHeaders(h http.Header, prefix string) {
+	if e == nil || len(e.CustomerKey) == 0 {
+		return
+	}
+	sum := md5.Sum(e.CustomerKey)
+	h.Add("X-Amz-"+prefix+"Server-Side-Encryption-Customer-Algorithm", "AES256")
+	h.Add("X-Amz-"+prefix+"Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(e.CustomerKey))
+	h.Add("X-Amz-"+prefix+"Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// user metadata from response headers, or nil if none
+func metadata(h http.Header) map[string]string {
+	var out map[string]string
+	for k, v := range h {
+		if strings.HasPrefix(k, metaPrefix) && len(v) > 0 {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[strings.ToLower(k[len(metaPrefix):])] = v[0]
+		}
+	}
+	return out
+}
+
+// encryption reported by response headers, or nil if none
+func encryption(h http.Header) *Encryption {
+	sse := h.Get("X-Amz-Server-Side-Encryption")
+	if sse == "" {
+		return nil
+	}
+	return &Encryption{
+		ServerSideEncryption: sse,
+		KMSKeyId:             h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+	}
+}
@@ -0,0 +1,429 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws"
+)
+
+const (
+	// smallest part s3 accepts, except for the last one
+	MinPartSize = 5 * 1024 * 1024
+
+	// most parts s3 accepts in one upload
+	MaxParts = 10000
+
+	DefaultPartSize           = 8 * 1024 * 1024
+	DefaultMultipartThreshold = 16 * 1024 * 1024
+	DefaultUploadConcurrency  = 4
+)
+
+// an in-progress multipart upload
+type Multipart struct {
+	Object   Object
+	UploadId string
+}
+
+type UploadPartRequest struct {
+	Multipart
+	PartNumber int // from 1 to MaxParts
+	ReaderFact goutil.ReaderFactory
+	Encryption *Encryption // only needed for SSE-C, with the same key as the initiation
+	Verify     bool        // check the part's etag against the md5 of what was sent
+}
+
+type Part struct {
+	PartNumber int
+	ETag       string
+}
+
+type CompleteMultipartRequest struct {
+	Multipart
+	Parts []Part
+}
+
+type UploadRequest struct {
+	PutRequest
+	Threshold   int // objects larger than this use multipart; zero means DefaultMultipartThreshold
+	PartSize    int // zero means DefaultPartSize, grown as needed to fit within MaxParts
+	Concurrency int // parts uploaded at once; zero means DefaultUploadConcurrency
+}
+
+// puts req.ReaderFact, as a multipart upload with parts in parallel if it's larger than the threshold.
+// for multipart, the reader factory must be able to create more than one reader.
+// parts are retried individually per i's retry strategy, and the upload is aborted on failure.
+func Upload(i Interface, req UploadRequest) error {
+	if err := checkObject(req.Object); err != nil {
+		return err
+	}
+	n := req.ReaderFact.Len()
+	threshold := req.Threshold
+	if threshold <= 0 {
+		threshold = DefaultMultipartThreshold
+	}
+	if n <= threshold {
+		return i.Put(req.PutRequest)
+	}
+	partSize := req.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	for (n+partSize-1)/partSize > MaxParts {
+		partSize *= 2
+	}
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultUploadConcurrency
+	}
+
+	m, err := i.InitiateMultipart(req.BasePut)
+	if err != nil {
+		return err
+	}
+
+	count := (n + partSize - 1) / partSize
+	parts := make([]Part, count)
+
+	var lock sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+
+	q := goutil.NewWorkQueue(concurrency)
+	for p := 0; p < count; p++ {
+		p := p
+		q.Submit(func() {
+			if failed() {
+				return
+			}
+			off := p * partSize
+			size := partSize
+			if off+size > n {
+				size = n - off
+			}
+			part, err := i.UploadPart(UploadPartRequest{
+				Multipart:  *m,
+				PartNumber: p + 1,
+				ReaderFact: NewSectionReaderFact(req.ReaderFact, off, size),
+				Encryption: req.Encryption,
+				Verify:     req.Checksum != "",
+			})
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("part %d: %w", p+1, err)
+				}
+				return
+			}
+			parts[p] = *part
+		})
+	}
+	q.Wait()
+
+	if firstErr != nil {
+		i.AbortMultipart(*m)
+		return firstErr
+	}
+	if err := i.CompleteMultipart(CompleteMultipartRequest{Multipart: *m, Parts: parts}); err != nil {
+		i.AbortMultipart(*m)
+		return err
+	}
+	return nil
+}
+
+// a reader factory for length bytes of rf, starting at offset
+func NewSectionReaderFact(rf goutil.ReaderFactory, offset, length int) goutil.ReaderFactory {
+	if b, ok := rf.(goutil.BufferReaderFact); ok {
+		return goutil.BufferReaderFact{Buffer: b.Buffer[offset : offset+length]}
+	}
+	return sectionReaderFact{rf: rf, offset: offset, length: length}
+}
+
+type sectionReaderFact struct {
+	rf             goutil.ReaderFactory
+	offset, length int
+}
+
+func (f sectionReaderFact) Len() int {
+	return f.length
+}
+
+func (f sectionReaderFact) CreateReader() (io.ReadCloser, error) {
+	r, err := f.rf.CreateReader()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err = s.Seek(int64(f.offset), io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, r, int64(f.offset))
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return limitedReadCloser{Reader: io.LimitReader(r, int64(f.length)), Closer: r}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s SmartS3) InitiateMultipart(req BasePut) (*Multipart, error) {
+	if err := checkObject(req.Object); err != nil {
+		return nil, err
+	}
+	f := func() (interface{}, error) {
+		return s.initiateMultipart(req)
+	}
+	v, err := s.retry(str(req), f)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Multipart), nil
+}
+
+func (s SmartS3) UploadPart(req UploadPartRequest) (*Part, error) {
+	if err := checkMultipart(req.Multipart); err != nil {
+		return nil, err
+	}
+	if req.PartNumber < 1 || req.PartNumber > MaxParts {
+		return nil, fmt.Errorf("illegal part number: %d", req.PartNumber)
+	}
+	f := func() (interface{}, error) {
+		return s.uploadPart(req)
+	}
+	v, err := s.retry(fmt.Sprintf("part %d of %s", req.PartNumber, str(req.Multipart)), f)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Part), nil
+}
+
+func (s SmartS3) CompleteMultipart(req CompleteMultipartRequest) error {
+	if err := checkMultipart(req.Multipart); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errors.New("no parts")
+	}
+	f := func() (interface{}, error) {
+		return nil, s.completeMultipart(req)
+	}
+	_, err := s.retry(str(req), f)
+	return err
+}
+
+func (s SmartS3) AbortMultipart(m Multipart) error {
+	if err := checkMultipart(m); err != nil {
+		return err
+	}
+	f := func() (interface{}, error) {
+		return nil, s.abortMultipart(m)
+	}
+	_, err := s.retry(str(m), f)
+	return err
+}
+
+func checkMultipart(m Multipart) error {
+	if err := checkObject(m.Object); err != nil {
+		return err
+	}
+	if m.UploadId == "" {
+		return errors.New("no upload id")
+	}
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	Bucket, Key, UploadId string
+}
+
+func (s SmartS3) initiateMultipart(req BasePut) (*Multipart, error) {
+	u, err := s.createURL(req.Object)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = "uploads"
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("POST", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.addHeaders(hreq.Header)
+	if err := s.sign(hreq, emptySHA256); err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, responseError(resp)
+	}
+	var out initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.UploadId == "" {
+		return nil, errors.New("no upload id returned")
+	}
+	return &Multipart{Object: req.Object, UploadId: out.UploadId}, nil
+}
+
+func (s SmartS3) uploadPart(req UploadPartRequest) (*Part, error) {
+	u, err := s.createURL(req.Object)
+	if err != nil {
+		return nil, err
+	}
+	query := make(url.Values)
+	query.Set("partNumber", strconv.Itoa(req.PartNumber))
+	query.Set("uploadId", req.UploadId)
+	u.RawQuery = encodeQuery(query)
+	transport := http.DefaultTransport
+	reader, err := req.ReaderFact.CreateReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var body io.Reader = reader
+	var sent *hashingReader
+	if req.Verify {
+		sent = newMD5Reader(reader)
+		body = sent
+	}
+	hreq, err := s.newRequest("PUT", u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.ContentLength = int64(req.ReaderFact.Len())
+	req.Encryption.addCustomerHeaders(hreq.Header, "")
+	if err := s.sign(hreq, aws.UnsignedPayload); err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, responseError(resp)
+	}
+	if err := checkSent(req.Object, sent, resp); err != nil {
+		return nil, err
+	}
+	etag := strings.Replace(resp.Header.Get("Etag"), `"`, "", -1)
+	return &Part{PartNumber: req.PartNumber, ETag: etag}, nil
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type partList []completedPart
+
+func (p partList) Len() int {
+	return len(p)
+}
+func (p partList) Less(i, j int) bool {
+	return p[i].PartNumber < p[j].PartNumber
+}
+func (p partList) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (s SmartS3) completeMultipart(req CompleteMultipartRequest) error {
+	u, err := s.createURL(req.Object)
+	if err != nil {
+		return err
+	}
+	query := make(url.Values)
+	query.Set("uploadId", req.UploadId)
+	u.RawQuery = encodeQuery(query)
+
+	var c completeMultipartUpload
+	for _, p := range req.Parts {
+		c.Parts = append(c.Parts, completedPart{PartNumber: p.PartNumber, ETag: `"` + p.ETag + `"`})
+	}
+	sort.Sort(partList(c.Parts))
+	body, err := xml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := s.sign(hreq, hashHex(body)); err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return responseError(resp)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return embeddedError(resp.StatusCode, buf)
+}
+
+func (s SmartS3) abortMultipart(m Multipart) error {
+	u, err := s.createURL(m.Object)
+	if err != nil {
+		return err
+	}
+	query := make(url.Values)
+	query.Set("uploadId", m.UploadId)
+	u.RawQuery = encodeQuery(query)
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := s.sign(hreq, emptySHA256); err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	return nil
+}
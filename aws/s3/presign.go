@@ -0,0 +1,190 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type PresignRequest struct {
+	Object     Object
+	Method     string // "GET", "PUT" or "DELETE"; empty means "GET"
+	Expiration time.Duration
+
+	// for PUT, the content type and length, if positive, that uploads must have
+	ContentType   string
+	ContentLength int64
+}
+
+// a request anyone can make without credentials until it expires
+type PresignedRequest struct {
+	Method string
+	URL    string
+	Header http.Header // headers the request must be sent with, as signed
+}
+
+// sigv4 query-string signed request, valid for at most MaxPresignExpiration
+func (s SmartS3) Presign(req PresignRequest) (*PresignedRequest, error) {
+	if err := checkObject(req.Object); err != nil {
+		return nil, err
+	}
+	if req.Expiration <= 0 || req.Expiration > MaxPresignExpiration {
+		return nil, fmt.Errorf("illegal expiration: %v", req.Expiration)
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	switch method {
+	case "GET", "DELETE":
+		if req.ContentType != "" || req.ContentLength > 0 {
+			return nil, fmt.Errorf("content constraints only apply to PUT, not %s", method)
+		}
+	case "PUT":
+	default:
+		return nil, fmt.Errorf("can't presign %s", method)
+	}
+	u, err := s.createURL(req.Object)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.ContentType != "" {
+		hreq.Header.Set("Content-Type", req.ContentType)
+	}
+	if req.ContentLength > 0 {
+		hreq.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	header := make(http.Header)
+	for k, v := range hreq.Header {
+		header[k] = v
+	}
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.service().Presign(&keys, hreq, time.Now(), req.Expiration); err != nil {
+		return nil, err
+	}
+	return &PresignedRequest{Method: method, URL: hreq.URL.String(), Header: header}, nil
+}
+
+// conditions for a browser upload via an html form posted straight to s3
+type PostPolicy struct {
+	Bucket string
+
+	// the key uploads are stored under, or if empty, a prefix they must start with.
+	// for the latter, the form's key field is the prefix plus "${filename}", which s3
+	// replaces with the uploaded file's name; browsers may change the field, within the prefix.
+	Key, KeyPrefix string
+
+	// inclusive range of upload sizes, if MaxSize is positive
+	MinSize, MaxSize int64
+
+	Expiration time.Duration
+
+	// form fields with exact values, e.g. "Content-Type", "success_action_status" or "x-amz-meta-user"
+	Fields map[string]string
+
+	// form fields that must start with a value, e.g. "Content-Type": "image/"
+	StartsWith map[string]string
+}
+
+// the action url and fields of an html form; the file input must follow the fields,
+// and be named "file"
+type PostForm struct {
+	URL    string
+	Fields map[string]string
+}
+
+// signs a POST policy, producing the form browsers should post
+func (s SmartS3) PresignPost(p PostPolicy) (*PostForm, error) {
+	return s.presignPost(p, time.Now())
+}
+
+func (s SmartS3) presignPost(p PostPolicy, t time.Time) (*PostForm, error) {
+	if p.Bucket == "" {
+		return nil, errors.New("no bucket name")
+	}
+	if p.Expiration <= 0 {
+		return nil, fmt.Errorf("illegal expiration: %v", p.Expiration)
+	}
+	if p.MinSize < 0 || (p.MaxSize > 0 && p.MaxSize < p.MinSize) {
+		return nil, fmt.Errorf("illegal size range: %d-%d", p.MinSize, p.MaxSize)
+	}
+	t = t.UTC()
+	svc := s.service()
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": svc.Credential(&keys, t),
+		"x-amz-date":       t.Format("20060102T150405Z"),
+	}
+	if keys.SessionToken != "" {
+		fields["x-amz-security-token"] = keys.SessionToken
+	}
+	for k, v := range p.Fields {
+		fields[k] = v
+	}
+	conditions := []interface{}{map[string]string{"bucket": p.Bucket}}
+	switch {
+	case p.Key != "":
+		fields["key"] = p.Key
+	case p.KeyPrefix != "":
+		fields["key"] = p.KeyPrefix + "${filename}"
+		conditions = append(conditions, []string{"starts-with", "$key", p.KeyPrefix})
+	default:
+		return nil, errors.New("need a key or key prefix")
+	}
+	var names []string
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if k == "key" && p.Key == "" {
+			continue
+		}
+		conditions = append(conditions, map[string]string{k: fields[k]})
+	}
+	names = nil
+	for k := range p.StartsWith {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		conditions = append(conditions, []string{"starts-with", "$" + k, p.StartsWith[k]})
+	}
+	if p.MaxSize > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", p.MinSize, p.MaxSize})
+	}
+
+	doc, err := json.Marshal(struct {
+		Expiration string        `json:"expiration"`
+		Conditions []interface{} `json:"conditions"`
+	}{t.Add(p.Expiration).Format("2006-01-02T15:04:05.000Z"), conditions})
+	if err != nil {
+		return nil, err
+	}
+	policy := base64.StdEncoding.EncodeToString(doc)
+	fields["policy"] = policy
+	fields["x-amz-signature"] = svc.SignPolicy(&keys, t, policy)
+
+	u, err := s.createURL(Object{Bucket: p.Bucket})
+	if err != nil {
+		return nil, err
+	}
+	return &PostForm{URL: u.String(), Fields: fields}, nil
+}
@@ -0,0 +1,200 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	DefaultDownloadPartSize    = 8 * 1024 * 1024
+	DefaultDownloadConcurrency = 4
+)
+
+// random access to an object's bytes, via ranged gets
+type ObjectReader struct {
+	i    Interface
+	o    Object
+	size int64
+}
+
+// heads o to determine its size
+func NewObjectReader(i Interface, o Object) (*ObjectReader, error) {
+	h, err := i.Head(o)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReader{i: i, o: o, size: int64(h.ContentLength)}, nil
+}
+
+func (r *ObjectReader) Size() int64 {
+	return r.size
+}
+
+// implements io.ReaderAt
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(p)) - 1
+	if end >= r.size {
+		end = r.size - 1
+	}
+	buf, err := r.i.GetObject(GetRequest{Object: r.o, Range: &ByteRange{Start: off, End: end}})
+	n := copy(p, buf)
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type DownloadRequest struct {
+	GetRequest
+	Size        int64 // size of the object if known, otherwise zero to head it first
+	PartSize    int64 // zero means DefaultDownloadPartSize
+	Concurrency int   // ranges fetched at once; zero means DefaultDownloadConcurrency
+
+	// the object's etag, if known without heading it, e.g. from a listing. unless NoVerify,
+	// downloads of single-part objects are checked against it. objects encrypted with kms
+	// have etags that look like md5's but aren't, so leave this empty for them. quotes are ignored.
+	ETag string
+}
+
+// writes an entire object to w, fetching ranges concurrently but writing them in order.
+// at most Concurrency parts are held in memory at once.
+func Download(i Interface, req DownloadRequest, w io.Writer) (int64, error) {
+	if err := checkObject(req.Object); err != nil {
+		return 0, err
+	}
+	size := req.Size
+	if size <= 0 {
+		// might really be empty, but we can't tell without asking
+		h, err := i.HeadObject(req.head())
+		if err != nil {
+			return 0, err
+		}
+		if req.IfMatch == "" {
+			// so every range comes from the object we headed
+			req.IfMatch = h.ETag
+		}
+		size = int64(h.ContentLength)
+		req.ETag = h.md5()
+	}
+	req.ETag = unquoteETag(req.ETag)
+	var sum hash.Hash
+	if !req.NoVerify && md5ETag.MatchString(req.ETag) && (req.Encryption == nil || len(req.Encryption.CustomerKey) == 0) {
+		sum = md5.New()
+		w = io.MultiWriter(w, sum)
+	}
+	partSize := req.PartSize
+	if partSize <= 0 {
+		partSize = DefaultDownloadPartSize
+	}
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultDownloadConcurrency
+	}
+	if size == 0 {
+		return 0, nil
+	}
+
+	type result struct {
+		buf []byte
+		err error
+	}
+
+	count := int((size + partSize - 1) / partSize)
+	results := make([]chan result, count)
+	for p := range results {
+		results[p] = make(chan result, 1)
+	}
+
+	// tokens bound the parts fetched but not yet written
+	tokens := make(chan bool, concurrency)
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		for p := 0; p < count; p++ {
+			select {
+			case tokens <- true:
+			case <-done:
+				return
+			}
+			go func(p int) {
+				get := req.GetRequest
+				get.Range = &ByteRange{Start: int64(p) * partSize, End: int64(p+1)*partSize - 1}
+				if get.Range.End >= size {
+					get.Range.End = size - 1
+				}
+				buf, err := i.GetObject(get)
+				if err == nil && int64(len(buf)) != get.Range.End-get.Range.Start+1 {
+					err = fmt.Errorf("short range %v: got %d bytes", *get.Range, len(buf))
+				}
+				results[p] <- result{buf, err}
+			}(p)
+		}
+	}()
+
+	var written int64
+	for p := 0; p < count; p++ {
+		r := <-results[p]
+		if r.err != nil {
+			return written, r.err
+		}
+		n, err := w.Write(r.buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		<-tokens
+	}
+	if sum != nil {
+		if actual := hex.EncodeToString(sum.Sum(nil)); actual != req.ETag {
+			return written, &ChecksumError{Object: req.Object, Algorithm: ChecksumMD5, Expected: req.ETag, Actual: actual}
+		}
+	}
+	return written, nil
+}
+
+// like Get, but streams the object via Download in the background.
+// errors fetching ranges are returned from the reader.
+func ParallelGet(i Interface, req DownloadRequest) (io.ReadCloser, error) {
+	if err := checkObject(req.Object); err != nil {
+		return nil, err
+	}
+	if req.Size <= 0 {
+		h, err := i.HeadObject(req.head())
+		if err != nil {
+			return nil, err
+		}
+		if req.IfMatch == "" {
+			// so every range comes from the object we headed
+			req.IfMatch = h.ETag
+		}
+		req.Size = int64(h.ContentLength)
+		req.ETag = h.md5()
+	}
+	if req.Size == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	r, w := io.Pipe()
+	go func() {
+		_, err := Download(i, req, w)
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
@@ -2,6 +2,7 @@
 package s3
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,20 +14,58 @@ import (
 )
 
 type Interface interface {
+	// a copy of the Interface whose operations are bound to ctx: cancelling it aborts
+	// requests in flight and retry backoffs, and its deadline applies to the transport
+	WithContext(ctx context.Context) Interface
+
 	Copy(req CopyRequest) error
 	Put(req PutRequest) error
 	PutObject(req PutObjectRequest) error
 	Head(req Object) (*HeadResponse, error)
+	HeadObject(req HeadRequest) (*HeadResponse, error)
 	Get(req GetRequest) (io.ReadCloser, error)
 	GetObject(req GetRequest) ([]byte, error)
 	List(req ListRequest) (ListBucketResult, error)
+	ListV2(req ListV2Request) (ListV2Result, error)
+	ListVersions(req ListVersionsRequest) (ListVersionsResult, error)
 	Delete(req DeleteRequest) error
+	DeleteObjects(req DeleteObjectsRequest) (*DeleteObjectsResult, error)
 	Buckets() (*ListAllMyBucketsResult, error)
 	MakePublic(bucket string) error
+	BucketInterface
+
+	// multipart uploads; see also Upload
+	InitiateMultipart(req BasePut) (*Multipart, error)
+	UploadPart(req UploadPartRequest) (*Part, error)
+	CompleteMultipart(req CompleteMultipartRequest) error
+	AbortMultipart(m Multipart) error
+}
+
+// p may be a static aws.Auth
+func GetDefault(p aws.Provider) Interface {
+	return SmartS3{Credentials: p, Strat: defaultStrat()}
+}
+
+// like GetDefault, but for a specific endpoint (e.g., "http://localhost:9000"), region and addressing style.
+func GetForEndpoint(p aws.Provider, endpoint, region string, addressing Addressing) Interface {
+	return SmartS3{Credentials: p, Strat: defaultStrat(), Endpoint: endpoint, Region: region, Addressing: addressing}
+}
+
+func defaultStrat() goutil.RetryStrategy {
+	return &goutil.RetryBackoffStrat{BackoffFactor: 1.5, Delay: time.Second, Retries: 3}
 }
 
-func GetDefault(a aws.Auth) Interface {
-	return SmartS3{Auth: a, Strat: &goutil.RetryBackoffStrat{BackoffFactor: 1.5, Delay: time.Second, Retries: 3}}
+// implemented by Interface's that know where their objects live
+type Locator interface {
+	Url(o Object) string
+}
+
+// url of o according to i if it's a Locator, otherwise o.Url()
+func Url(i Interface, o Object) string {
+	if l, ok := i.(Locator); ok {
+		return l.Url(o)
+	}
+	return o.Url()
 }
 
 type ListAllMyBucketsResult struct {
@@ -44,26 +83,71 @@ type Bucket struct {
 }
 
 type HeadResponse struct {
-	ETag          string
-	ContentType   string
-	ContentLength int
-	LastModified  time.Time
+	ETag               string
+	ContentType        string
+	ContentLength      int
+	LastModified       time.Time
+	ContentEncoding    string            `json:",omitempty"`
+	CacheControl       string            `json:",omitempty"`
+	ContentDisposition string            `json:",omitempty"`
+	Metadata           map[string]string `json:",omitempty"` // user metadata, with lower-case keys
+	StorageClass       string            `json:",omitempty"` // empty for STANDARD
+	Encryption         *Encryption       `json:",omitempty"` // never includes a customer key
+	VersionId          string            `json:",omitempty"` // only for versioned buckets
 }
 
 type GetRequest struct {
 	Object       Object
 	RoundTripper http.RoundTripper
+	Range        *ByteRange  // optional
+	Encryption   *Encryption // only needed for SSE-C
+	VersionId    string      // optional; empty means the latest version
+	Conditions
+
+	// unless set, reading a whole single-part object fails with a *ChecksumError
+	// at the end if its md5 doesn't match its etag
+	NoVerify bool
+}
+
+// inclusive range of bytes; negative End means through the end of the object
+type ByteRange struct {
+	Start, End int64
+}
+
+func (r ByteRange) String() string {
+	if r.End < 0 {
+		return fmt.Sprintf("bytes=%d-", r.Start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
 }
 
 type CopyRequest struct {
 	From, To Object
+
+	// whether to take content headers and user metadata from Headers (REPLACE directive)
+	// rather than copying them from From (COPY directive)
+	ReplaceMetadata bool
+
+	// for To, ignoring Object and ContentMD5. storage class and encryption apply regardless of ReplaceMetadata
+	Headers BasePut
+
+	// only needed if From is encrypted with SSE-C
+	SourceEncryption *Encryption
 }
 
 type BasePut struct {
-	Object          Object
-	ContentType     string
-	ContentEncoding string
-	ContentMD5      string // md5, hex or base64
+	Object             Object
+	ContentType        string
+	ContentEncoding    string
+	ContentMD5         string            // md5, hex or base64
+	CacheControl       string            // e.g. "max-age=3600"
+	ContentDisposition string            // e.g. `attachment; filename="x.csv"`
+	Metadata           map[string]string // user metadata, sent as x-amz-meta-* headers
+	StorageClass       string            // e.g. "STANDARD_IA"; empty means STANDARD
+	Encryption         *Encryption       // optional
+
+	// optional check for corruption in transit; multipart uploads check each part's md5 instead
+	Checksum ChecksumAlgorithm
 }
 
 type PutRequest struct {
@@ -77,14 +161,16 @@ type PutObjectRequest struct {
 }
 
 type ListRequest struct {
-	Bucket  string
-	MaxKeys int64
-	Marker  string
-	Prefix  string
+	Bucket    string
+	MaxKeys   int64
+	Marker    string
+	Prefix    string
+	Delimiter string
 }
 
 type DeleteRequest struct {
-	Object Object
+	Object    Object
+	VersionId string // optional; deletes that version permanently rather than adding a delete marker
 }
 
 type Object struct {
@@ -92,8 +178,9 @@ type Object struct {
 	Key    string
 }
 
+// url of object on the default endpoint, path-style
 func (o Object) Url() string {
-	return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", o.Bucket, o.Key)
+	return fmt.Sprintf("%s/%s/%s", DefaultEndpoint, o.Bucket, o.Key)
 }
 
 type ListBucketResultContents struct {
@@ -116,14 +203,52 @@ func (b ListedObject) Object() Object {
 
 type ListBucketResult struct {
 	Name, Prefix, Marker, Delimiter string
+	NextMarker                      string // only when there's a delimiter
 	MaxKeys                         int64
 	IsTruncated                     bool
 	Contents                        []ListBucketResultContents
+	CommonPrefixes                  []CommonPrefix
+}
+
+// keys sharing a prefix up to the delimiter, like a directory
+type CommonPrefix struct {
+	Prefix string
 }
 
 type SmartS3 struct {
-	Auth  aws.Auth
-	Strat goutil.RetryStrategy
+	Auth        aws.Auth
+	Credentials aws.Provider // if set, used instead of Auth
+	Strat       goutil.RetryStrategy
+
+	// base url of the service, e.g. "https://s3.amazonaws.com" or "http://localhost:9000";
+	// if empty, it's derived from Region
+	Endpoint string
+
+	// e.g. "us-west-2"; empty means "us-east-1"
+	Region string
+
+	Addressing Addressing
+
+	ctx context.Context // see WithContext
+}
+
+// how buckets are addressed in request url's
+type Addressing int
+
+const (
+	// e.g., https://s3.amazonaws.com/bucket/key
+	PathStyle Addressing = iota
+	// e.g., https://bucket.s3.amazonaws.com/key
+	VirtualHostStyle
+)
+
+// url of object o on this endpoint
+func (s SmartS3) Url(o Object) string {
+	u, err := s.createURL(o)
+	if err != nil {
+		return o.Url()
+	}
+	return u.String()
 }
 
 func (s SmartS3) List(req ListRequest) (ListBucketResult, error) {
@@ -132,7 +257,7 @@ func (s SmartS3) List(req ListRequest) (ListBucketResult, error) {
 		return out, errors.New("no bucket name")
 	}
 	f := func() (interface{}, error) {
-		return list(s.Auth, req)
+		return s.list(req)
 	}
 	v, err := s.retry(str(req), f)
 	if err != nil {
@@ -147,8 +272,11 @@ func (s SmartS3) Get(req GetRequest) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := checkRange(req.Range); err != nil {
+		return nil, err
+	}
 	f := func() (interface{}, error) {
-		return get(s.Auth, req)
+		return s.get(req)
 	}
 	v, err := s.retry(str(req), f)
 	if err != nil {
@@ -159,13 +287,12 @@ func (s SmartS3) Get(req GetRequest) (io.ReadCloser, error) {
 }
 
 func (s SmartS3) MakePublic(bucket string) error {
-	policy := fmt.Sprintf(`{"Statement":[{"Action":"s3:GetObject","Effect":"Allow","Principal":{"AWS":"*"},"Resource":"arn:aws:s3:::%s/*","Sid":"AllowPublicRead"}],"Version":"2008-10-17"}`, bucket)
-	return putPolicy(s.Auth, bucket, policy)
+	return s.PutBucketPolicy(bucket, PublicReadPolicy(bucket))
 }
 
 func (s SmartS3) Buckets() (*ListAllMyBucketsResult, error) {
 	f := func() (interface{}, error) {
-		return buckets(s.Auth)
+		return s.buckets()
 	}
 	v, err := s.retry("service", f)
 	if err != nil {
@@ -176,19 +303,7 @@ func (s SmartS3) Buckets() (*ListAllMyBucketsResult, error) {
 }
 
 func (s SmartS3) Head(req Object) (*HeadResponse, error) {
-	err := checkObject(req)
-	if err != nil {
-		return nil, err
-	}
-	f := func() (interface{}, error) {
-		return head(s.Auth, req)
-	}
-	v, err := s.retry(str(req), f)
-	if err != nil {
-		return nil, err
-	} else {
-		return v.(*HeadResponse), err
-	}
+	return s.HeadObject(HeadRequest{Object: req})
 }
 
 func (s SmartS3) GetObject(req GetRequest) ([]byte, error) {
@@ -196,8 +311,11 @@ func (s SmartS3) GetObject(req GetRequest) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := checkRange(req.Range); err != nil {
+		return nil, err
+	}
 	f := func() (interface{}, error) {
-		return getObject(s.Auth, req)
+		return s.getObject(req)
 	}
 	v, err := s.retry(str(req), f)
 	if err != nil {
@@ -217,7 +335,7 @@ func (s SmartS3) Copy(req CopyRequest) error {
 		return err
 	}
 	f := func() (interface{}, error) {
-		return nil, cp(s.Auth, req)
+		return nil, s.cp(req)
 	}
 	_, err = s.retry(str(req), f)
 	return err
@@ -229,7 +347,7 @@ func (s SmartS3) Put(req PutRequest) error {
 		return err
 	}
 	f := func() (interface{}, error) {
-		return nil, SimplePut(s.Auth, req)
+		return nil, s.simplePut(req)
 	}
 	_, err = s.retry(str(req), f)
 	return err
@@ -248,14 +366,38 @@ func (s SmartS3) Delete(req DeleteRequest) error {
 		return err
 	}
 	f := func() (interface{}, error) {
-		return nil, del(s.Auth, req)
+		return nil, s.del(req)
 	}
 	_, err = s.retry(str(req), f)
 	return err
 }
 
+func (s SmartS3) WithContext(ctx context.Context) Interface {
+	if ctx == nil {
+		panic("nil context")
+	}
+	s.ctx = ctx
+	return s
+}
+
+// the context operations are bound to, by default context.Background()
+func (s SmartS3) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// retries f per the strategy, but only for Retryable errors, and only until the context is done
 func (s SmartS3) retry(msg string, f func() (interface{}, error)) (v interface{}, err error) {
-	return goutil.Retry(msg, s.Strat.NewInstance(), f)
+	return goutil.RetryIfContext(s.Context(), msg, s.Strat.NewInstance(), Retryable, f)
+}
+
+func checkRange(r *ByteRange) error {
+	if r != nil && (r.Start < 0 || (r.End >= 0 && r.End < r.Start)) {
+		return fmt.Errorf("illegal range: %v", *r)
+	}
+	return nil
 }
 
 func checkObject(o Object) error {
@@ -1,7 +1,26 @@
 package s3
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/xoba/goutil"
+	"github.com/xoba/goutil/aws"
 )
 
 func TestEmptyS3Object(t *testing.T) {
@@ -25,3 +44,246 @@ func TestGoodKey(t *testing.T) {
 		t.Errorf("failed to recognize valid object")
 	}
 }
+
+func TestCreateURL(t *testing.T) {
+	o := Object{Bucket: "abc", Key: "x y/z+1"}
+	for _, c := range []struct {
+		s        SmartS3
+		expected string
+	}{
+		{SmartS3{}, "https://s3.amazonaws.com/abc/x%20y/z%2B1"},
+		{SmartS3{Region: "us-west-2"}, "https://s3.us-west-2.amazonaws.com/abc/x%20y/z%2B1"},
+		{SmartS3{Addressing: VirtualHostStyle}, "https://abc.s3.amazonaws.com/x%20y/z%2B1"},
+		{SmartS3{Endpoint: "http://localhost:9000/"}, "http://localhost:9000/abc/x%20y/z%2B1"},
+	} {
+		if u := c.s.Url(o); u != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, u)
+		}
+	}
+	if _, err := (SmartS3{Endpoint: "localhost"}).createURL(o); err == nil {
+		t.Errorf("failed to detect illegal endpoint")
+	}
+}
+
+func TestSectionReaderFact(t *testing.T) {
+	data := []byte("0123456789")
+	f, err := ioutil.TempFile("", "section")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+	file, err := goutil.NewFileReaderFact(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rf := range []goutil.ReaderFactory{
+		goutil.BufferReaderFact{Buffer: data},
+		file,
+		goutil.NewSingleReaderFact(bytes.NewReader(data), len(data)),
+	} {
+		s := NewSectionReaderFact(rf, 3, 4)
+		r, err := s.CreateReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "3456" || s.Len() != 4 {
+			t.Errorf("bad section for %T: %q", rf, buf)
+		}
+	}
+}
+
+func TestByteRange(t *testing.T) {
+	if r := (ByteRange{Start: 10, End: 19}).String(); r != "bytes=10-19" {
+		t.Errorf("bad range: %q", r)
+	}
+	if r := (ByteRange{Start: 10, End: -1}).String(); r != "bytes=10-" {
+		t.Errorf("bad range: %q", r)
+	}
+	if err := checkRange(&ByteRange{Start: 10, End: 9}); err == nil {
+		t.Errorf("failed to detect illegal range")
+	}
+}
+
+type pager struct {
+	Interface
+	pages []ListV2Result
+}
+
+func (p *pager) ListV2(req ListV2Request) (ListV2Result, error) {
+	if len(p.pages) == 0 {
+		return ListV2Result{}, errors.New("no more pages")
+	}
+	r := p.pages[0]
+	p.pages = p.pages[1:]
+	return r, nil
+}
+
+func TestLister(t *testing.T) {
+	p := &pager{pages: []ListV2Result{
+		{
+			IsTruncated:           true,
+			NextContinuationToken: "x",
+			Contents:              []ListBucketResultContents{{Key: "a"}, {Key: "c"}},
+			CommonPrefixes:        []CommonPrefix{{"b/"}},
+		},
+		{
+			Contents: []ListBucketResultContents{{Key: "d"}},
+		},
+	}}
+	l := NewLister(p, ListV2Request{Bucket: "bucket", Delimiter: "/"})
+	var keys []string
+	for l.Next() {
+		keys = append(keys, l.Key())
+		if l.Prefix() == "" && l.Object().Bucket != "bucket" {
+			t.Errorf("bad bucket for %q", l.Key())
+		}
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[a b/ c d]" {
+		t.Errorf("bad keys: %v", keys)
+	}
+	l = NewLister(&pager{}, ListV2Request{Bucket: "bucket"})
+	if l.Next() || l.Err() == nil {
+		t.Errorf("failed to surface error")
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The resource you requested does not exist</Message><Resource>/mybucket/myfoto.jpg</Resource><RequestId>4442587FB7D0A2F9</RequestId><HostId>xyz</HostId></Error>`
+	resp := &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(body)), Header: make(http.Header)}
+	err := responseError(resp)
+	if !IsNoSuchKey(err) || IsNoSuchBucket(err) || Retryable(err) {
+		t.Errorf("bad classification: %v", err)
+	}
+	if e := err.(*Error); e.RequestId != "4442587FB7D0A2F9" || e.HostId != "xyz" || e.StatusCode != 404 {
+		t.Errorf("bad error: %#v", e)
+	}
+	resp = &http.Response{StatusCode: 503, Body: ioutil.NopCloser(strings.NewReader("")), Header: make(http.Header)}
+	if err := responseError(resp); !Retryable(fmt.Errorf("wrapped: %w", err)) {
+		t.Errorf("failed to retry: %v", err)
+	}
+	if Retryable(errors.New("illegal bucket or key")) {
+		t.Errorf("retried local error")
+	}
+}
+
+func TestFakeErrors(t *testing.T) {
+	f := NewMemoryS3()
+	if _, err := f.Head(Object{"b", "k"}); !IsNoSuchBucket(err) {
+		t.Errorf("expected no such bucket: %v", err)
+	}
+	f.MakeBucket("b")
+	if _, err := f.GetObject(GetRequest{Object: Object{"b", "k"}}); !IsNoSuchKey(err) {
+		t.Errorf("expected no such key: %v", err)
+	}
+}
+
+func TestPolicyJSON(t *testing.T) {
+	buf, err := json.Marshal(PublicReadPolicy("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"Version":"2008-10-17","Statement":[{"Sid":"AllowPublicRead","Effect":"Allow","Principal":{"AWS":"*"},"Action":"s3:GetObject","Resource":"arn:aws:s3:::b/*"}]}`
+	if string(buf) != expected {
+		t.Errorf("bad policy: %s", buf)
+	}
+	var p Policy
+	if err := json.Unmarshal([]byte(`{"Statement":[{"Effect":"Deny","Principal":"*","Action":["s3:PutObject","s3:DeleteObject"]}]}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Statement[0]; !st.Principal.Everyone || len(st.Action) != 2 {
+		t.Errorf("bad statement: %#v", st)
+	}
+}
+
+func TestPresign(t *testing.T) {
+	s := SmartS3{Auth: aws.Auth{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}}
+	r, err := s.Presign(PresignRequest{Object: Object{"b", "k"}, Method: "PUT", Expiration: time.Hour, ContentType: "image/png", ContentLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("X-Amz-SignedHeaders") != "content-length;content-type;host" || r.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("bad presigned request: %#v", r)
+	}
+	if _, err := s.Presign(PresignRequest{Object: Object{"b", "k"}, Method: "DELETE", Expiration: time.Hour, ContentType: "x"}); err == nil {
+		t.Error("failed to detect content type on delete")
+	}
+}
+
+func TestPresignPost(t *testing.T) {
+	s := SmartS3{Auth: aws.Auth{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}}
+	now := time.Date(2015, 12, 29, 0, 0, 0, 0, time.UTC)
+	f, err := s.presignPost(PostPolicy{
+		Bucket:     "b",
+		KeyPrefix:  "uploads/",
+		MaxSize:    1 << 20,
+		Expiration: time.Hour,
+		Fields:     map[string]string{"success_action_status": "201"},
+		StartsWith: map[string]string{"Content-Type": "image/"},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.URL != "https://s3.amazonaws.com/b/" || f.Fields["key"] != "uploads/${filename}" || f.Fields["x-amz-credential"] != "AKIDEXAMPLE/20151229/us-east-1/s3/aws4_request" {
+		t.Errorf("bad form: %#v", f)
+	}
+	doc, err := base64.StdEncoding.DecodeString(f.Fields["policy"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"expiration":"2015-12-29T01:00:00.000Z","conditions":[{"bucket":"b"},["starts-with","$key","uploads/"],{"success_action_status":"201"},{"x-amz-algorithm":"AWS4-HMAC-SHA256"},{"x-amz-credential":"AKIDEXAMPLE/20151229/us-east-1/s3/aws4_request"},{"x-amz-date":"20151229T000000Z"},["starts-with","$Content-Type","image/"],["content-length-range",0,1048576]]}`
+	if string(doc) != expected {
+		t.Errorf("bad policy: %s", doc)
+	}
+	key := []byte("AWS4secret")
+	for _, s := range []string{"20151229", "us-east-1", "s3", "aws4_request", f.Fields["policy"]} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		key = h.Sum(nil)
+	}
+	if f.Fields["x-amz-signature"] != hex.EncodeToString(key) {
+		t.Errorf("bad signature: %s", f.Fields["x-amz-signature"])
+	}
+}
+
+func TestContext(t *testing.T) {
+	done := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	i := GetForEndpoint(aws.Auth{AccessKey: "a", SecretKey: "s"}, server.URL, "", PathStyle).WithContext(ctx)
+	if _, err := i.GetObject(GetRequest{Object: Object{"b", "k"}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	f := NewMemoryS3()
+	f.MakeBucket("b")
+	ctx, cancel = context.WithCancel(context.Background())
+	bound := f.WithContext(ctx)
+	put(t, bound, "k", "x")
+	cancel()
+	if _, err := bound.Head(Object{"b", "k"}); err != context.Canceled {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+	if _, err := f.Head(Object{"b", "k"}); err != nil {
+		t.Error(err)
+	}
+}
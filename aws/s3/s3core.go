@@ -2,18 +2,17 @@ package s3
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -24,6 +23,14 @@ import (
 
 const (
 	N = "\n"
+
+	DefaultEndpoint = "https://s3.amazonaws.com"
+
+	// sha256 of an empty payload
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// longest expiration sigv4 allows on pre-signed url's
+	MaxPresignExpiration = 7 * 24 * time.Hour
 )
 
 func mimeType(name string) string {
@@ -31,7 +38,7 @@ func mimeType(name string) string {
 	return mime.TypeByExtension(ext)
 }
 
-func list(auth aws.Auth, req ListRequest) (out ListBucketResult, err error) {
+func (s SmartS3) list(req ListRequest) (out ListBucketResult, err error) {
 	if req.Bucket == "" {
 		return out, errors.New("no bucket name")
 	}
@@ -47,26 +54,29 @@ func list(auth aws.Auth, req ListRequest) (out ListBucketResult, err error) {
 	if req.Prefix != "" {
 		query.Add("prefix", req.Prefix)
 	}
-	u, err := url.Parse("https://s3.amazonaws.com/" + req.Bucket + "/?" + query.Encode())
-	now := time.Now()
-	sig, err := signList(u.Path, auth, now)
+	if req.Delimiter != "" {
+		query.Add("delimiter", req.Delimiter)
+	}
+	u, err := s.createURL(Object{Bucket: req.Bucket})
 	if err != nil {
 		return
 	}
+	u.RawQuery = encodeQuery(query)
 	transport := http.DefaultTransport
-	hreq, err := http.NewRequest("GET", u.String(), nil)
+	hreq, err := s.newRequest("GET", u.String(), nil)
 	if err != nil {
 		return
 	}
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
+	if err = s.sign(hreq, emptySHA256); err != nil {
+		return
+	}
 	resp, err := transport.RoundTrip(hreq)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return out, errors.New(resp.Status)
+		return out, responseError(resp)
 	}
 	var buf bytes.Buffer
 	_, err = io.Copy(&buf, resp.Body)
@@ -80,37 +90,143 @@ func list(auth aws.Auth, req ListRequest) (out ListBucketResult, err error) {
 	return
 }
 
-func createURL(o Object) (*url.URL, error) {
-	return url.Parse(o.Url())
+// the base url of the service, without trailing slash
+func (s SmartS3) endpoint() (*url.URL, error) {
+	e := s.Endpoint
+	if e == "" {
+		if r := s.region(); r == "us-east-1" {
+			e = DefaultEndpoint
+		} else {
+			e = "https://s3." + r + ".amazonaws.com"
+		}
+	}
+	u, err := url.Parse(e)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("illegal endpoint: %q", e)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u, nil
 }
 
-func createURL2() (*url.URL, error) {
-	return url.Parse("https://s3.amazonaws.com/")
+func (s SmartS3) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
 }
 
-func head(auth aws.Auth, req Object) (*HeadResponse, error) {
-	u, err := createURL(req)
+// url for an object, a bucket (empty key), or the service itself (empty bucket)
+func (s SmartS3) createURL(o Object) (*url.URL, error) {
+	u, err := s.endpoint()
 	if err != nil {
 		return nil, err
 	}
-	now := time.Now()
-	sig, err := signHead(u.Path, auth, now)
+	switch {
+	case o.Bucket == "":
+		u.Path += "/"
+	case s.Addressing == VirtualHostStyle:
+		u.Host = o.Bucket + "." + u.Host
+		u.Path += "/" + o.Key
+	default:
+		u.Path += "/" + o.Bucket + "/" + o.Key
+	}
+	u.RawPath = escapePath(u.Path)
+	return u, nil
+}
+
+// a request bound to the context, so cancelling it aborts the request
+func (s SmartS3) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(s.Context(), method, url, body)
+}
+
+// signs r with sigv4, given the hex sha256 of its payload or aws.UnsignedPayload
+func (s SmartS3) sign(r *http.Request, payload string) error {
+	return s.signer().Sign(r, payload, time.Now())
+}
+
+func (s SmartS3) signer() *aws.Signer {
+	return aws.NewSigner("s3", s.region(), s.provider())
+}
+
+func (s SmartS3) service() *aws.Service {
+	return &aws.Service{Name: "s3", Region: s.region()}
+}
+
+func (s SmartS3) provider() aws.Provider {
+	if s.Credentials == nil {
+		return s.Auth
+	}
+	return s.Credentials
+}
+
+func (s SmartS3) keys() (aws.Keys, error) {
+	c, err := s.provider().Retrieve()
+	if err != nil {
+		return aws.Keys{}, err
+	}
+	return c.Keys(), nil
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// like url.Values.Encode, but with spaces as "%20"
+func encodeQuery(v url.Values) string {
+	return strings.Replace(v.Encode(), "+", "%20", -1)
+}
+
+// escapes each segment of a path, in the strict manner aws expects
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, x := range parts {
+		parts[i] = escape(x)
+	}
+	return strings.Join(parts, "/")
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func (s SmartS3) head(req HeadRequest) (*HeadResponse, error) {
+	u, err := s.createURL(req.Object)
 	if err != nil {
 		return nil, err
 	}
+	setVersion(u, req.VersionId)
 	transport := http.DefaultTransport
-	hreq, err := http.NewRequest("HEAD", u.String(), nil)
+	hreq, err := s.newRequest("HEAD", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
+	req.Conditions.addHeaders(hreq.Header)
+	req.Encryption.addCustomerHeaders(hreq.Header, "")
+	if err := s.sign(hreq, emptySHA256); err != nil {
+		return nil, err
+	}
 	resp, err := transport.RoundTrip(hreq)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, errors.New(resp.Status)
+		return nil, responseError(resp)
 	}
 
 	cl, err := strconv.ParseUint(resp.Header.Get("Content-Length"), 10, 64)
@@ -127,105 +243,72 @@ func head(auth aws.Auth, req Object) (*HeadResponse, error) {
 	}
 
 	hr := &HeadResponse{
-		ETag:          etag,
-		ContentType:   resp.Header.Get("Content-Type"),
-		ContentLength: int(cl),
-		LastModified:  t,
+		ETag:               etag,
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentLength:      int(cl),
+		LastModified:       t,
+		ContentEncoding:    resp.Header.Get("Content-Encoding"),
+		CacheControl:       resp.Header.Get("Cache-Control"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		Metadata:           metadata(resp.Header),
+		StorageClass:       resp.Header.Get("X-Amz-Storage-Class"),
+		Encryption:         encryption(resp.Header),
+		VersionId:          resp.Header.Get("X-Amz-Version-Id"),
 	}
 
 	return hr, nil
 }
 
-func putPolicy(auth aws.Auth, bucket, policy string) error {
-	now := time.Now()
-	sig, err := signPut(fmt.Sprintf("/%s/?policy", bucket), "", "", auth, now)
-	if err != nil {
-		return err
-	}
-	transport := http.DefaultTransport
-	hreq, err := http.NewRequest("PUT", "https://s3.amazonaws.com/?policy", strings.NewReader(policy))
-	if err != nil {
-		return err
-	}
-	hreq.Host = fmt.Sprintf("%s.s3.amazonaws.com", bucket)
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
-	resp, err := transport.RoundTrip(hreq)
-	if err != nil {
-		return err
-	}
-	io.Copy(os.Stdout, resp.Body)
-	resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.New(resp.Status)
-	}
-
-	return nil
-}
-
-func buckets(auth aws.Auth) (*ListAllMyBucketsResult, error) {
-	u, err := createURL2()
+func (s SmartS3) buckets() (*ListAllMyBucketsResult, error) {
+	u, err := s.createURL(Object{})
 	if err != nil {
 		return nil, err
 	}
-	now := time.Now()
-	sig, err := signGet(u.Path, auth, now)
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	transport := http.DefaultTransport
-	hreq, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
+	if err := s.sign(hreq, emptySHA256); err != nil {
 		return nil, err
 	}
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
 	resp, err := transport.RoundTrip(hreq)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, errors.New(resp.Status)
+		return nil, responseError(resp)
 	}
 	var out ListAllMyBucketsResult
-	if false {
-		io.Copy(os.Stdout, resp.Body)
-	} else {
-		d := xml.NewDecoder(resp.Body)
-		err = d.Decode(&out)
-		if err != nil {
-			return nil, err
-		}
+	d := xml.NewDecoder(resp.Body)
+	err = d.Decode(&out)
+	if err != nil {
+		return nil, err
 	}
 	return &out, nil
 }
 
-func PreSignedUrl(auth aws.Auth, o Object, expiration time.Duration) (string, error) {
-	u, err := createURL(o)
+// pre-signed url on the default endpoint
+func PreSignedUrl(p aws.Provider, o Object, expiration time.Duration) (string, error) {
+	return SmartS3{Credentials: p}.PreSignedUrl(o, expiration)
+}
+
+// sigv4 query-string signed GET url, valid for at most MaxPresignExpiration
+func (s SmartS3) PreSignedUrl(o Object, expiration time.Duration) (string, error) {
+	r, err := s.Presign(PresignRequest{Object: o, Expiration: expiration})
 	if err != nil {
 		return "", err
 	}
-	now := time.Now()
-	t := time.Now().UTC().Add(expiration)
-	sig, err := signGetExp(u.Path, auth, now, t)
-	return fmt.Sprintf("%s?AWSAccessKeyId=%s&Expires=%d&Signature=%s", o.Url(), url.QueryEscape(auth.AccessKey), t.Unix(), url.QueryEscape(sig)), nil
-}
-
-func signGetExp(path string, a aws.Auth, t time.Time, expiration time.Time) (string, error) {
-	return sign(a, "GET"+N+N+N+fmt.Sprintf("%d", expiration.Unix())+N+path)
+	return r.URL, nil
 }
 
-func get(auth aws.Auth, req GetRequest) (io.ReadCloser, error) {
-	u, err := createURL(req.Object)
-	if err != nil {
-		return nil, err
-	}
-	now := time.Now()
-	sig, err := signGet(u.Path, auth, now)
+func (s SmartS3) get(req GetRequest) (io.ReadCloser, error) {
+	u, err := s.createURL(req.Object)
 	if err != nil {
 		return nil, err
 	}
+	setVersion(u, req.VersionId)
 	rt := func() http.RoundTripper {
 		if req.RoundTripper == nil {
 			return http.DefaultTransport
@@ -233,55 +316,63 @@ func get(auth aws.Auth, req GetRequest) (io.ReadCloser, error) {
 			return req.RoundTripper
 		}
 	}()
-	hreq, err := http.NewRequest("GET", u.String(), nil)
+	hreq, err := s.newRequest("GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
+	if req.Range != nil {
+		hreq.Header.Set("Range", req.Range.String())
+	}
+	req.Conditions.addHeaders(hreq.Header)
+	req.Encryption.addCustomerHeaders(hreq.Header, "")
+	if err := s.sign(hreq, emptySHA256); err != nil {
+		return nil, err
+	}
 	resp, err := rt.RoundTrip(hreq)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return nil, errors.New(resp.Status)
+	if resp.StatusCode != 200 && !(req.Range != nil && resp.StatusCode == 206) {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	if etag := unquoteETag(resp.Header.Get("Etag")); !req.NoVerify && resp.StatusCode == 200 && verifiableETag(etag, resp.Header) {
+		return newVerifyingReader(resp.Body, req.Object, etag), nil
 	}
 	return resp.Body, nil
 }
 
-func del(auth aws.Auth, req DeleteRequest) (err error) {
-	u, err := createURL(req.Object)
+func (s SmartS3) del(req DeleteRequest) (err error) {
+	u, err := s.createURL(req.Object)
 	if err != nil {
 		return err
 	}
-	now := time.Now()
-	sig, err := signDelete(u.Path, auth, now)
-	if err != nil {
-		return
-	}
+	setVersion(u, req.VersionId)
 	transport := http.DefaultTransport
-	hreq, err := http.NewRequest("DELETE", u.String(), nil)
+	hreq, err := s.newRequest("DELETE", u.String(), nil)
 	if err != nil {
 		return err
 	}
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
+	if err := s.sign(hreq, emptySHA256); err != nil {
+		return err
+	}
 	resp, err := transport.RoundTrip(hreq)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.New(resp.Status)
+		return responseError(resp)
 	}
 	return nil
 }
 
-func getObject(auth aws.Auth, req GetRequest) ([]byte, error) {
-	r, err := get(auth, req)
+func (s SmartS3) getObject(req GetRequest) ([]byte, error) {
+	r, err := s.get(req)
 	if err != nil {
 		return nil, err
 	}
+	defer r.Close()
 	var buf bytes.Buffer
 	_, err = io.Copy(&buf, r)
 	if err != nil {
@@ -290,65 +381,74 @@ func getObject(auth aws.Auth, req GetRequest) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func cp(auth aws.Auth, req CopyRequest) (err error) {
-	u, err := createURL(req.To)
+func (s SmartS3) cp(req CopyRequest) (err error) {
+	u, err := s.createURL(req.To)
 	if err != nil {
 		return err
 	}
-	now := time.Now()
 	transport := http.DefaultTransport
-	hreq, err := http.NewRequest("PUT", u.String(), nil)
+	hreq, err := s.newRequest("PUT", u.String(), nil)
 	if err != nil {
 		return err
 	}
-	hreq.Header.Add("Date", format(now))
-	hreq.Header.Add("x-amz-copy-source", "/"+req.From.Bucket+"/"+req.From.Key)
-	sig, err := signCopy(u.Path, auth, now, req.From)
-	if err != nil {
-		return
+	hreq.Header.Add("x-amz-copy-source", copySource(req.From))
+	req.addHeaders(hreq.Header)
+	if err := s.sign(hreq, emptySHA256); err != nil {
+		return err
 	}
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
 	resp, err := transport.RoundTrip(hreq)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return errors.New(resp.Status)
+		return responseError(resp)
 	}
-	return nil
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return embeddedError(resp.StatusCode, buf)
 }
 
-func signCopy(path string, a aws.Auth, t time.Time, from Object) (string, error) {
-	xx := "x-amz-copy-source:/" + from.Bucket + "/" + from.Key
-	return sign(a, "PUT"+N+N+N+format(t)+N+xx+N+path)
+func copySource(o Object) string {
+	return escapePath("/" + o.Bucket + "/" + o.Key)
 }
 
-func signPut(path string, md5, ct string, a aws.Auth, t time.Time) (string, error) {
-	return sign(a, "PUT"+N+md5+N+ct+N+format(t)+N+path)
+// put on the default endpoint, without retries
+func SimplePut(p aws.Provider, req PutRequest) (err error) {
+	return SmartS3{Credentials: p}.simplePut(req)
 }
 
-func SimplePut(auth aws.Auth, req PutRequest) (err error) {
-	u, err := createURL(req.Object)
+func (s SmartS3) simplePut(req PutRequest) (err error) {
+	u, err := s.createURL(req.Object)
 	if err != nil {
 		return err
 	}
-	now := time.Now()
 	transport := http.DefaultTransport
 	reader, err := req.ReaderFact.CreateReader()
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	hreq, err := http.NewRequest("PUT", u.String(), reader)
+	var body io.Reader = reader
+	var sent *hashingReader
+	var trailing *trailingReader
+	switch req.Checksum {
+	case "":
+	case ChecksumMD5:
+		sent = newMD5Reader(reader)
+		body = sent
+	default:
+		if trailing, err = newTrailingReader(reader, req.Checksum); err != nil {
+			return err
+		}
+		body = trailing
+	}
+	hreq, err := s.newRequest("PUT", u.String(), body)
 	if err != nil {
 		return err
 	}
-	hreq.Header.Add("Date", format(now))
-	if len(req.ContentType) == 0 {
-		req.ContentType = mimeType(req.Object.Key)
-	}
-
 	md5, err := func() (string, error) {
 		if len(req.ContentMD5) == 32 {
 			d, err := hex.DecodeString(req.ContentMD5)
@@ -365,66 +465,36 @@ func SimplePut(auth aws.Auth, req PutRequest) (err error) {
 		return err
 	}
 
-	sig, err := signPut(u.Path, md5, req.ContentType, auth, now)
-	if err != nil {
-		return
-	}
 	hreq.ContentLength = int64(req.ReaderFact.Len())
-	hreq.Header.Add("Content-Type", req.ContentType)
-	if len(req.ContentEncoding) > 0 {
-		hreq.Header.Add("Content-Encoding", req.ContentEncoding)
-	}
+	req.BasePut.addHeaders(hreq.Header)
 	if len(md5) > 0 {
 		hreq.Header.Add("Content-MD5", md5)
 	}
-	hreq.Header.Add("Content-Length", fmt.Sprintf("%d", req.ReaderFact.Len()))
-	hreq.Header.Add("Authorization", "AWS "+auth.AccessKey+":"+sig)
+	payload := aws.UnsignedPayload
+	if trailing != nil {
+		// the checksum follows the body, which is sent in chunks
+		encoding := "aws-chunked"
+		if e := hreq.Header.Get("Content-Encoding"); e != "" {
+			encoding += "," + e
+		}
+		hreq.Header.Set("Content-Encoding", encoding)
+		hreq.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(hreq.ContentLength, 10))
+		hreq.Header.Set("X-Amz-Trailer", trailing.trailer())
+		hreq.ContentLength = trailing.length(hreq.ContentLength)
+		payload = aws.StreamingUnsignedTrailer
+	}
+	if err := s.sign(hreq, payload); err != nil {
+		return err
+	}
 	resp, err := transport.RoundTrip(hreq)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return errors.New(resp.Status)
+		return responseError(resp)
 	}
-	return nil
-}
-
-func format(t time.Time) string {
-	return t.UTC().Format(time.RFC1123Z)
-}
-
-func signGet(path string, a aws.Auth, t time.Time) (string, error) {
-	return sign(a, "GET"+N+N+N+format(t)+N+path)
-}
-func signHead(path string, a aws.Auth, t time.Time) (string, error) {
-	return sign(a, "HEAD"+N+N+N+format(t)+N+path)
-}
-
-func signList(path string, a aws.Auth, t time.Time) (string, error) {
-	return sign(a, "GET"+N+N+N+format(t)+N+path)
-}
-
-func signDelete(path string, a aws.Auth, t time.Time) (string, error) {
-	return sign(a, "DELETE"+N+N+N+format(t)+N+path)
-}
-
-func sign(a aws.Auth, toSign string) (signature string, err error) {
-	h := hmac.New(sha1.New, []byte(a.SecretKey))
-	if _, err = h.Write([]byte(toSign)); err != nil {
-		return
-	}
-	sig := h.Sum(nil)
-	buf := new(bytes.Buffer)
-	encoder := base64.NewEncoder(base64.StdEncoding, buf)
-	if _, err = encoder.Write(sig); err != nil {
-		return
-	}
-	if err = encoder.Close(); err != nil {
-		return
-	}
-	signature = buf.String()
-	return
+	return checkSent(req.Object, sent, resp)
 }
 
 func str(v interface{}) string {
@@ -0,0 +1,392 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xoba/goutil"
+)
+
+const DefaultSyncConcurrency = 8
+
+// which way a Sync copies
+type SyncDirection int
+
+const (
+	// local directory to bucket prefix
+	SyncUp SyncDirection = iota
+	// bucket prefix to local directory
+	SyncDown
+)
+
+type SyncRequest struct {
+	Dir       string
+	Bucket    string
+	Prefix    string // treated as a directory, so "a" and "a/" are the same
+	Direction SyncDirection
+
+	DryRun bool // just report what would be done
+	Delete bool // delete destination files missing from the source
+
+	// globs matched against slash-separated paths relative to Dir and Prefix, or just the
+	// file name for globs without a slash. with includes, only matching paths are synced;
+	// excludes take precedence. paths that don't pass are neither copied nor deleted.
+	Include, Exclude []string
+
+	Concurrency int // transfers at once; zero means DefaultSyncConcurrency
+
+	Log func(SyncAction) // optional; called as each action is done, or planned if DryRun
+}
+
+type SyncOp string
+
+const (
+	SyncPut          SyncOp = "upload"
+	SyncGet          SyncOp = "download"
+	SyncDeleteRemote SyncOp = "delete"
+	SyncDeleteLocal  SyncOp = "remove"
+)
+
+type SyncAction struct {
+	Op   SyncOp
+	Path string // relative to Dir and Prefix
+	Size int64
+}
+
+func (a SyncAction) String() string {
+	return fmt.Sprintf("%s: %s (%d bytes)", a.Op, a.Path, a.Size)
+}
+
+type syncFile struct {
+	size     int64
+	etag     string // remote only
+	modified time.Time
+}
+
+// mirrors a local directory to a bucket prefix or back, copying files that differ in size,
+// md5 (for objects whose etags are md5's) or modification time (otherwise). returns the
+// actions taken, or those that would be if DryRun.
+func Sync(i Interface, req SyncRequest) ([]SyncAction, error) {
+	if req.Dir == "" || req.Bucket == "" {
+		return nil, errors.New("need a directory and bucket")
+	}
+	for _, g := range append(append([]string{}, req.Include...), req.Exclude...) {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("bad glob %q: %v", g, err)
+		}
+	}
+	prefix := req.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	local, err := localFiles(req.Dir, req.filter)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := remoteFiles(i, req.Bucket, prefix, req.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dst := local, remote
+	if req.Direction == SyncDown {
+		src, dst = remote, local
+	}
+	var actions []SyncAction
+	for p, s := range src {
+		if d, ok := dst[p]; ok {
+			if d.size == s.size && d.modified.Equal(s.modified) {
+				continue
+			}
+			o := Object{Bucket: req.Bucket, Key: prefix + p}
+			same, err := sameFile(i, o, filepath.Join(req.Dir, filepath.FromSlash(p)), local[p], remote[p], req.Direction)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				continue
+			}
+		}
+		op := SyncPut
+		if req.Direction == SyncDown {
+			op = SyncGet
+		}
+		actions = append(actions, SyncAction{Op: op, Path: p, Size: s.size})
+	}
+	if req.Delete {
+		for p, d := range dst {
+			if _, ok := src[p]; ok {
+				continue
+			}
+			op := SyncDeleteRemote
+			if req.Direction == SyncDown {
+				op = SyncDeleteLocal
+			}
+			actions = append(actions, SyncAction{Op: op, Path: p, Size: d.size})
+		}
+	}
+	sort.Sort(byActionPath(actions))
+
+	if req.DryRun {
+		if req.Log != nil {
+			for _, a := range actions {
+				req.Log(a)
+			}
+		}
+		return actions, nil
+	}
+	return actions, req.run(i, prefix, remote, actions)
+}
+
+func (req SyncRequest) run(i Interface, prefix string, remote map[string]syncFile, actions []SyncAction) error {
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultSyncConcurrency
+	}
+
+	var lock sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+	done := func(a SyncAction, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s %s: %w", a.Op, a.Path, err)
+			}
+			return
+		}
+		if req.Log != nil {
+			req.Log(a)
+		}
+	}
+
+	var deletes []SyncAction
+	q := goutil.NewWorkQueue(concurrency)
+	for _, a := range actions {
+		if a.Op == SyncDeleteRemote {
+			deletes = append(deletes, a)
+			continue
+		}
+		a := a
+		q.Submit(func() {
+			if failed() {
+				return
+			}
+			o := Object{Bucket: req.Bucket, Key: prefix + a.Path}
+			file := filepath.Join(req.Dir, filepath.FromSlash(a.Path))
+			var err error
+			switch a.Op {
+			case SyncPut:
+				err = Upload(i, UploadRequest{PutRequest: PutRequest{
+					BasePut:    BasePut{Object: o},
+					ReaderFact: goutil.FileReaderFact{Path: file, Length: int(a.Size)},
+				}})
+			case SyncGet:
+				err = downloadFile(i, o, remote[a.Path], file)
+			case SyncDeleteLocal:
+				err = os.Remove(file)
+			}
+			done(a, err)
+		})
+	}
+	q.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for len(deletes) > 0 {
+		n := len(deletes)
+		if n > MaxDeleteObjects {
+			n = MaxDeleteObjects
+		}
+		var ids []ObjectIdentifier
+		for _, a := range deletes[:n] {
+			ids = append(ids, ObjectIdentifier{Key: prefix + a.Path})
+		}
+		r, err := i.DeleteObjects(DeleteObjectsRequest{Bucket: req.Bucket, Objects: ids, Quiet: true})
+		if err == nil {
+			err = r.Err()
+		}
+		if err != nil {
+			return err
+		}
+		for _, a := range deletes[:n] {
+			done(a, nil)
+		}
+		deletes = deletes[n:]
+	}
+	return nil
+}
+
+// downloads to a temporary file, then renames it into place with the object's modification time
+func downloadFile(i Interface, o Object, r syncFile, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file), ".s3sync")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// without a size, Download heads the object, learning whether its etag is an md5 to verify
+	_, err = Download(i, DownloadRequest{
+		GetRequest: GetRequest{Object: o, Conditions: Conditions{IfMatch: r.etag}},
+	}, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(f.Name(), r.modified, r.modified); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// whether the local and remote files have the same content, as far as we can tell.
+// when the etag isn't an md5, the copy is skipped only if the destination isn't older.
+func sameFile(i Interface, o Object, file string, l, r syncFile, dir SyncDirection) (bool, error) {
+	if l.size != r.size {
+		return false, nil
+	}
+	if md5ETag.MatchString(r.etag) {
+		sum, err := fileMD5(file)
+		if err != nil {
+			return false, err
+		}
+		if sum == r.etag {
+			return true, nil
+		}
+		// the etag may just look like an md5, as for objects encrypted with kms or a customer key
+		known, err := knownMD5(i, o)
+		if err != nil || known {
+			return false, err
+		}
+	}
+	if dir == SyncDown {
+		return !r.modified.After(l.modified), nil
+	}
+	return !l.modified.After(r.modified), nil
+}
+
+// whether an object's etag is the md5 of its contents, as far as heading it tells
+func knownMD5(i Interface, o Object) (bool, error) {
+	h, err := i.HeadObject(HeadRequest{Object: o})
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == 400 {
+		// objects encrypted with a customer key can't be headed without it
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return h.md5() != "", nil
+}
+
+func fileMD5(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// whether the slash-separated relative path should be synced
+func (req SyncRequest) filter(p string) bool {
+	match := func(globs []string) bool {
+		for _, g := range globs {
+			name := p
+			if !strings.Contains(g, "/") {
+				name = path.Base(p)
+			}
+			if ok, _ := path.Match(g, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if match(req.Exclude) {
+		return false
+	}
+	return len(req.Include) == 0 || match(req.Include)
+}
+
+func localFiles(dir string, filter func(string) bool) (map[string]syncFile, error) {
+	out := make(map[string]syncFile)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return out, nil
+	}
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".s3sync") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if filter(rel) {
+			out[rel] = syncFile{size: fi.Size(), modified: fi.ModTime()}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func remoteFiles(i Interface, bucket, prefix string, filter func(string) bool) (map[string]syncFile, error) {
+	out := make(map[string]syncFile)
+	l := NewLister(i, ListV2Request{Bucket: bucket, Prefix: prefix})
+	for l.Next() {
+		o := l.Object()
+		rel := o.Key[len(prefix):]
+		// folder markers, and keys that would land outside the directory, are skipped
+		if rel == "" || path.Clean(rel) != rel || !within(rel) || !filter(rel) {
+			continue
+		}
+		out[rel] = syncFile{size: int64(o.Size), etag: unquoteETag(o.ETag), modified: o.LastModified}
+	}
+	return out, l.Err()
+}
+
+// whether a slash-separated relative path stays inside the directory it's relative to
+func within(rel string) bool {
+	p := filepath.Clean(filepath.FromSlash(rel))
+	return p != ".." && !strings.HasPrefix(p, ".."+string(filepath.Separator)) && !filepath.IsAbs(p)
+}
+
+type byActionPath []SyncAction
+
+func (a byActionPath) Len() int {
+	return len(a)
+}
+func (a byActionPath) Less(i, j int) bool {
+	return a[i].Path < a[j].Path
+}
+func (a byActionPath) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xoba/goutil/tool"
+)
+
+// the s3sync tool, for registering with the tool package:
+//
+//	tool.Register(s3.SyncTool{S3: s3.GetDefault(auth)})
+//
+// either the source or destination is an s3 url like s3://bucket/prefix, the other a directory.
+type SyncTool struct {
+	S3 Interface
+}
+
+func (SyncTool) Name() string {
+	return "s3sync,mirror a directory to an s3 prefix or back"
+}
+
+func (t SyncTool) Run(args []string) {
+	var req SyncRequest
+	var include, exclude globs
+	flags := tool.FlagsWithDoc(t, "\nargs are SOURCE DESTINATION, one of which is s3://bucket/prefix")
+	flags.BoolVar(&req.DryRun, "dryrun", false, "just show what would be done")
+	flags.BoolVar(&req.Delete, "delete", false, "delete destination files that aren't in the source")
+	flags.Var(&include, "include", "glob of paths to sync; may be repeated")
+	flags.Var(&exclude, "exclude", "glob of paths not to sync; may be repeated")
+	flags.IntVar(&req.Concurrency, "concurrency", DefaultSyncConcurrency, "transfers at once")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	src, dst := flags.Arg(0), flags.Arg(1)
+	switch {
+	case isS3Url(dst) && !isS3Url(src):
+		req.Direction = SyncUp
+		req.Dir = src
+		req.Bucket, req.Prefix = parseS3Url(dst)
+	case isS3Url(src) && !isS3Url(dst):
+		req.Direction = SyncDown
+		req.Dir = dst
+		req.Bucket, req.Prefix = parseS3Url(src)
+	default:
+		fmt.Fprintln(os.Stderr, "need one directory and one s3://bucket/prefix")
+		os.Exit(1)
+	}
+	req.Include, req.Exclude = include, exclude
+	req.Log = func(a SyncAction) {
+		if req.DryRun {
+			fmt.Print("(dryrun) ")
+		}
+		fmt.Println(a)
+	}
+	if _, err := Sync(t.S3, req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func isS3Url(s string) bool {
+	return strings.HasPrefix(s, "s3://")
+}
+
+func parseS3Url(s string) (bucket, prefix string) {
+	parts := strings.SplitN(strings.TrimPrefix(s, "s3://"), "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// a repeatable string flag
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globs) Set(s string) error {
+	*g = append(*g, s)
+	return nil
+}
@@ -0,0 +1,214 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the version id s3 reports for objects written while versioning was off
+const NullVersion = "null"
+
+// preconditions for gets and heads. a failed If-None-Match or If-Modified-Since
+// yields an error satisfying IsNotModified; a failed If-Match or If-Unmodified-Since
+// one satisfying IsPreconditionFailed.
+type Conditions struct {
+	IfMatch           string    // etag, quoted or not, or "*"
+	IfNoneMatch       string    // etag, quoted or not, or "*"
+	IfModifiedSince   time.Time // zero means unconditional
+	IfUnmodifiedSince time.Time // zero means unconditional
+}
+
+func (c Conditions) addHeaders(h http.Header) {
+	if c.IfMatch != "" {
+		h.Set("If-Match", quoteETag(c.IfMatch))
+	}
+	if c.IfNoneMatch != "" {
+		h.Set("If-None-Match", quoteETag(c.IfNoneMatch))
+	}
+	if !c.IfModifiedSince.IsZero() {
+		h.Set("If-Modified-Since", c.IfModifiedSince.UTC().Format(http.TimeFormat))
+	}
+	if !c.IfUnmodifiedSince.IsZero() {
+		h.Set("If-Unmodified-Since", c.IfUnmodifiedSince.UTC().Format(http.TimeFormat))
+	}
+}
+
+// evaluates the conditions against an object's etag and modification time, in the order of rfc 7232
+func (c Conditions) check(etag string, modified time.Time) error {
+	switch {
+	case c.IfMatch != "" && !etagMatches(c.IfMatch, etag):
+		return &Error{StatusCode: 412, Code: "PreconditionFailed", Message: "If-Match failed"}
+	case c.IfMatch == "" && !c.IfUnmodifiedSince.IsZero() && modified.After(c.IfUnmodifiedSince):
+		return &Error{StatusCode: 412, Code: "PreconditionFailed", Message: "If-Unmodified-Since failed"}
+	case c.IfNoneMatch != "" && etagMatches(c.IfNoneMatch, etag):
+		return &Error{StatusCode: 304, Code: "NotModified"}
+	case c.IfNoneMatch == "" && !c.IfModifiedSince.IsZero() && !modified.After(c.IfModifiedSince):
+		return &Error{StatusCode: 304, Code: "NotModified"}
+	}
+	return nil
+}
+
+func etagMatches(condition, etag string) bool {
+	return condition == "*" || unquoteETag(condition) == unquoteETag(etag)
+}
+
+func quoteETag(etag string) string {
+	if etag == "*" || strings.HasPrefix(etag, `"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+func unquoteETag(etag string) string {
+	return strings.Replace(etag, `"`, "", -1)
+}
+
+// whether a conditional get or head found the object unchanged
+func IsNotModified(err error) bool {
+	return IsCode(err, "NotModified")
+}
+
+func IsPreconditionFailed(err error) bool {
+	return IsCode(err, "PreconditionFailed")
+}
+
+func IsNoSuchVersion(err error) bool {
+	return IsCode(err, "NoSuchVersion")
+}
+
+type HeadRequest struct {
+	Object    Object
+	VersionId string // optional; empty means the latest version
+	Conditions
+	Encryption *Encryption // only needed for SSE-C
+}
+
+// the head request equivalent to a get
+func (r GetRequest) head() HeadRequest {
+	return HeadRequest{Object: r.Object, VersionId: r.VersionId, Conditions: r.Conditions, Encryption: r.Encryption}
+}
+
+// sets the versionId query parameter, if any
+func setVersion(u *url.URL, versionId string) {
+	if versionId != "" {
+		u.RawQuery = encodeQuery(url.Values{"versionId": {versionId}})
+	}
+}
+
+type ListVersionsRequest struct {
+	Bucket          string
+	Prefix          string
+	Delimiter       string
+	MaxKeys         int64
+	KeyMarker       string
+	VersionIdMarker string // only with KeyMarker
+}
+
+type ListVersionsResult struct {
+	Name, Prefix, Delimiter            string
+	KeyMarker, VersionIdMarker         string
+	NextKeyMarker, NextVersionIdMarker string
+	MaxKeys                            int64
+	IsTruncated                        bool
+	Versions                           []ObjectVersion `xml:"Version"`
+	DeleteMarkers                      []DeleteMarker  `xml:"DeleteMarker"`
+	CommonPrefixes                     []CommonPrefix
+}
+
+type ObjectVersion struct {
+	Key, VersionId, ETag, StorageClass string
+	IsLatest                           bool
+	Size                               int
+	LastModified                       time.Time
+}
+
+// the latest version of a deleted key in a versioned bucket
+type DeleteMarker struct {
+	Key, VersionId string
+	IsLatest       bool
+	LastModified   time.Time
+}
+
+func (s SmartS3) HeadObject(req HeadRequest) (*HeadResponse, error) {
+	err := checkObject(req.Object)
+	if err != nil {
+		return nil, err
+	}
+	f := func() (interface{}, error) {
+		return s.head(req)
+	}
+	v, err := s.retry(str(req), f)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*HeadResponse), nil
+}
+
+func (s SmartS3) ListVersions(req ListVersionsRequest) (ListVersionsResult, error) {
+	var out ListVersionsResult
+	if req.Bucket == "" {
+		return out, errors.New("no bucket name")
+	}
+	f := func() (interface{}, error) {
+		return s.listVersions(req)
+	}
+	v, err := s.retry(str(req), f)
+	if err != nil {
+		return out, err
+	}
+	return v.(ListVersionsResult), nil
+}
+
+func (s SmartS3) listVersions(req ListVersionsRequest) (out ListVersionsResult, err error) {
+	query := make(url.Values)
+	query.Set("versions", "")
+	if req.MaxKeys > 0 {
+		query.Set("max-keys", fmt.Sprintf("%d", req.MaxKeys))
+	}
+	if req.Prefix != "" {
+		query.Set("prefix", req.Prefix)
+	}
+	if req.Delimiter != "" {
+		query.Set("delimiter", req.Delimiter)
+	}
+	if req.KeyMarker != "" {
+		query.Set("key-marker", req.KeyMarker)
+	}
+	if req.VersionIdMarker != "" {
+		query.Set("version-id-marker", req.VersionIdMarker)
+	}
+	u, err := s.createURL(Object{Bucket: req.Bucket})
+	if err != nil {
+		return
+	}
+	u.RawQuery = encodeQuery(query)
+	transport := http.DefaultTransport
+	hreq, err := s.newRequest("GET", u.String(), nil)
+	if err != nil {
+		return
+	}
+	if err = s.sign(hreq, emptySHA256); err != nil {
+		return
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return out, responseError(resp)
+	}
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, resp.Body); err != nil {
+		return
+	}
+	err = xml.Unmarshal(buf.Bytes(), &out)
+	return
+}
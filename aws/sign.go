@@ -20,14 +20,16 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -35,16 +37,37 @@ import (
 const iSO8601BasicFormat = "20060102T150405Z"
 const iSO8601BasicFormatShort = "20060102"
 
+const (
+	// payload hash for requests whose bodies aren't signed, like streamed s3 uploads
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// payload hash for aws-chunked uploads, whose chunks are signed as they're sent
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	// payload hash for aws-chunked uploads whose chunks aren't signed, ending with
+	// trailing headers like checksums
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// hex sha256 of an empty payload
+	EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
 var (
 	ErrNoDate = errors.New("Date header not supplied")
 )
 
-var lf = []byte{'\n'}
+// headers never signed, since transports and proxies may change them
+var unsignedHeaders = map[string]bool{
+	"authorization":   true,
+	"user-agent":      true,
+	"x-amzn-trace-id": true,
+}
 
 // Keys holds a set of Amazon Security Credentials.
 type Keys struct {
-	AccessKey string
-	SecretKey string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials; sent as X-Amz-Security-Token
 }
 
 func (k *Keys) sign(s *Service, t time.Time) []byte {
@@ -55,10 +78,6 @@ func (k *Keys) sign(s *Service, t time.Time) []byte {
 	return h
 }
 
-func formatTime(t time.Time) string {
-	return t.UTC().Format(http.TimeFormat)
-}
-
 // Service represents an AWS-compatible service.
 type Service struct {
 	// Name is the name of the service being used (i.e. iam, etc)
@@ -69,145 +88,257 @@ type Service struct {
 }
 
 // Sign signs an HTTP request with the given AWS keys for use on service s.
+//
+// The time is taken from the X-Amz-Date header if present (in ISO 8601 basic format),
+// otherwise from the Date header. If the X-Amz-Content-Sha256 header is present, its
+// value is used as the payload hash (e.g., UnsignedPayload), otherwise the body is hashed.
+// A session token is added, and signed, as the X-Amz-Security-Token header.
+//
+// See Signer for signing without preparing the headers.
 func (s *Service) Sign(keys *Keys, r *http.Request) error {
 	var t time.Time
 
-	date := r.Header.Get("Date")
-	if date == "" {
-		return ErrNoDate
+	if keys.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", keys.SessionToken)
 	}
 
-	t, err := time.Parse(http.TimeFormat, date)
-	if err != nil {
-		return err
+	if date := r.Header.Get("X-Amz-Date"); date != "" {
+		var err error
+		t, err = time.Parse(iSO8601BasicFormat, date)
+		if err != nil {
+			return err
+		}
+	} else {
+		date := r.Header.Get("Date")
+		if date == "" {
+			return ErrNoDate
+		}
+		var err error
+		t, err = time.Parse(http.TimeFormat, date)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Date", t.Format(iSO8601BasicFormat))
 	}
 
-	r.Header.Set("Date", t.Format(iSO8601BasicFormat))
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		var err error
+		if payload, err = hashBody(r); err != nil {
+			return err
+		}
+	}
+
+	s.authorize(keys, r, t, payload)
+	return nil
+}
 
-	k := keys.sign(s, t)
-	h := hmac.New(sha256.New, k)
-	s.writeStringToSign(h, t, r)
+// sets the Authorization header of r, whose headers are otherwise ready, returning the signature
+func (s *Service) authorize(keys *Keys, r *http.Request, t time.Time, payload string) string {
+	names := signedHeaders(r)
+	sig := s.signature(keys, t, s.canonicalRequest(r, names, payload))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s, SignedHeaders=%s, Signature=%s",
+		s.Credential(keys, t), strings.Join(names, ";"), sig))
+	return sig
+}
 
-	auth := bytes.NewBufferString("AWS4-HMAC-SHA256 ")
-	auth.Write([]byte("Credential=" + keys.AccessKey + "/" + s.creds(t)))
-	auth.Write([]byte{',', ' '})
-	auth.Write([]byte("SignedHeaders="))
-	s.writeHeaderList(auth, r)
-	auth.Write([]byte{',', ' '})
-	auth.Write([]byte("Signature=" + fmt.Sprintf("%x", h.Sum(nil))))
+// Presign adds a signature to r's query string, valid for the given duration starting at t.
+// The host header is signed along with any headers already set on r, which clients must
+// then send with the same values. The payload is unsigned, and a session token is added
+// to the query string.
+func (s *Service) Presign(keys *Keys, r *http.Request, t time.Time, expires time.Duration) error {
+	t = t.UTC()
+	names := signedHeaders(r)
+
+	q := r.URL.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.Credential(keys, t))
+	q.Set("X-Amz-Date", t.Format(iSO8601BasicFormat))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", strings.Join(names, ";"))
+	if keys.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", keys.SessionToken)
+	}
+	r.URL.RawQuery = encodeQuery(q)
 
-	r.Header.Set("Authorization", auth.String())
+	// s3 doesn't sign presigned payloads; other services sign them as empty
+	payload := EmptyPayload
+	if s.Name == "s3" {
+		payload = UnsignedPayload
+	}
+	q.Set("X-Amz-Signature", s.signature(keys, t, s.canonicalRequest(r, names, payload)))
+	r.URL.RawQuery = encodeQuery(q)
 
 	return nil
 }
 
-func (s *Service) writeQuery(w io.Writer, r *http.Request) {
-	var a []string
-	for k, vs := range r.URL.Query() {
-		k = url.QueryEscape(k)
-		for _, v := range vs {
-			if v == "" {
-				a = append(a, k)
-			} else {
-				v = url.QueryEscape(v)
-				a = append(a, k+"="+v)
-			}
-		}
-	}
-	sort.Strings(a)
-	for i, s := range a {
-		if i > 0 {
-			w.Write([]byte{'&'})
-		}
-		w.Write([]byte(s))
-	}
+// Credential is the access key and scope of a signature made at time t, as used in
+// presigned urls and POST policies.
+func (s *Service) Credential(keys *Keys, t time.Time) string {
+	return keys.AccessKey + "/" + s.creds(t.UTC())
 }
 
-func (s *Service) writeHeader(w io.Writer, r *http.Request) {
-	i, a := 0, make([]string, len(r.Header))
-	for k, v := range r.Header {
-		sort.Strings(v)
-		a[i] = strings.ToLower(k) + ":" + strings.Join(v, ",")
-		i++
-	}
-	sort.Strings(a)
-	for i, s := range a {
-		if i > 0 {
-			w.Write(lf)
+// SignPolicy returns the hex signature of a base64-encoded POST policy, for browser-based
+// uploads, made at time t.
+func (s *Service) SignPolicy(keys *Keys, t time.Time, policy string) string {
+	return fmt.Sprintf("%x", ghmac(keys.sign(s, t.UTC()), []byte(policy)))
+}
+
+// like url.Values.Encode, but with spaces as "%20", which aws requires
+func encodeQuery(v url.Values) string {
+	return strings.Replace(v.Encode(), "+", "%20", -1)
+}
+
+// escapes all but the characters sigv4 leaves unreserved
+func escape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
 		}
-		io.WriteString(w, s)
 	}
+	return buf.String()
 }
 
-func (s *Service) writeHeaderList(w io.Writer, r *http.Request) {
-	i, a := 0, make([]string, len(r.Header))
+// the lower-case names of the headers to sign, including host, sorted
+func signedHeaders(r *http.Request) []string {
+	names := []string{"host"}
 	for k := range r.Header {
-		a[i] = strings.ToLower(k)
-		i++
-	}
-	sort.Strings(a)
-	for i, s := range a {
-		if i > 0 {
-			w.Write([]byte{';'})
+		if k := strings.ToLower(k); k != "host" && !unsignedHeaders[k] {
+			names = append(names, k)
 		}
-		w.Write([]byte(s))
 	}
+	sort.Strings(names)
+	return names
 }
 
-func (s *Service) writeBody(w io.Writer, r *http.Request) {
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
+// the host the request is sent to
+func host(r *http.Request) string {
+	if r.Host != "" {
+		return r.Host
 	}
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-
-	h := sha256.New()
-	h.Write(b)
-	fmt.Fprintf(w, "%x", h.Sum(nil))
+	return r.URL.Host
 }
 
-func (s *Service) writeURI(w io.Writer, r *http.Request) {
-	path := r.URL.RequestURI()
-	if r.URL.RawQuery != "" {
-		path = path[:len(path)-len(r.URL.RawQuery)-1]
+// a header's values, trimmed and with inner runs of spaces collapsed, comma-separated
+func headerValue(r *http.Request, name string) string {
+	if name == "host" {
+		return host(r)
 	}
-	slash := strings.HasSuffix(path, "/")
-	path = filepath.Clean(path)
-	if path != "/" && slash {
-		path += "/"
+	vs := r.Header[http.CanonicalHeaderKey(name)]
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		out[i] = strings.Join(strings.Fields(v), " ")
 	}
-	w.Write([]byte(path))
+	return strings.Join(out, ",")
 }
 
-func (s *Service) writeRequest(w io.Writer, r *http.Request) {
-	r.Header.Set("host", r.Host)
+// the path as sent. s3 uses it verbatim, since keys may contain "//", "." and so on;
+// other services normalize it and escape it again, so escapes are doubly escaped.
+func (s *Service) canonicalURI(u *url.URL) string {
+	p := u.EscapedPath()
+	if u.Opaque != "" {
+		// e.g. "//host/path", for paths that mustn't be re-escaped
+		p = u.Opaque
+		if strings.HasPrefix(p, "//") {
+			p = p[2:]
+			if i := strings.Index(p, "/"); i >= 0 {
+				p = p[i:]
+			} else {
+				p = "/"
+			}
+		}
+	}
+	if p == "" {
+		p = "/"
+	}
+	if s.Name == "s3" {
+		return p
+	}
+	slash := strings.HasSuffix(p, "/")
+	p = path.Clean(p)
+	if p != "/" && slash {
+		p += "/"
+	}
+	parts := strings.Split(p, "/")
+	for i, x := range parts {
+		parts[i] = escape(x)
+	}
+	return strings.Join(parts, "/")
+}
 
-	w.Write([]byte(r.Method))
-	w.Write(lf)
-	s.writeURI(w, r)
-	w.Write(lf)
-	s.writeQuery(w, r)
-	w.Write(lf)
-	s.writeHeader(w, r)
-	w.Write(lf)
-	w.Write(lf)
-	s.writeHeaderList(w, r)
-	w.Write(lf)
-	s.writeBody(w, r)
+// the query string, escaped strictly and sorted by key and then value
+func canonicalQuery(u *url.URL) string {
+	type pair struct{ k, v string }
+	var a []pair
+	for k, vs := range u.Query() {
+		for _, v := range vs {
+			a = append(a, pair{escape(k), escape(v)})
+		}
+	}
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].k != a[j].k {
+			return a[i].k < a[j].k
+		}
+		return a[i].v < a[j].v
+	})
+	out := make([]string, len(a))
+	for i, p := range a {
+		out[i] = p.k + "=" + p.v
+	}
+	return strings.Join(out, "&")
 }
 
-func (s *Service) writeStringToSign(w io.Writer, t time.Time, r *http.Request) {
-	w.Write([]byte("AWS4-HMAC-SHA256"))
-	w.Write(lf)
-	w.Write([]byte(t.Format(iSO8601BasicFormat)))
-	w.Write(lf)
+func (s *Service) canonicalRequest(r *http.Request, names []string, payload string) string {
+	var buf bytes.Buffer
+	buf.WriteString(r.Method + "\n")
+	buf.WriteString(s.canonicalURI(r.URL) + "\n")
+	buf.WriteString(canonicalQuery(r.URL) + "\n")
+	for _, k := range names {
+		buf.WriteString(k + ":" + headerValue(r, k) + "\n")
+	}
+	buf.WriteString("\n")
+	buf.WriteString(strings.Join(names, ";") + "\n")
+	buf.WriteString(payload)
+	return buf.String()
+}
 
-	w.Write([]byte(s.creds(t)))
-	w.Write(lf)
+// the hex signature of a canonical request made at t
+func (s *Service) signature(keys *Keys, t time.Time, creq string) string {
+	h := sha256.Sum256([]byte(creq))
+	sts := "AWS4-HMAC-SHA256\n" + t.Format(iSO8601BasicFormat) + "\n" + s.creds(t) + "\n" + hex.EncodeToString(h[:])
+	return hex.EncodeToString(ghmac(keys.sign(s, t), []byte(sts)))
+}
 
+// hex sha256 of the body, which is read from a copy if r.GetBody is set, and otherwise
+// read into memory and replaced
+func hashBody(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return EmptyPayload, nil
+	}
 	h := sha256.New()
-	s.writeRequest(h, r)
-	fmt.Fprintf(w, "%x", h.Sum(nil))
+	if r.GetBody != nil {
+		b, err := r.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer b.Close()
+		if _, err := io.Copy(h, b); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func (s *Service) creds(t time.Time) string {
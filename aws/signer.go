@@ -0,0 +1,186 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the smallest chunk, other than the last, s3 accepts in an aws-chunked upload
+const MinChunkSize = 8 << 10
+
+// signs requests for one service and region with credentials from a provider,
+// retrieved anew for each request. safe for concurrent use.
+type Signer struct {
+	Service     string // e.g., "s3" or "dynamodb"
+	Region      string // e.g., "us-east-1"
+	Credentials Provider
+}
+
+func NewSigner(service, region string, p Provider) *Signer {
+	return &Signer{Service: service, Region: region, Credentials: p}
+}
+
+func (s *Signer) service() *Service {
+	return &Service{Name: s.Service, Region: s.Region}
+}
+
+func (s *Signer) keys() (*Keys, error) {
+	if s.Credentials == nil {
+		return nil, ErrNoCredentials
+	}
+	c, err := s.Credentials.Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	keys := c.Keys()
+	return &keys, nil
+}
+
+// Sign sets the X-Amz-Date, X-Amz-Security-Token (for session tokens) and Authorization
+// headers of r, made at time t. payloadHash is the hex sha256 of the body, if the caller
+// already knows it, or UnsignedPayload; if empty, the body is hashed, from a copy if
+// r.GetBody is set. s3 requests also get the X-Amz-Content-Sha256 header s3 requires.
+func (s *Signer) Sign(r *http.Request, payloadHash string, t time.Time) error {
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	if payloadHash == "" {
+		if payloadHash, err = hashBody(r); err != nil {
+			return err
+		}
+	}
+	s.prepare(r, keys, t)
+	if s.Service == "s3" {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	s.service().authorize(keys, r, t.UTC(), payloadHash)
+	return nil
+}
+
+func (s *Signer) prepare(r *http.Request, keys *Keys, t time.Time) {
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Amz-Date", t.UTC().Format(iSO8601BasicFormat))
+	if keys.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", keys.SessionToken)
+	} else {
+		r.Header.Del("X-Amz-Security-Token")
+	}
+}
+
+// Presign adds a signature to r's query string, valid for the given duration starting at t.
+// See Service.Presign.
+func (s *Signer) Presign(r *http.Request, t time.Time, expires time.Duration) error {
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	return s.service().Presign(keys, r, t, expires)
+}
+
+// SignStreaming signs r as an aws-chunked s3 upload, so the body needn't be hashed in
+// advance. r's body, of decodedLength bytes, is replaced by one sending it in chunks of
+// chunkSize (at least MinChunkSize), each signed in turn as it's read, and its content
+// length is set to that of the encoded body.
+func (s *Signer) SignStreaming(r *http.Request, t time.Time, decodedLength int64, chunkSize int) error {
+	if chunkSize < MinChunkSize {
+		return fmt.Errorf("chunk size %d is less than %d", chunkSize, MinChunkSize)
+	}
+	if decodedLength < 0 {
+		return errors.New("streaming requires a known content length")
+	}
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	t = t.UTC()
+	s.prepare(r, keys, t)
+	length := encodedLength(decodedLength, chunkSize)
+	r.Header.Set("Content-Encoding", "aws-chunked")
+	r.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(decodedLength, 10))
+	r.Header.Set("X-Amz-Content-Sha256", StreamingPayload)
+	r.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	svc := s.service()
+	seed := svc.authorize(keys, r, t, StreamingPayload)
+
+	body := r.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	r.Body = &chunkedReader{
+		body:   body,
+		buf:    make([]byte, chunkSize),
+		key:    keys.sign(svc, t),
+		prefix: "AWS4-HMAC-SHA256-PAYLOAD\n" + t.Format(iSO8601BasicFormat) + "\n" + svc.creds(t) + "\n",
+		prev:   seed,
+	}
+	r.ContentLength = length
+	r.GetBody = nil
+	return nil
+}
+
+// the length of an aws-chunked body: full chunks, a partial one if any, then an empty one
+func encodedLength(n int64, chunkSize int) int64 {
+	size := int64(chunkSize)
+	length := (n / size) * chunkLength(size)
+	if rest := n % size; rest > 0 {
+		length += chunkLength(rest)
+	}
+	return length + chunkLength(0)
+}
+
+// "<hex size>;chunk-signature=<64 hex>\r\n<data>\r\n"
+func chunkLength(n int64) int64 {
+	return int64(len(strconv.FormatInt(n, 16))) + int64(len(";chunk-signature=")) + 64 + 2 + n + 2
+}
+
+// encodes a body as signed chunks, each signature chaining from the previous one
+type chunkedReader struct {
+	body   io.ReadCloser
+	buf    []byte // holds a chunk's data as it's read
+	key    []byte
+	prefix string // of each chunk's string to sign
+	prev   string // the previous signature, initially the request's
+	out    []byte // encoded but not yet returned
+	done   bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(c.body, c.buf)
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+		default:
+			return 0, err
+		}
+		c.out = c.chunk(c.buf[:n])
+		if n == 0 {
+			c.done = true
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) chunk(data []byte) []byte {
+	h := sha256.Sum256(data)
+	sts := c.prefix + c.prev + "\n" + EmptyPayload + "\n" + hex.EncodeToString(h[:])
+	c.prev = hex.EncodeToString(ghmac(c.key, []byte(sts)))
+	out := []byte(strconv.FormatInt(int64(len(data)), 16) + ";chunk-signature=" + c.prev + "\r\n")
+	out = append(out, data...)
+	return append(out, "\r\n"...)
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
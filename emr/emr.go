@@ -229,6 +229,7 @@ func runStreamingReducer(r Reducer) {
 type Flow struct {
 	IsSpot             bool
 	Auth               aws.Auth
+	Credentials        aws.Provider `json:"-"` // if set, used instead of Auth
 	Steps              []Step
 	Instances          int
 	MasterInstanceType string
@@ -273,7 +274,7 @@ func Run(flow Flow) (*RunFlowResponse, error) {
 
 	id := fmt.Sprintf("%s-%s_%s_%s", tool.Name(flow.Steps[0].Mapper), tool.Name(flow.Steps[0].Reducer), time.Now().UTC().Format("20060102T150405Z"), uuid.New()[:4])
 
-	ss3 := s3.GetDefault(flow.Auth)
+	ss3 := s3.GetDefault(flow.provider())
 
 	v := make(url.Values)
 
@@ -338,13 +339,13 @@ func Run(flow Flow) (*RunFlowResponse, error) {
 			var args []string
 			args = append(args, fmt.Sprintf("-indirect=%v", step.IndirectMapJob))
 			args = append(args, step.Args...)
-			check(ss3.PutObject(s3.PutObjectRequest{BasePut: s3.BasePut{Object: mapperObject, ContentType: "application/octet-stream"}, Data: []byte(createScript(step.Mapper, step.ToolChecker, args...))}))
+			check(uploadScript(ss3, mapperObject, createScript(step.Mapper, step.ToolChecker, args...)))
 		}
 
 		{
 			var args []string
 			args = append(args, step.Args...)
-			check(ss3.PutObject(s3.PutObjectRequest{BasePut: s3.BasePut{Object: reducerObject, ContentType: "application/octet-stream"}, Data: []byte(createScript(step.Reducer, step.ToolChecker, args...))}))
+			check(uploadScript(ss3, reducerObject, createScript(step.Reducer, step.ToolChecker, args...)))
 		}
 
 		{
@@ -418,7 +419,10 @@ func Run(flow Flow) (*RunFlowResponse, error) {
 		}
 	}
 
-	u := createSignedURL(flow.Auth, v)
+	u, err := createSignedURL(flow.provider(), v)
+	if err != nil {
+		return nil, err
+	}
 
 	resp, err := runReq(u)
 	if err != nil {
@@ -518,13 +522,28 @@ func validate(f Flow) {
 	isNull("KeyName", f.KeyName)
 }
 
-func createSignedURL(auth aws.Auth, v url.Values) string {
+func (f Flow) provider() aws.Provider {
+	if f.Credentials != nil {
+		return f.Credentials
+	}
+	return f.Auth
+}
+
+func createSignedURL(p aws.Provider, v url.Values) (string, error) {
+
+	auth, err := p.Retrieve()
+	if err != nil {
+		return "", err
+	}
 
 	v.Set("Version", "2009-03-31")
 	v.Set("SignatureVersion", "2")
 	v.Set("SignatureMethod", "HmacSHA256")
 	v.Set("AWSAccessKeyId", auth.AccessKey)
 	v.Set("Timestamp", iso(time.Now()))
+	if auth.SessionToken != "" {
+		v.Set("SecurityToken", auth.SessionToken)
+	}
 
 	var lines []string
 
@@ -541,7 +560,7 @@ func createSignedURL(auth aws.Auth, v url.Values) string {
 
 	v.Set("Signature", ghmac(auth.SecretKey, str))
 
-	return fmt.Sprintf("https://elasticmapreduce.amazonaws.com?%s", encode(v))
+	return fmt.Sprintf("https://elasticmapreduce.amazonaws.com?%s", encode(v)), nil
 
 }
 
@@ -677,6 +696,15 @@ func createScript(t tool.Interface, checker ToolChecker, args ...string) string
 	return string(f.Bytes())
 }
 
+func uploadScript(ss3 s3.Interface, o s3.Object, script string) error {
+	return s3.Upload(ss3, s3.UploadRequest{
+		PutRequest: s3.PutRequest{
+			BasePut:    s3.BasePut{Object: o, ContentType: "application/octet-stream"},
+			ReaderFact: goutil.BufferReaderFact{Buffer: []byte(script)},
+		},
+	})
+}
+
 func toUrl(o s3.Object) string {
 	return fmt.Sprintf("s3n://%s/%s", o.Bucket, o.Key)
 }
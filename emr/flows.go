@@ -121,11 +121,13 @@ func ParseEmrResponse(r io.Reader) (*RunFlowResponse, error) {
 	return &x, nil
 }
 
-func FetchFlow(a aws.Auth, flow string) *FlowsResponse {
+// a may be a static aws.Auth
+func FetchFlow(a aws.Provider, flow string) *FlowsResponse {
 	v := make(url.Values)
 	v.Set("Action", "DescribeJobFlows")
 	v.Set("JobFlowIds.member.1", flow)
-	u := createSignedURL(a, v)
+	u, err := createSignedURL(a, v)
+	check(err)
 	resp, err := runReq(u)
 	check(err)
 	defer resp.Close()
@@ -222,9 +224,10 @@ func LoadLines2(ss3 s3.Interface, output *StepLocation, threads int, decider Url
 		wg.Add(1)
 		go func() {
 			for o := range ch {
-				fn := o.Object().Url()
+				fn := s3.Url(ss3, o.Object())
 				if decider(fn) {
-					r, err := ss3.Get(s3.GetRequest{Object: o.Object()})
+					// no etag: listings don't say how objects are encrypted, so it may not be an md5
+					r, err := s3.ParallelGet(ss3, s3.DownloadRequest{GetRequest: s3.GetRequest{Object: o.Object()}, Size: int64(o.Size)})
 					check(err)
 					defer r.Close()
 					if strings.HasSuffix(o.Key, ".gz") {
@@ -248,7 +251,7 @@ func LoadLines2(ss3 s3.Interface, output *StepLocation, threads int, decider Url
 			wg.Done()
 		}()
 	}
-	List(ss3, output, ch)
+	check(List(ss3, output, ch))
 	wg.Wait()
 	close(ch2)
 	wg2.Wait()
@@ -262,10 +265,10 @@ func LoadLines3(ss3 s3.Interface, output *StepLocation, threads int, proc FilePr
 		wg.Add(1)
 		go func() {
 			for o := range ch {
-				fn := o.Object().Url()
+				fn := s3.Url(ss3, o.Object())
 				p := proc.ForFile(fn, o.Size)
 				for p != nil {
-					r, err := ss3.Get(s3.GetRequest{Object: o.Object()})
+					r, err := s3.ParallelGet(ss3, s3.DownloadRequest{GetRequest: s3.GetRequest{Object: o.Object()}, Size: int64(o.Size)})
 					if err != nil {
 						if p = proc.Failure(fn, o.Size, err); p != nil {
 							continue
@@ -299,7 +302,7 @@ func LoadLines3(ss3 s3.Interface, output *StepLocation, threads int, proc FilePr
 			wg.Done()
 		}()
 	}
-	List(ss3, output, ch)
+	check(List(ss3, output, ch))
 	wg.Wait()
 }
 
@@ -323,30 +326,23 @@ type FileKeyValue struct {
 	Item     *KeyValue
 }
 
-// randomize order of each listing batch
-func List(ss3 s3.Interface, output *StepLocation, ch chan s3.ListedObject) {
-	var marker string
-	for {
-		r, err := ss3.List(s3.ListRequest{MaxKeys: 1000, Bucket: output.Bucket, Prefix: output.Prefix, Marker: marker})
-		if err != nil {
-			panic(err)
-		}
-
-		p := rand.Perm(len(r.Contents))
-
-		for i := 0; i < len(r.Contents); i++ {
-			v := r.Contents[p[i]]
-			ch <- s3.ListedObject{
-				ListBucketResultContents: v,
-				Bucket: output.Bucket,
-			}
+// randomize order of each listing batch; closes ch when done, even on error
+func List(ss3 s3.Interface, output *StepLocation, ch chan s3.ListedObject) error {
+	defer close(ch)
+	var batch []s3.ListedObject
+	flush := func() {
+		for _, i := range rand.Perm(len(batch)) {
+			ch <- batch[i]
 		}
-
-		if r.IsTruncated {
-			marker = r.Contents[len(r.Contents)-1].Key
-		} else {
-			break
+		batch = batch[:0]
+	}
+	l := s3.NewLister(ss3, s3.ListV2Request{MaxKeys: 1000, Bucket: output.Bucket, Prefix: output.Prefix})
+	for l.Next() {
+		batch = append(batch, l.Object())
+		if len(batch) == 1000 {
+			flush()
 		}
 	}
-	close(ch)
+	flush()
+	return l.Err()
 }
@@ -1,6 +1,30 @@
 package goutil
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
 
 func TestBogus(t *testing.T) {
 }
+
+func TestRetryIfContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	f := func() (interface{}, error) {
+		calls++
+		return nil, errors.New("failed")
+	}
+	start := time.Now()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	strat := RetryBackoffStrat{Delay: time.Hour, Retries: 3}
+	_, err := RetryIfContext(ctx, "test", strat.NewInstance(), func(error) bool { return true }, f)
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("expected cancellation after one call, got %v after %d", err, calls)
+	}
+	if time.Since(start) > time.Minute {
+		t.Error("backoff wasn't interrupted")
+	}
+}
@@ -223,12 +223,14 @@ func (log *logger) saveToS3(path string) error {
 		Bucket: log.bucket,
 		Key:    fmt.Sprintf("%s_%s_%s.json", uuid.New(), log.run, time.Now().UTC().Format("20060102T150405Z")),
 	}
-	return log.ss3.Put(s3.PutRequest{
-		BasePut: s3.BasePut{
-			Object:      o,
-			ContentType: "application/json",
+	return s3.Upload(log.ss3, s3.UploadRequest{
+		PutRequest: s3.PutRequest{
+			BasePut: s3.BasePut{
+				Object:      o,
+				ContentType: "application/json",
+			},
+			ReaderFact: rf,
 		},
-		ReaderFact: rf,
 	})
 }
 
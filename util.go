@@ -4,6 +4,7 @@ package goutil
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -88,6 +89,39 @@ func (r *RetryBackoffStratInstance) Retry() bool {
 	return false
 }
 
+// like Retry, but the backoff ends early, without retrying, if ctx is done
+func (r *RetryBackoffStratInstance) RetryContext(ctx context.Context) bool {
+	if r.count < r.retries {
+		r.count++
+		if !SleepRandContext(ctx, r.delay) {
+			return false
+		}
+		r.delay = time.Duration(int64(r.factor * float64(r.delay)))
+		return true
+	}
+	return false
+}
+
+// implemented by strategy instances whose backoff can be interrupted
+type ContextRetrier interface {
+	RetryContext(ctx context.Context) bool
+}
+
+// like SleepRand, but returns false as soon as ctx is done
+func SleepRandContext(ctx context.Context, t time.Duration) bool {
+	if t > 0 {
+		t += time.Duration(rand.Int63n(int64(t)))
+	}
+	timer := time.NewTimer(t)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 /*
  sleeps the given amount of time, and then some similarly scaled amount, randomly
 */
@@ -97,16 +131,36 @@ func SleepRand(t time.Duration) {
 
 // retries something, generically
 func Retry(msg string, bs RetryStrategyInstance, f func() (interface{}, error)) (v interface{}, err error) {
-	retries := 0
+	return RetryIf(msg, bs, func(error) bool { return true }, f)
+}
+
+// like Retry, but gives up immediately on errors for which retryable returns false
+func RetryIf(msg string, bs RetryStrategyInstance, retryable func(error) bool, f func() (interface{}, error)) (v interface{}, err error) {
+	return RetryIfContext(context.Background(), msg, bs, retryable, f)
+}
+
+// like RetryIf, but stops once ctx is done, returning ctx.Err() if that's during a backoff.
+// backoffs are interrupted if bs is a ContextRetrier.
+func RetryIfContext(ctx context.Context, msg string, bs RetryStrategyInstance, retryable func(error) bool, f func() (interface{}, error)) (v interface{}, err error) {
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		v, err = f()
-		if err == nil {
+		if err == nil || ctx.Err() != nil || !retryable(err) {
 			return
 		}
-		if !bs.Retry() {
-			return
+		var retry bool
+		if cr, ok := bs.(ContextRetrier); ok {
+			retry = cr.RetryContext(ctx)
 		} else {
-			retries++
+			retry = bs.Retry()
+		}
+		if !retry {
+			if ctx.Err() != nil {
+				return v, ctx.Err()
+			}
+			return
 		}
 	}
 }